@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CrawlBudget holds the limits after which a crawl is wound down.
+// A zero value for any of the limits means there is no limit.
+type CrawlBudget struct {
+	MaxPages       int
+	MaxNewListings int
+	MaxDuration    time.Duration
+	MaxErrorsInRow int
+}
+
+// Reasons a crawl can be stopped for
+const (
+	StopMaxPages       = "max pages reached"
+	StopMaxNewListings = "max new listings reached"
+	StopMaxDuration    = "max duration reached"
+	StopMaxErrorsInRow = "max errors in a row reached"
+	StopFrontierEmpty  = "frontier empty"
+	StopInterrupted    = "interrupted"
+	StopLockLost       = "lock lost"
+)
+
+// ExceededBy returns the reason the budget has been used up by
+// the given stats, or an empty string if there is budget left.
+func (self CrawlBudget) ExceededBy(stats *crawlStats) string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if self.MaxPages > 0 && stats.pages >= self.MaxPages {
+		return StopMaxPages
+	}
+	if self.MaxNewListings > 0 && stats.newListings >= self.MaxNewListings {
+		return StopMaxNewListings
+	}
+	if self.MaxErrorsInRow > 0 && stats.errorsInRow >= self.MaxErrorsInRow {
+		return StopMaxErrorsInRow
+	}
+	if self.MaxDuration > 0 && time.Since(stats.started) >= self.MaxDuration {
+		return StopMaxDuration
+	}
+	return ""
+}
+
+// crawlStats keeps track of the progress of a running crawl, it's
+// shared between the workers and the router.
+type crawlStats struct {
+	mu sync.Mutex
+
+	started       time.Time
+	pages         int
+	errors        int
+	errorsInRow   int
+	newListings   int
+	inFlight      int
+	frontierSaved int
+}
+
+func newCrawlStats() *crawlStats {
+	return &crawlStats{started: time.Now()}
+}
+
+// pageFetched records the outcome of a single page fetch
+func (self *crawlStats) pageFetched(ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.pages++
+	if ok {
+		self.errorsInRow = 0
+	} else {
+		self.errors++
+		self.errorsInRow++
+	}
+}
+
+func (self *crawlStats) listingRegistered() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.newListings++
+}
+
+// startWork/finishWork bracket a uri handed out to a worker, so we
+// know when nothing is left that could produce new links.
+func (self *crawlStats) startWork() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.inFlight++
+}
+
+func (self *crawlStats) finishWork() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.inFlight--
+}
+
+func (self *crawlStats) idle() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.inFlight <= 0
+}
+
+func (self *crawlStats) savedFrontier(count int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.frontierSaved += count
+}
+
+func (self *crawlStats) Summary(reason string) string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return fmt.Sprintf("Crawl stopped: %s\n"+
+		"  pages fetched:  %d (errors: %d)\n"+
+		"  new listings:   %d\n"+
+		"  frontier saved: %d\n"+
+		"  elapsed:        %v\n",
+		reason, self.pages, self.errors, self.newListings,
+		self.frontierSaved, time.Since(self.started))
+}
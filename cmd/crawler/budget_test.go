@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCrawlBudgetExceededBy(t *testing.T) {
+
+	type inOut struct {
+		budget CrawlBudget
+		stats  *crawlStats
+		expect string
+	}
+
+	now := time.Now()
+	cases := []inOut{
+		{CrawlBudget{}, &crawlStats{started: now, pages: 1000, errorsInRow: 50}, ""},
+		{CrawlBudget{MaxPages: 10}, &crawlStats{started: now, pages: 9}, ""},
+		{CrawlBudget{MaxPages: 10}, &crawlStats{started: now, pages: 10}, StopMaxPages},
+		{CrawlBudget{MaxNewListings: 5}, &crawlStats{started: now, newListings: 5}, StopMaxNewListings},
+		{CrawlBudget{MaxErrorsInRow: 3}, &crawlStats{started: now, errors: 10, errorsInRow: 2}, ""},
+		{CrawlBudget{MaxErrorsInRow: 3}, &crawlStats{started: now, errorsInRow: 3}, StopMaxErrorsInRow},
+		{CrawlBudget{MaxDuration: time.Hour}, &crawlStats{started: now.Add(-time.Minute)}, ""},
+		{CrawlBudget{MaxDuration: time.Hour}, &crawlStats{started: now.Add(-2 * time.Hour)}, StopMaxDuration},
+	}
+
+	for _, c := range cases {
+		got := c.budget.ExceededBy(c.stats)
+		if got != c.expect {
+			t.Errorf("%+v.ExceededBy(pages: %d) == %q, expected %q", c.budget, c.stats.pages, got, c.expect)
+		}
+	}
+}
+
+func TestCrawlStatsErrorsInRow(t *testing.T) {
+
+	stats := newCrawlStats()
+	stats.pageFetched(false)
+	stats.pageFetched(false)
+	stats.pageFetched(true)
+	stats.pageFetched(false)
+
+	if stats.pages != 4 || stats.errors != 3 || stats.errorsInRow != 1 {
+		t.Errorf("unexpected stats after fetches: %d pages, %d errors, %d in a row", stats.pages, stats.errors, stats.errorsInRow)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmshelby/photochem/home"
+)
+
+const (
+	PagePriority         = 0
+	ListingPriority      = 1
+	DistributedPollDelay = time.Second
+)
+
+// crawlDistributed runs the crawl against a work queue shared through
+// the database, any number of crawler processes can join the same
+// named crawl. The wait time becomes the delay between fetches against
+// a host, across all of them. Returns once the crawl is stopped and
+// drained.
+func crawlDistributed(ctx context.Context, name string, numberOfWorkers int, waitTime time.Duration) {
+
+	queue := homeDb.NewWorkQueue(name, waitTime)
+	fmt.Printf("Joining distributed crawl: %s (worker id: %s)\n", name, queue.Owner)
+
+	// Only gets added if nobody has started this crawl before
+	pushLinks(queue, []string{startUri})
+
+	for i := 0; i < numberOfWorkers; i++ {
+		fmt.Println("Staring up worker ", i+1)
+		go distributedWorker(ctx, queue, i+1)
+		GlobalWG.Add(1)
+	}
+
+	go distributedMonitor(ctx, queue)
+	GlobalWG.Add(1)
+
+	GlobalWG.Wait()
+}
+
+// distributedMonitor watches the budget, and the shared queue for when
+// there's nothing left to do.
+func distributedMonitor(ctx context.Context, queue *home.WorkQueue) {
+
+	defer GlobalWG.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if reason := budget.ExceededBy(stats); reason != "" {
+			requestStop(reason)
+			continue
+		}
+
+		// Links are pushed before items are acked, so claimed items
+		// keep this from hitting zero while there's more coming
+		remaining, err := queue.Remaining()
+		if err != nil {
+			fmt.Println("[ERR] Problem counting remaining work: ", err)
+			continue
+		}
+		if remaining == 0 {
+			requestStop(StopFrontierEmpty)
+		}
+	}
+}
+
+func distributedWorker(ctx context.Context, queue *home.WorkQueue, workerNumber int) {
+
+	defer GlobalWG.Done()
+
+	for ctx.Err() == nil {
+
+		item, err := queue.Claim()
+		if err != nil {
+			if err != home.ErrNoWork {
+				fmt.Println("[ERR] Problem claiming work: ", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(DistributedPollDelay):
+			}
+			continue
+		}
+
+		links, fetched := crawl(ctx, item.Url)
+		if fetched {
+			pushLinks(queue, links)
+			err = queue.Ack(item)
+		} else if ctx.Err() != nil {
+			// Cut off by shutdown, let someone else have it
+			err = queue.Release(item)
+		} else {
+			err = queue.Fail(item)
+		}
+		if err != nil {
+			fmt.Println("[ERR] Problem finishing work: ", err)
+		}
+	}
+}
+
+// pushLinks routes links onto the shared queue, listings first
+func pushLinks(queue *home.WorkQueue, links []string) {
+
+	var listings, pages []string
+	for _, link := range links {
+		if isListingUri(link) {
+			if !doesListingExist(link) {
+				listings = append(listings, link)
+			}
+		} else {
+			pages = append(pages, link)
+		}
+	}
+
+	if _, err := queue.Push(ListingPriority, listings...); err != nil {
+		fmt.Println("[ERR] Problem queueing listings: ", err)
+	}
+	if _, err := queue.Push(PagePriority, pages...); err != nil {
+		fmt.Println("[ERR] Problem queueing pages: ", err)
+	}
+}
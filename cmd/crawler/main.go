@@ -2,160 +2,239 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"flag"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/jmshelby/photochem/config"
 	"github.com/jmshelby/photochem/home"
 )
 
-const (
-	DefaultWaitTime        = 2000
-	DefaultNumberOfWorkers = 3
-)
-
 var startUri string
 var originalHost string
 var homeDb *home.DB
+var processLock home.Locker
 var GlobalWG sync.WaitGroup
 
+var fetchConfig = config.Defaults().Fetch
+var crawlFilters = config.Defaults().Filters
+
+var budget CrawlBudget
+var stats *crawlStats
+
+// Cancelled once the crawl should wind down
+var crawlCtx context.Context
+var stopCrawl context.CancelFunc
+var stopOnce sync.Once
+var stopReason string
+
 func main() {
 
+	crawlCtx, stopCrawl = context.WithCancel(context.Background())
+
 	initDestruct()
 
-	flag.Parse()
-	args := flag.Args()
-	fmt.Println(args)
-	if len(args) < 1 {
-		fmt.Println("Please specify start page")
-		os.Exit(1)
+	cfg := config.Defaults()
+	config.MustLoad("crawler", cfg, &cfg.DB, &cfg.Fetch, &cfg.Filters, &cfg.Lock, &cfg.Crawl, &cfg.Geocode, &cfg.Notify)
+
+	fetchConfig = cfg.Fetch
+	crawlFilters = cfg.Filters
+	budget = CrawlBudget{
+		MaxPages:       cfg.Crawl.MaxPages,
+		MaxNewListings: cfg.Crawl.MaxNewListings,
+		MaxDuration:    cfg.Crawl.MaxDuration.Duration(),
+		MaxErrorsInRow: cfg.Crawl.MaxErrorsInRow,
 	}
 
 	// TODO -- add arg for pattern matching?? (or just use hostname?)
-	startUri = args[0]
+	startUri = cfg.Crawl.StartUrl
 
 	startUrl, _ := url.Parse(startUri)
 	originalHost = startUrl.Host
 
-	if len(args) < 2 {
-		fmt.Println("Please specify db host")
+	// Start Up access to our listings
+	homeDb = home.NewDB(cfg.DB.Host, cfg.DB.Name)
+
+	// Listings without coordinates get them from their address
+	geocoder, err := home.NewGeocoder(cfg.Geocode.Provider, cfg.Geocode.ZipCentroids, cfg.Geocode.GoogleAPIKey)
+	if err != nil {
+		fmt.Println("Problem setting up geocoder: ", err)
 		os.Exit(1)
 	}
-	if len(args) < 3 {
-		fmt.Println("Please specify db name")
+	homeDb.Geocoder = geocoder
+
+	// Saved search alerts go out after the run
+	notifier, err := home.NewNotifier(cfg.Notify.Provider, cfg.Notify.SmtpAddr, cfg.Notify.SmtpFrom, cfg.Notify.SmtpUser, cfg.Notify.SmtpPassword)
+	if err != nil {
+		fmt.Println("Problem setting up notifier: ", err)
 		os.Exit(1)
 	}
 
-	dbHost := args[1]
-	dbName := args[2]
-
-	var numberOfWorkers int
-	if len(args) > 3 {
-		var convErr error
-		numberOfWorkers, convErr = strconv.Atoi(args[3])
-		if convErr != nil {
-			fmt.Printf("Bad number of workers param")
-			os.Exit(2)
+	// Distributed crawlers coordinate through the shared queue instead
+	if !cfg.Crawl.Distributed {
+		processLock, err = home.AcquireProcessLock(cfg.Lock.Type, "crawler-"+originalHost, homeDb)
+		if err == home.ErrLockHeld {
+			fmt.Println("Process already running")
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Println("[ERR] Problem acquiring lock: ", err)
+			os.Exit(1)
+		}
+		if lost := processLock.Lost(); lost != nil {
+			go func() {
+				select {
+				case <-lost:
+					requestStop(StopLockLost)
+				case <-crawlCtx.Done():
+				}
+			}()
 		}
-	} else {
-		numberOfWorkers = DefaultNumberOfWorkers
 	}
 
-	var waitTime int
-	if len(args) > 4 {
-		var convErr error
-		waitTime, convErr = strconv.Atoi(args[4])
-		if convErr != nil {
-			fmt.Printf("Bad param for millisecond wait time")
-			os.Exit(2)
+	stats = newCrawlStats()
+
+	if cfg.Crawl.Distributed {
+		crawlName := cfg.Crawl.Name
+		if crawlName == "" {
+			crawlName = originalHost
 		}
+		crawlDistributed(crawlCtx, crawlName, cfg.Fetch.Workers, cfg.Fetch.Wait.Duration())
 	} else {
-		waitTime = DefaultWaitTime
+		crawlLocally(crawlCtx, cfg.Fetch.Workers, cfg.Fetch.Wait.Duration())
 	}
 
-	unlocked := acquireLock(9293)
-	if !unlocked {
-		fmt.Println("Process already running")
-		os.Exit(0)
+	alerts, err := homeDb.RunSavedSearchesLocked(notifier)
+	switch {
+	case err == home.ErrLockHeld:
+		fmt.Println("Saved searches already running")
+	case err != nil:
+		fmt.Println("[ERR] Problem running saved searches: ", err)
+	default:
+		fmt.Printf("Saved search alerts: %v\n", alerts)
 	}
 
-	// Start Up access to our listings
-	homeDb = home.NewDB(dbHost, dbName)
+	// Cleanup
+	cleanup()
+
+	fmt.Print(stats.Summary(stopReason))
+}
+
+// crawlLocally runs the crawl with the frontier kept in memory by
+// the router, returns once the crawl is stopped and drained.
+func crawlLocally(ctx context.Context, numberOfWorkers int, waitTime time.Duration) {
+
+	// Pick up whatever a previous crawl left behind
+	seeds, err := homeDb.TakeFrontier()
+	if err != nil {
+		fmt.Println("[ERR] Problem loading saved frontier: ", err)
+	}
+	seeds = append([]string{startUri}, seeds...)
 
 	// Make a channel to pass new interesting links
 	linkQueue := make(chan string, 100)
 	// Make a regular queue for non-listing pages
-	pageQueue := make(chan string, numberOfWorkers)
+	pageQueue := make(chan string)
 	// Make a prioritized queue for listings
-	listingQueue := make(chan string, numberOfWorkers)
+	listingQueue := make(chan string)
 
 	// Start up workers
 	for i := 0; i < numberOfWorkers; i++ {
 		fmt.Println("Staring up worker ", i+1)
-		go queueWorker(pageQueue, listingQueue, linkQueue, waitTime, i+1)
+		go queueWorker(ctx, pageQueue, listingQueue, linkQueue, waitTime, i+1)
 		GlobalWG.Add(1)
 	}
 
-	// Start link router
-	go queueRouter(linkQueue, listingQueue, pageQueue)
+	// Start link router, primed with the starting uri
+	go queueRouter(ctx, seeds, linkQueue, listingQueue, pageQueue)
 	GlobalWG.Add(1)
 
-	// Prime with starting uri
-	pageQueue <- startUri
-
-	// Wait till they finish (which will probably never happen)
+	// Wait till the budget runs out, there's nothing left to crawl, or
+	// we're told to stop, and the workers have finished what they were
+	// working on
 	GlobalWG.Wait()
 
-	// Cleanup
-	cleanup()
+	// The router's gone, links still in the queue are saved for next time
+	persistFrontier(drainLinks(linkQueue))
+}
+
+// drainLinks closes the queue, once nobody is sending on it anymore,
+// and returns whatever was left in it
+func drainLinks(linkQueue chan string) []string {
+	close(linkQueue)
+	var links []string
+	for link := range linkQueue {
+		links = append(links, link)
+	}
+	return links
+}
+
+// requestStop tells the router and workers to stop taking new work
+func requestStop(reason string) {
+	stopOnce.Do(func() {
+		fmt.Printf("Stopping crawl: %s\n", reason)
+		stopReason = reason
+		stopCrawl()
+	})
 }
 
 func cleanup() {
 
-	// TODO - close channels
+	if processLock != nil {
+		processLock.Release()
+	}
 
 	// Call cleanup on our db instance
 	if homeDb != nil {
 		homeDb.Cleanup()
+		homeDb.Close()
 	}
 }
 
 func initDestruct() {
-	c := make(chan os.Signal, 1)
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 	go func() {
 		<-c
-		fmt.Printf("Caught Interupt Signal, cleaning up, and exiting...\n")
-		cleanup()
+		fmt.Printf("Caught Interupt Signal, finishing up in-flight work...\n")
+		requestStop(StopInterrupted)
+
+		// Don't wait around if asked twice
+		<-c
+		fmt.Printf("Caught second Interupt Signal, exiting now...\n")
 		os.Exit(1)
 	}()
 }
 
-func queueRouter(linkQueue, listingQueue, pageQueue chan string) {
+func queueRouter(ctx context.Context, seeds []string, linkQueue <-chan string, listingQueue, pageQueue chan<- string) {
 
 	defer GlobalWG.Done()
 
+	// We're the only sender on these
+	defer close(listingQueue)
+	defer close(pageQueue)
+
 	var pagesQueued = make(map[string]bool)
 
-	for link := range linkQueue {
+	// Links waiting for a worker
+	var listings, pages []string
 
+	route := func(link string) {
 		// Skip if we've seen it before
 		if pagesQueued[link] {
-			continue
+			return
 		}
 		// Remember that we saw this link
 		pagesQueued[link] = true
@@ -165,49 +244,139 @@ func queueRouter(linkQueue, listingQueue, pageQueue chan string) {
 			if doesListingExist(link) {
 				fmt.Println("Listing already exists, skipping: ", link)
 			} else {
-				go func(listingLink string) { listingQueue <- listingLink }(link)
+				listings = append(listings, link)
 			}
 		} else {
-			go func(pageLink string) { pageQueue <- pageLink }(link)
+			pages = append(pages, link)
+		}
+	}
+
+	for _, seed := range seeds {
+		route(seed)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+
+		// Offer up the next link, listings first
+		var next string
+		var out chan<- string
+		if len(listings) > 0 {
+			next, out = listings[0], listingQueue
+		} else if len(pages) > 0 {
+			next, out = pages[0], pageQueue
 		}
 
+		select {
+		case <-ctx.Done():
+			persistFrontier(append(listings, pages...))
+			return
+		case link := <-linkQueue:
+			route(link)
+		case out <- next:
+			stats.startWork()
+			if len(listings) > 0 {
+				listings = listings[1:]
+			} else {
+				pages = pages[1:]
+			}
+		case <-ticker.C:
+			if reason := budget.ExceededBy(stats); reason != "" {
+				requestStop(reason)
+			} else if len(listings) == 0 && len(pages) == 0 && len(linkQueue) == 0 && stats.idle() {
+				requestStop(StopFrontierEmpty)
+			}
+		}
 	}
 }
 
-func queueWorker(queue, priorityQueue, linkQueue chan string, delay int, workerNumber int) {
+func persistFrontier(uris []string) {
+	if len(uris) == 0 {
+		return
+	}
+	err := homeDb.SaveFrontier(uris)
+	if err != nil {
+		fmt.Println("[ERR] Problem saving frontier: ", err)
+		return
+	}
+	stats.savedFrontier(len(uris))
+}
+
+func queueWorker(ctx context.Context, queue, priorityQueue <-chan string, linkQueue chan<- string, delay time.Duration, workerNumber int) {
 
 	defer GlobalWG.Done()
 
-	// Start with an entry from the main queue
-	for uri := range queue {
-
-		// Chew through listing queue as higher priority
-		for {
-			select {
-			case listingUri := <-priorityQueue:
-				crawl(listingUri, linkQueue)
-				time.Sleep(time.Duration(delay) * time.Millisecond)
-				continue
-			default:
-			}
-			break
+	for {
+		// The router only offers listings while there are any, so
+		// they are already prioritized for us
+		var uri string
+		var open bool
+		select {
+		case <-ctx.Done():
+			return
+		case uri, open = <-priorityQueue:
+		case uri, open = <-queue:
+		}
+		if !open {
+			return
 		}
 
-		crawl(uri, linkQueue)
+		links, fetched := crawl(ctx, uri)
+		if !fetched && ctx.Err() != nil {
+			// Cut off by shutdown, pick it up next time
+			persistFrontier([]string{uri})
+		}
+		// The router is gone, so save what it didn't get to see
+		persistFrontier(forwardLinks(ctx, links, linkQueue))
+		stats.finishWork()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
 
-		time.Sleep(time.Duration(delay) * time.Millisecond)
+// forwardLinks passes links on to the router, never blocking once the
+// crawl is stopped, and returns the ones the router didn't take.
+func forwardLinks(ctx context.Context, links []string, linkQueue chan<- string) []string {
+
+	var leftover []string
+	for _, link := range links {
+		if ctx.Err() != nil {
+			leftover = append(leftover, link)
+			continue
+		}
+		// Pass to queue to be routed/prioritized
+		select {
+		case linkQueue <- link:
+		case <-ctx.Done():
+			leftover = append(leftover, link)
+		}
 	}
+	return leftover
 }
 
-func crawl(uri string, linkQueue chan string) {
+// crawl fetches the page, registers it if it's a listing, and returns
+// the links on it worth following. fetched is false if the page
+// couldn't be fetched.
+func crawl(ctx context.Context, uri string) (links []string, fetched bool) {
 
 	fmt.Println("Fetching: ", uri)
-	body := fetchPage(uri)
+	body := fetchPage(ctx, uri)
 
 	if body == nil {
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		stats.pageFetched(false)
 		fmt.Println("Problem Fetching, skipping ...")
-		return
+		return nil, false
 	}
+	stats.pageFetched(true)
 
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(body)
@@ -215,37 +384,39 @@ func crawl(uri string, linkQueue chan string) {
 
 	body.Close()
 
-	// Register Listing in our database, if its a listing
-	registerListing(uri, bodyString)
+	// Register Listing in our database, if its a listing, we have the
+	// page already so this is finished even when shutting down
+	if registerListing(uri, bodyString) {
+		stats.listingRegistered()
+	}
 
 	// Pull out potential new links
-	links := collectInterestingLinks(bodyString)
-
-	for _, link := range links {
+	for _, link := range collectInterestingLinks(bodyString) {
 		absolute := resolveReferenceLink(link, uri)
 		if absolute != "" {
 			if shouldAddToQueue(absolute) {
-				// Pass to queue to be routed/prioritized
-				linkQueue <- absolute
+				links = append(links, absolute)
 			}
 		}
 	}
 
+	return links, true
 }
 
-func fetchPage(uri string) io.ReadCloser {
+func fetchPage(ctx context.Context, uri string) io.ReadCloser {
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: fetchConfig.InsecureSkipVerify,
 		},
 	}
-	client := http.Client{Transport: transport}
+	client := http.Client{Transport: transport, Timeout: fetchConfig.Timeout.Duration()}
 
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.3; Trident/7.0; rv:11.0) like Gecko")
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", fetchConfig.UserAgent)
 
 	resp, err := client.Do(req)
 
@@ -300,15 +471,19 @@ func shouldAddToQueue(uri string) bool {
 		return false
 	}
 
-	// No if it's related to rent listings
-	if match, _ := regexp.MatchString("/(rentals|off-campus-housing)/", strings.ToLower(uri)); match {
-		return false
+	// No if it's in one of the excluded sections, ie: rent listings
+	if len(crawlFilters.ExcludePaths) > 0 {
+		pattern := "/(" + regexpAlternatives(crawlFilters.ExcludePaths) + ")/"
+		if match, _ := regexp.MatchString(pattern, strings.ToLower(uri)); match {
+			return false
+		}
 	}
 
-	// TEMP - If this is a listing uri
-	if isListingUri(uri) {
-		// No if it's not in a couple of states
-		if match, _ := regexp.MatchString("-(co|ca|ny|hi)-", strings.ToLower(uri)); !match {
+	// If this is a listing uri
+	if isListingUri(uri) && len(crawlFilters.States) > 0 {
+		// No if it's not in one of the states we want
+		pattern := "-(" + regexpAlternatives(crawlFilters.States) + ")-"
+		if match, _ := regexp.MatchString(pattern, strings.ToLower(uri)); !match {
 			return false
 		}
 	}
@@ -316,6 +491,14 @@ func shouldAddToQueue(uri string) bool {
 	return true
 }
 
+func regexpAlternatives(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = regexp.QuoteMeta(strings.ToLower(value))
+	}
+	return strings.Join(quoted, "|")
+}
+
 func resolveReferenceLink(href, base string) string {
 	uri, err := url.Parse(href)
 	if err != nil {
@@ -368,18 +551,19 @@ func doesListingExist(uri string) bool {
 	return (found == nil)
 }
 
-func registerListing(uri, pageSource string) {
+// registerListing returns true if a new listing was registered
+func registerListing(uri, pageSource string) bool {
 
 	//fmt.Println("Parsing Images for => ", uri)
 	if !isListingUri(uri) {
-		return
+		return false
 	}
 
 	// Register with our home db
 	listing, existed, err := homeDb.RegisterListing(uri, "homes.com", pageSource)
 	if err != nil {
 		fmt.Printf("[ERR] Problem registering listing: %s - %s\n", uri, err)
-		return
+		return false
 	}
 
 	if existed {
@@ -389,26 +573,5 @@ func registerListing(uri, pageSource string) {
 	//fmt.Printf("Listing Registered: %+v\n", listing)
 	fmt.Printf("Listing Registered: (%v) %v\n", listing.Id.Hex(), uri)
 
-}
-
-// Process Level Lock
-
-func acquireLock(lockId int) bool {
-
-	// Hacky way to lock this process down to only one process
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", lockId))
-	if err != nil {
-		if strings.Index(err.Error(), "in use") != -1 {
-			return false
-		} else {
-			panic(err)
-		}
-	}
-
-	// TODO - anything else we need to do to keep this open??
-	go func() {
-		listener.Accept()
-	}()
-
-	return true
+	return !existed
 }
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestShouldAddToQueue(t *testing.T) {
 
@@ -34,3 +38,79 @@ func TestShouldAddToQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestForwardLinksAfterStop(t *testing.T) {
+
+	type inOut struct {
+		// Space left in the queue, nobody's reading it, like after
+		// the router stopped
+		room      int
+		cancelled bool
+		leftover  int
+	}
+
+	cases := []inOut{
+		{3, false, 0},
+		{0, true, 3},
+		{1, false, 2},
+	}
+
+	links := []string{"http://www.homes.com/a/", "http://www.homes.com/b/", "http://www.homes.com/c/"}
+
+	for _, c := range cases {
+		linkQueue := make(chan string, 100)
+		for len(linkQueue) < cap(linkQueue)-c.room {
+			linkQueue <- "http://www.homes.com/"
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if c.cancelled {
+			cancel()
+		} else {
+			// Stops while blocked on the full queue
+			time.AfterFunc(10*time.Millisecond, cancel)
+		}
+
+		done := make(chan []string)
+		go func() { done <- forwardLinks(ctx, links, linkQueue) }()
+
+		select {
+		case leftover := <-done:
+			if len(leftover) != c.leftover {
+				t.Errorf("forwardLinks() with room for %d, cancelled %v == %v, expected %d left over", c.room, c.cancelled, leftover, c.leftover)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("forwardLinks() with room for %d, cancelled %v blocked after the crawl stopped", c.room, c.cancelled)
+		}
+		cancel()
+	}
+}
+
+func TestDrainLinksAfterStop(t *testing.T) {
+
+	links := []string{"http://www.homes.com/a/", "http://www.homes.com/b/", "http://www.homes.com/c/"}
+
+	// The workers got their links in before the stop, the router never
+	// read them
+	linkQueue := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	if leftover := forwardLinks(ctx, links, linkQueue); len(leftover) != 0 {
+		t.Fatalf("forwardLinks() == %v, expected all queued", leftover)
+	}
+	cancel()
+
+	drained := drainLinks(linkQueue)
+	if len(drained) != len(links) {
+		t.Fatalf("drainLinks() == %v, expected %v", drained, links)
+	}
+	for i := range links {
+		if drained[i] != links[i] {
+			t.Errorf("drainLinks() == %v, expected %v", drained, links)
+			break
+		}
+	}
+
+	// Nothing queued is nothing to save
+	if drained := drainLinks(make(chan string, 100)); len(drained) != 0 {
+		t.Errorf("drainLinks() on an empty queue == %v", drained)
+	}
+}
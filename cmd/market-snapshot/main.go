@@ -0,0 +1,50 @@
+package main
+
+// Takes the daily market snapshot, for the trend charts. It snapshots
+// yesterday, the last whole UTC day. Meant to be run once a day, soon
+// after midnight UTC, ie: from cron, running it again the same day just
+// replaces that day's snapshot.
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmshelby/photochem/config"
+	"github.com/jmshelby/photochem/home"
+)
+
+func main() {
+
+	fmt.Printf("Started - %v\n", time.Now())
+
+	cfg := config.Defaults()
+	config.MustLoad("market-snapshot", cfg, &cfg.DB, &cfg.Lock)
+
+	homeDb := home.NewDB(cfg.DB.Host, cfg.DB.Name)
+
+	lock, err := home.AcquireProcessLock(cfg.Lock.Type, "market-snapshot", homeDb)
+	if err == home.ErrLockHeld {
+		fmt.Println("Process already running")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("[ERR] Problem acquiring lock: ", err)
+		os.Exit(1)
+	}
+
+	snapshots, err := homeDb.SnapshotMarket(home.LastMarketDay(time.Now()))
+	if err != nil {
+		fmt.Println("[ERR] Problem taking market snapshot: ", err)
+	}
+	fmt.Printf("Saved: %v area snapshots\n", len(snapshots))
+
+	lock.Release()
+	homeDb.Close()
+
+	fmt.Printf("Done - %v\n", time.Now())
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+// Most listings handed back once zoomed in past clustering
+const ClusterListingLimit = 500
+
+// Map view, the listing filters plus the zoom level, bounds are required
+type WebServiceClusterRequest struct {
+	WebServiceListingRequest
+	Zoom int `json:"zoom"`
+}
+
+type WebServiceClusterResponse struct {
+	Zoom     int                 `json:"zoom"`
+	Clusters []WebServiceCluster `json:"clusters"`
+	// Zoomed in far enough, it's the listings themselves
+	Listings []WebServiceListing `json:"listings,omitempty"`
+	Total    int                 `json:"totalCount"`
+}
+
+type WebServiceCluster struct {
+	Count       int     `json:"count"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+	PriceMin    uint    `json:"priceMin"`
+	PriceMedian uint    `json:"priceMedian"`
+	PriceMax    uint    `json:"priceMax"`
+	// The listing, when it's the only one
+	Id string `json:"id,omitempty"`
+}
+
+func (self *WebService) GetListingClusters(r *http.Request, args *WebServiceClusterRequest, reply *WebServiceClusterResponse) error {
+	if err := authorizeListingUser(r, &args.WebServiceListingRequest); err != nil {
+		return err
+	}
+	return clusterListings(args, reply)
+}
+
+func clusterListings(args *WebServiceClusterRequest, reply *WebServiceClusterResponse) error {
+
+	fmt.Printf("cluster request: %+v\n", args)
+
+	if args.Bounds == nil {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Clustering needs the map bounds",
+		}
+	}
+	// Either way, not just when clustering
+	if err := home.CheckZoom(args.Zoom); err != nil {
+		return queryError(err)
+	}
+
+	reply.Zoom = args.Zoom
+	reply.Clusters = []WebServiceCluster{}
+
+	// Close enough to show every listing
+	if args.Zoom >= home.ClusterListingsZoom {
+		if args.Limit == 0 {
+			args.Limit = ClusterListingLimit
+		}
+		listings := WebServiceListingResponse{}
+		if err := queryListings(&args.WebServiceListingRequest, &listings); err != nil {
+			return err
+		}
+		reply.Listings = listings.Listings
+		reply.Total = listings.Total
+		return nil
+	}
+
+	query := buildListingsQuery(&args.WebServiceListingRequest)
+	clusters, err := homeDb.ClusterListings(*query, args.Zoom, (args.Bounds.North+args.Bounds.South)/2)
+	if err != nil {
+		return queryError(err)
+	}
+
+	for _, cluster := range clusters {
+		response := WebServiceCluster{
+			Count:       cluster.Count,
+			Lng:         cluster.Center.Coordinates[0],
+			Lat:         cluster.Center.Coordinates[1],
+			PriceMin:    cluster.PriceMin,
+			PriceMedian: cluster.PriceMedian,
+			PriceMax:    cluster.PriceMax,
+		}
+		if cluster.ListingId != "" {
+			response.Id = cluster.ListingId.Hex()
+		}
+		reply.Clusters = append(reply.Clusters, response)
+		reply.Total += cluster.Count
+	}
+
+	return nil
+}
+
+// GET /clusters
+func restClusters(rw http.ResponseWriter, req *http.Request) error {
+	args := WebServiceClusterRequest{}
+	if err := decodeQuery(req.URL.Query(), &args); err != nil {
+		return err
+	}
+	if err := authorizeListingUser(req, &args.WebServiceListingRequest); err != nil {
+		return err
+	}
+
+	reply := WebServiceClusterResponse{}
+	if err := clusterListings(&args, &reply); err != nil {
+		return err
+	}
+	return writeRestJson(rw, reply)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+// Application error codes, from the range json-rpc leaves for servers
+const (
+	E_NOT_FOUND    json2.ErrorCode = -32001
+	E_UNAVAILABLE  json2.ErrorCode = -32002
+	E_UNAUTHORIZED json2.ErrorCode = -32003
+)
+
+func invalidIdError(id string) error {
+	return &json2.Error{
+		Code:    json2.E_BAD_PARAMS,
+		Message: "Invalid listing id",
+		Data:    map[string]interface{}{"id": id},
+	}
+}
+
+// lookupError turns an error from fetching a listing into a json-rpc error
+func lookupError(id string, err error) error {
+	if err == home.ErrListingNotFound {
+		return &json2.Error{
+			Code:    E_NOT_FOUND,
+			Message: "Listing not found",
+			Data:    map[string]interface{}{"id": id},
+		}
+	}
+	fmt.Printf("[ERR] Problem looking up listing %s: %s\n", id, err)
+	return &json2.Error{
+		Code:    json2.E_INTERNAL,
+		Message: "Problem looking up listing",
+	}
+}
+
+// queryError reports bad filter values back to the client, with the
+// offending values
+func queryError(err error) error {
+	if queryErr, ok := err.(*home.QueryError); ok {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Invalid listing query",
+			Data:    map[string]interface{}{"fields": queryErr.Fields},
+		}
+	}
+	if err == home.ErrNoGeocoder {
+		return &json2.Error{
+			Code:    E_UNAVAILABLE,
+			Message: "Zip code searches are not available",
+		}
+	}
+	fmt.Printf("[ERR] Problem querying listings: %s\n", err)
+	return &json2.Error{
+		Code:    json2.E_INTERNAL,
+		Message: "Problem querying listings",
+	}
+}
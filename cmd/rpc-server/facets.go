@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jmshelby/photochem/home"
+)
+
+type WebServiceFacetsResponse struct {
+	Total        int                     `json:"totalCount"`
+	States       []WebServiceFacetCount  `json:"states"`
+	Cities       []WebServiceFacetCount  `json:"cities"`
+	Zips         []WebServiceFacetCount  `json:"zips"`
+	PriceBuckets []WebServicePriceBucket `json:"priceBuckets"`
+	PriceMin     uint                    `json:"priceMin"`
+	PriceMedian  uint                    `json:"priceMedian"`
+	PriceMax     uint                    `json:"priceMax"`
+}
+
+type WebServiceFacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Max is left off the last bucket
+type WebServicePriceBucket struct {
+	Min   uint `json:"min"`
+	Max   uint `json:"max,omitempty"`
+	Count int  `json:"count"`
+}
+
+// GetFacets breaks down the listings matching the same filters as
+// GetListings, the limit, sort and cursor are ignored
+func (self *WebService) GetFacets(r *http.Request, args *WebServiceListingRequest, reply *WebServiceFacetsResponse) error {
+	if err := authorizeListingUser(r, args); err != nil {
+		return err
+	}
+	return listingFacets(args, reply)
+}
+
+func listingFacets(args *WebServiceListingRequest, reply *WebServiceFacetsResponse) error {
+
+	fmt.Printf("facets request: %+v\n", args)
+
+	query := buildListingsQuery(args)
+	facets, err := homeDb.ListingFacets(*query)
+	if err != nil {
+		return queryError(err)
+	}
+
+	reply.Total = facets.Total
+	reply.States = newWebServiceFacetCounts(facets.States)
+	reply.Cities = newWebServiceFacetCounts(facets.Cities)
+	reply.Zips = newWebServiceFacetCounts(facets.Zips)
+	reply.PriceMin = facets.PriceMin
+	reply.PriceMedian = facets.PriceMedian
+	reply.PriceMax = facets.PriceMax
+
+	reply.PriceBuckets = make([]WebServicePriceBucket, len(facets.PriceBuckets))
+	for i, bucket := range facets.PriceBuckets {
+		reply.PriceBuckets[i] = WebServicePriceBucket{Min: bucket.Min, Max: bucket.Max, Count: bucket.Count}
+	}
+
+	return nil
+}
+
+func newWebServiceFacetCounts(facets []home.FacetCount) []WebServiceFacetCount {
+	counts := make([]WebServiceFacetCount, len(facets))
+	for i, facet := range facets {
+		counts[i] = WebServiceFacetCount{Value: facet.Value, Count: facet.Count}
+	}
+	return counts
+}
+
+// GET /facets
+func restFacets(rw http.ResponseWriter, req *http.Request) error {
+	args := WebServiceListingRequest{}
+	if err := decodeQuery(req.URL.Query(), &args); err != nil {
+		return err
+	}
+	if err := authorizeListingUser(req, &args); err != nil {
+		return err
+	}
+
+	reply := WebServiceFacetsResponse{}
+	if err := listingFacets(&args, &reply); err != nil {
+		return err
+	}
+	return writeRestJson(rw, reply)
+}
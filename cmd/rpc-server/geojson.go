@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmshelby/photochem/home"
+)
+
+// Listings as GeoJSON, for dropping straight onto a map
+
+const (
+	FormatListings     = ""
+	FormatGeoJson      = "geojson"
+	GeoJsonContentType = "application/geo+json"
+)
+
+// The rest api's FeatureCollection, the counts and cursor ride along
+// as foreign members
+type WebServiceFeatureCollection struct {
+	Type       string              `json:"type"`
+	Features   []WebServiceFeature `json:"features"`
+	Total      int                 `json:"totalCount"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+type WebServiceFeature struct {
+	Type       string                    `json:"type"`
+	Id         string                    `json:"id"`
+	Geometry   *WebServicePoint          `json:"geometry"`
+	Properties WebServiceFeatureProperty `json:"properties"`
+}
+
+type WebServicePoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type WebServiceFeatureProperty struct {
+	Id           string            `json:"id"`
+	Href         string            `json:"href"`
+	Price        uint              `json:"price"`
+	ForSale      bool              `json:"forSale"`
+	DaysOnMarket int               `json:"daysOnMarket"`
+	Address      WebServiceAddress `json:"address"`
+	// The first photo
+	Photo string `json:"photo,omitempty"`
+}
+
+type WebServiceAddress struct {
+	Street string `json:"street"`
+	Unit   string `json:"unit,omitempty"`
+	City   string `json:"city"`
+	State  string `json:"state"`
+	Zip    string `json:"zip"`
+}
+
+func newWebServiceFeatures(listings []home.Listing) []WebServiceFeature {
+	features := make([]WebServiceFeature, len(listings))
+	for i, listing := range listings {
+		features[i] = newWebServiceFeature(listing)
+	}
+	return features
+}
+
+// newWebServiceFeature has a null geometry for listings that couldn't
+// be located
+func newWebServiceFeature(listing home.Listing) WebServiceFeature {
+	properties := listing.Properties
+	address := properties.Address
+
+	feature := WebServiceFeature{
+		Type: "Feature",
+		Id:   listing.Id.Hex(),
+		Properties: WebServiceFeatureProperty{
+			Id:           listing.Id.Hex(),
+			Href:         listing.Url,
+			Price:        properties.CurrentPrice,
+			ForSale:      listing.ForSale,
+			DaysOnMarket: listing.DaysOnMarket(time.Now()),
+			Address: WebServiceAddress{
+				Street: address.Street,
+				Unit:   address.Unit,
+				City:   address.City,
+				State:  address.State,
+				Zip:    address.Zip,
+			},
+		},
+	}
+
+	if properties.Location.IsSet() {
+		feature.Geometry = &WebServicePoint{
+			Type:        "Point",
+			Coordinates: properties.Location.Coordinates,
+		}
+	}
+	if len(listing.Images) > 0 {
+		feature.Properties.Photo = listing.Images[0].Url
+	}
+
+	return feature
+}
@@ -1,39 +1,38 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	_ "strings"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/config"
 	"github.com/jmshelby/photochem/home"
 )
 
 var homeDb *home.DB
 
+// Checks user tokens, empty for no per user calls
+var userSecret string
+
 func main() {
 
-	flag.Parse()
-	args := flag.Args()
-	fmt.Println(args)
+	cfg := config.Defaults()
+	config.MustLoad("rpc-server", cfg, &cfg.DB, &cfg.Server, &cfg.Geocode)
 
-	if len(args) < 1 {
-		fmt.Println("Please specify db host")
-		os.Exit(1)
-	}
-	if len(args) < 2 {
-		fmt.Println("Please specify db name")
+	// Start Up access to our listings
+	homeDb = home.NewDB(cfg.DB.Host, cfg.DB.Name)
+
+	geocoder, err := home.NewGeocoder(cfg.Geocode.Provider, cfg.Geocode.ZipCentroids, cfg.Geocode.GoogleAPIKey)
+	if err != nil {
+		fmt.Println("Problem setting up geocoder: ", err)
 		os.Exit(1)
 	}
-
-	dbHost := args[0]
-	dbName := args[1]
-
-	// Start Up access to our listings
-	homeDb = home.NewDB(dbHost, dbName)
+	homeDb.Geocoder = geocoder
+	userSecret = cfg.Server.UserSecret
 
 	s := rpc.NewServer()
 	// json-rpc version 2
@@ -43,7 +42,21 @@ func main() {
 
 	// Wrap in my own handler for cors capability
 	http.Handle("/rpc", &MyServer{s})
-	http.ListenAndServe(":10000", nil)
+
+	// Plain rest api over the same queries
+	http.Handle("/listings", restHandler(restListings))
+	http.Handle("/listings/", restHandler(restListing))
+	http.Handle("/clusters", restHandler(restClusters))
+	http.Handle("/facets", restHandler(restFacets))
+	http.Handle("/market", restHandler(restMarketTrend))
+	http.Handle("/stream", restHandler(restStream))
+	http.Handle("/openapi.json", restHandler(restOpenAPI))
+
+	err = http.ListenAndServe(cfg.Server.Listen, nil)
+	if err != nil {
+		fmt.Println("Server stopped: ", err)
+		os.Exit(1)
+	}
 
 }
 
@@ -57,12 +70,49 @@ type WebServiceListingRequest struct {
 	PriceMax    uint     `json:"maxPrice"`
 	Zip         string   `json:"zip"`
 	ZipDistance uint     `json:"zip-meters"`
+	Zips        []string `json:"zips"`
+	State       string   `json:"state"`
+	States      []string `json:"states"`
+	City        string   `json:"city"`
+	Cities      []string `json:"cities"`
+	// Only listings first seen in the last so many days, ie: 7 for new this week
+	NewWithinDays uint `json:"newWithinDays"`
+	// Leaves out the listings this user has seen lately, liked or hidden,
+	// needs their user token, see authorizeUser
+	UserId string `json:"userId"`
+
+	Bounds  *WebServiceBounds    `json:"bounds"`
+	Polygon *home.GeoJsonPolygon `json:"polygon"`
+	Near    *WebServiceNear      `json:"near"`
+	Sort    string               `json:"sort"`
+	Cursor  string               `json:"cursor"`
+	// "geojson" for a FeatureCollection instead of the listings
+	Format string `json:"format"`
+}
+
+// Bounding box, ie: the current map viewport
+type WebServiceBounds struct {
+	West  float64 `json:"west"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+}
+
+// Radius search around a point
+type WebServiceNear struct {
+	Lat    float64 `json:"lat"`
+	Lng    float64 `json:"lng"`
+	Meters uint    `json:"meters"`
 }
 
 type WebServiceListingResponse struct {
 	Listings      []WebServiceListing `json:"listings"`
 	Total         int                 `json:"totalCount"`
 	ResponseTotal int                 `json:"responseCount"`
+	NextCursor    string              `json:"nextCursor,omitempty"`
+	// With the geojson format the response is a FeatureCollection
+	Type     string              `json:"type,omitempty"`
+	Features []WebServiceFeature `json:"features"`
 	// return total listings available??
 	// return current max??
 	// return current count actually returned??
@@ -70,22 +120,157 @@ type WebServiceListingResponse struct {
 }
 
 type WebServiceListing struct {
-	Id         string                   `json:"id"`
-	Href       string                   `json:"href"`
-	Properties interface{}              `json:"properties,omitempty"`
-	Photos     []WebServiceListingPhoto `json:"photos"`
+	Id          string                   `json:"id"`
+	Href        string                   `json:"href"`
+	Source      string                   `json:"source,omitempty"`
+	ForSale     bool                     `json:"forSale"`
+	UpdatedDate time.Time                `json:"updatedDate"`
+	Properties  interface{}              `json:"properties,omitempty"`
+	Photos      []WebServiceListingPhoto `json:"photos"`
+
+	FirstSeenDate time.Time  `json:"firstSeenDate"`
+	LastSeenDate  *time.Time `json:"lastSeenDate,omitempty"`
+	OffMarketDate *time.Time `json:"offMarketDate,omitempty"`
+	DaysOnMarket  int        `json:"daysOnMarket"`
+	// Every site the property is listed on, this one included
+	Sources []WebServiceListingSource `json:"sources,omitempty"`
+}
+
+type WebServiceListingSource struct {
+	Id      string `json:"id"`
+	Href    string `json:"href"`
+	Source  string `json:"source,omitempty"`
+	ForSale bool   `json:"forSale"`
 }
 
 type WebServiceListingPhoto struct {
-	Src string `json:"src"`
+	Src   string   `json:"src"`
+	Label string   `json:"label,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+type WebServiceListingIdRequest struct {
+	Id string `json:"id"`
+}
+
+type WebServiceListingHistoryResponse struct {
+	Id      string                    `json:"id"`
+	Events  []WebServiceListingEvent  `json:"events"`
+	Scrapes []WebServiceListingScrape `json:"scrapes"`
+}
+
+type WebServiceListingEvent struct {
+	Type     string    `json:"type"`
+	Price    uint      `json:"price"`
+	OldPrice uint      `json:"oldPrice,omitempty"`
+	ForSale  bool      `json:"forSale"`
+	Date     time.Time `json:"date"`
+}
+
+type WebServiceListingScrape struct {
+	FetchedDate time.Time  `json:"fetchedDate"`
+	ScrapedDate *time.Time `json:"scrapedDate,omitempty"`
+}
+
+func newWebServiceListing(listing home.Listing) WebServiceListing {
+	photos := make([]WebServiceListingPhoto, len(listing.Images))
+	for photoIndex, image := range listing.Images {
+		photos[photoIndex] = WebServiceListingPhoto{
+			Src:   image.Url,
+			Label: image.Label,
+			Tags:  image.Tags,
+		}
+	}
+
+	var sources []WebServiceListingSource
+	for _, source := range listing.Sources {
+		sources = append(sources, WebServiceListingSource{
+			Id:      source.ListingId.Hex(),
+			Href:    source.Url,
+			Source:  source.Source,
+			ForSale: source.ForSale,
+		})
+	}
+
+	response := WebServiceListing{
+		Id:            listing.Id.Hex(),
+		Href:          listing.Url,
+		Source:        listing.Source,
+		ForSale:       listing.ForSale,
+		UpdatedDate:   listing.UpdatedDate,
+		Properties:    listing.Properties,
+		Photos:        photos,
+		Sources:       sources,
+		FirstSeenDate: listing.FirstSeen(),
+		DaysOnMarket:  listing.DaysOnMarket(time.Now()),
+	}
+	if !listing.LastSeenDate.IsZero() {
+		response.LastSeenDate = &listing.LastSeenDate
+	}
+	if !listing.OffMarketDate.IsZero() {
+		response.OffMarketDate = &listing.OffMarketDate
+	}
+	return response
 }
 
 type WebService struct{}
 
 func (self *WebService) GetListings(r *http.Request, args *WebServiceListingRequest, reply *WebServiceListingResponse) error {
+	if err := authorizeListingUser(r, args); err != nil {
+		return err
+	}
+	return queryListings(args, reply)
+}
+
+// queryListings runs the listing search for both the json-rpc and rest
+// apis, errors are *json2.Error
+func queryListings(args *WebServiceListingRequest, reply *WebServiceListingResponse) error {
 
 	fmt.Printf("request: %+v\n", args)
 
+	query := buildListingsQuery(args)
+
+	if args.Format != FormatListings && args.Format != FormatGeoJson {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Unknown format",
+			Data:    map[string]interface{}{"format": args.Format},
+		}
+	}
+
+	listings, total, err := query.Fetch()
+	if err != nil {
+		return queryError(err)
+	}
+
+	// Same house on other sites, not worth failing the request over
+	if err := homeDb.MergeDuplicates(*listings); err != nil {
+		fmt.Println("[ERR] Problem merging duplicate listings: ", err)
+	}
+
+	if args.Format == FormatGeoJson {
+		reply.Type = "FeatureCollection"
+		reply.Features = newWebServiceFeatures(*listings)
+		reply.Listings = []WebServiceListing{}
+	} else {
+		reply.Features = []WebServiceFeature{}
+		reply.Listings = make([]WebServiceListing, len(*listings))
+		for i, listing := range *listings {
+			reply.Listings[i] = newWebServiceListing(listing)
+		}
+	}
+
+	reply.Total = total
+	reply.ResponseTotal = len(*listings)
+	reply.NextCursor = query.NextCursor(*listings)
+
+	return nil
+}
+
+// buildListingsQuery sets up the query from the request filters, bad
+// values are reported by the query's Err
+func buildListingsQuery(args *WebServiceListingRequest) *home.ListingsQuery {
+
 	query := homeDb.NewListingsQuery()
 
 	query.ForSale(true)
@@ -99,6 +284,10 @@ func (self *WebService) GetListings(r *http.Request, args *WebServiceListingRequ
 	if len(args.IncludeIds) > 0 {
 		query.Include(args.IncludeIds...)
 	}
+	if args.UserId != "" {
+		// Any problem is reported from Fetch
+		query.ExcludeSeenBy(args.UserId)
+	}
 	if args.PriceMin != 0 {
 		query.PriceAbove(args.PriceMin)
 	}
@@ -106,33 +295,112 @@ func (self *WebService) GetListings(r *http.Request, args *WebServiceListingRequ
 		query.PriceUnder(args.PriceMax)
 	}
 	if args.Zip != "" && args.ZipDistance != 0 {
+		// Any problem is reported from Fetch
 		query.NearZipCode(args.Zip, args.ZipDistance)
+	} else if args.Zip != "" {
+		// Without a distance, it's just another zip to match
+		args.Zips = append(args.Zips, args.Zip)
+	}
+	if len(args.Zips) > 0 {
+		query.InZipCodes(args.Zips...)
+	}
+	if args.State != "" {
+		args.States = append(args.States, args.State)
+	}
+	if len(args.States) > 0 {
+		query.InStates(args.States...)
+	}
+	if args.City != "" {
+		args.Cities = append(args.Cities, args.City)
+	}
+	if len(args.Cities) > 0 {
+		query.InCities(args.Cities...)
+	}
+	if args.NewWithinDays != 0 {
+		query.FirstSeenSince(time.Now().AddDate(0, 0, -int(args.NewWithinDays)))
+	}
+
+	if args.Bounds != nil {
+		query.WithinBox(args.Bounds.West, args.Bounds.South, args.Bounds.East, args.Bounds.North)
+	}
+	if args.Polygon != nil {
+		query.WithinPolygon(*args.Polygon)
+	}
+	if args.Near != nil {
+		query.NearPoint(args.Near.Lng, args.Near.Lat, args.Near.Meters)
 	}
 
-	listings, total := query.Fetch()
+	if args.Sort != "" {
+		query.SortBy(args.Sort)
+	}
+	if args.Cursor != "" {
+		query.After(args.Cursor)
+	}
 
-	// TODO -- move the converting to listing structures to another function
-	response := make([]WebServiceListing, len(*listings))
-	for i, listing := range *listings {
-		photos := make([]WebServiceListingPhoto, len(listing.Images))
-		for photoIndex, image := range listing.Images {
+	return query
+}
 
-			photos[photoIndex] = WebServiceListingPhoto{
-				Src: image.Url,
-			}
-		}
+func (self *WebService) GetListing(r *http.Request, args *WebServiceListingIdRequest, reply *WebServiceListing) error {
+	listing, err := lookupListing(args.Id)
+	if err != nil {
+		return err
+	}
+	*reply = newWebServiceListing(listing)
+	return nil
+}
 
-		response[i] = WebServiceListing{
-			Id:         listing.Id.Hex(),
-			Href:       listing.Url,
-			Properties: listing.Properties,
-			Photos:     photos,
-		}
+// lookupListing gets a single listing, with its duplicates merged in
+func lookupListing(id string) (home.Listing, error) {
+
+	listingId, err := home.ParseListingId(id)
+	if err != nil {
+		return home.Listing{}, invalidIdError(id)
 	}
 
-	reply.Listings = response
-	reply.Total = total
-	reply.ResponseTotal = len(*listings)
+	listing, err := homeDb.GetListing(listingId)
+	if err != nil {
+		return listing, lookupError(id, err)
+	}
+
+	merged := []home.Listing{listing}
+	if err := homeDb.MergeDuplicates(merged); err != nil {
+		fmt.Println("[ERR] Problem merging duplicate listings: ", err)
+	}
+
+	return merged[0], nil
+}
+
+func (self *WebService) GetListingHistory(r *http.Request, args *WebServiceListingIdRequest, reply *WebServiceListingHistoryResponse) error {
+
+	listingId, err := home.ParseListingId(args.Id)
+	if err != nil {
+		return invalidIdError(args.Id)
+	}
+
+	history, err := homeDb.GetListingHistory(listingId)
+	if err != nil {
+		return lookupError(args.Id, err)
+	}
+
+	reply.Id = listingId.Hex()
+	reply.Events = make([]WebServiceListingEvent, len(history.Events))
+	for i, event := range history.Events {
+		reply.Events[i] = WebServiceListingEvent{
+			Type:     event.Type,
+			Price:    event.Price,
+			OldPrice: event.OldPrice,
+			ForSale:  event.ForSale,
+			Date:     event.Date,
+		}
+	}
+	reply.Scrapes = make([]WebServiceListingScrape, len(history.Scrapes))
+	for i, scrape := range history.Scrapes {
+		reply.Scrapes[i] = WebServiceListingScrape{FetchedDate: scrape.FetchedDate}
+		if !scrape.ScrapedDate.IsZero() {
+			scrapedDate := scrape.ScrapedDate
+			reply.Scrapes[i].ScrapedDate = &scrapedDate
+		}
+	}
 
 	return nil
 }
@@ -151,16 +419,22 @@ type MyServer struct {
 }
 
 func (s *MyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Stop here if its Preflighted OPTIONS request
+	if allowCors(rw, req) {
+		return
+	}
+	// Lets Gorilla work
+	s.r.ServeHTTP(rw, req)
+}
+
+// allowCors sets the cors headers, returns true if that's all the
+// request needed
+func allowCors(rw http.ResponseWriter, req *http.Request) bool {
 	if origin := req.Header.Get("Origin"); origin != "" {
 		rw.Header().Set("Access-Control-Allow-Origin", origin)
 		rw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		rw.Header().Set("Access-Control-Allow-Headers",
 			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 	}
-	// Stop here if its Preflighted OPTIONS request
-	if req.Method == "OPTIONS" {
-		return
-	}
-	// Lets Gorilla work
-	s.r.ServeHTTP(rw, req)
+	return req.Method == "OPTIONS"
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+// How far back trends go when the request doesn't say
+const DefaultTrendDays = 90
+
+// Either a zip, or a city and state
+type WebServiceMarketTrendRequest struct {
+	Zip   string `json:"zip"`
+	City  string `json:"city"`
+	State string `json:"state"`
+	// Dates as 2006-01-02, defaults to the last 90 days
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type WebServiceMarketTrendResponse struct {
+	AreaType  string                     `json:"areaType"`
+	Area      string                     `json:"area"`
+	Snapshots []WebServiceMarketSnapshot `json:"snapshots"`
+}
+
+type WebServiceMarketSnapshot struct {
+	Date               string  `json:"date"`
+	Active             int     `json:"active"`
+	New                int     `json:"new"`
+	Delisted           int     `json:"delisted"`
+	MedianPrice        uint    `json:"medianPrice"`
+	MedianPricePerSqFt float64 `json:"medianPricePerSqFt"`
+}
+
+func (self *WebService) GetMarketTrend(r *http.Request, args *WebServiceMarketTrendRequest, reply *WebServiceMarketTrendResponse) error {
+	return marketTrend(args, reply)
+}
+
+func marketTrend(args *WebServiceMarketTrendRequest, reply *WebServiceMarketTrendResponse) error {
+
+	// Normalized the same way listing addresses are
+	address := home.NormalizeAddress(home.RawAddress{City: args.City, State: args.State, Zip: args.Zip})
+
+	switch {
+	case args.Zip != "" && (args.City != "" || args.State != ""):
+		return marketParamsError("Ask for a zip, or a city and state, not both")
+	case args.Zip != "":
+		reply.AreaType = home.AreaZip
+		reply.Area = address.Zip
+	case address.City != "" && address.State != "":
+		reply.AreaType = home.AreaCity
+		reply.Area = home.CityArea(address.City, address.State)
+	default:
+		return marketParamsError("A zip, or a city and state, is required")
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -DefaultTrendDays)
+	var err error
+	if args.To != "" {
+		if to, err = time.Parse(MarketDateFormat, args.To); err != nil {
+			return marketParamsError("Bad to date, expected " + MarketDateFormat)
+		}
+		if args.From == "" {
+			from = to.AddDate(0, 0, -DefaultTrendDays)
+		}
+	}
+	if args.From != "" {
+		if from, err = time.Parse(MarketDateFormat, args.From); err != nil {
+			return marketParamsError("Bad from date, expected " + MarketDateFormat)
+		}
+	}
+
+	snapshots, err := homeDb.GetMarketTrend(reply.AreaType, reply.Area, from, to)
+	if err != nil {
+		fmt.Printf("[ERR] Problem getting market trend for %s: %s\n", reply.Area, err)
+		return &json2.Error{
+			Code:    json2.E_INTERNAL,
+			Message: "Problem getting market trend",
+		}
+	}
+
+	reply.Snapshots = make([]WebServiceMarketSnapshot, len(snapshots))
+	for i, snapshot := range snapshots {
+		reply.Snapshots[i] = WebServiceMarketSnapshot{
+			Date:               snapshot.Date.Format(MarketDateFormat),
+			Active:             snapshot.Active,
+			New:                snapshot.New,
+			Delisted:           snapshot.Delisted,
+			MedianPrice:        snapshot.MedianPrice,
+			MedianPricePerSqFt: snapshot.MedianPricePerSqFt,
+		}
+	}
+
+	return nil
+}
+
+const MarketDateFormat = "2006-01-02"
+
+func marketParamsError(message string) error {
+	return &json2.Error{
+		Code:    json2.E_BAD_PARAMS,
+		Message: message,
+	}
+}
+
+// GET /market
+func restMarketTrend(rw http.ResponseWriter, req *http.Request) error {
+	args := WebServiceMarketTrendRequest{}
+	if err := decodeQuery(req.URL.Query(), &args); err != nil {
+		return err
+	}
+
+	reply := WebServiceMarketTrendResponse{}
+	if err := marketTrend(&args, &reply); err != nil {
+		return err
+	}
+	return writeRestJson(rw, reply)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// OpenAPI document for the rest api, generated from the request and
+// response types, so it keeps up with them.
+
+const OpenAPIVersion = "3.0.3"
+
+// openAPIRoute is one GET endpoint in the document
+type openAPIRoute struct {
+	Path       string
+	Summary    string
+	PathParams []string
+	QueryType  reflect.Type
+	Response   reflect.Type
+	// Served instead for application/geo+json, if there is one
+	GeoJson reflect.Type
+	// Instead of application/json, if set
+	ContentType string
+	ErrorStatus []int
+}
+
+var openAPIRoutes = []openAPIRoute{
+	{
+		Path:        "/listings",
+		Summary:     "Search listings, one per property",
+		QueryType:   reflect.TypeOf(WebServiceListingRequest{}),
+		Response:    reflect.TypeOf(WebServiceListingResponse{}),
+		GeoJson:     reflect.TypeOf(WebServiceFeatureCollection{}),
+		ErrorStatus: []int{400, 503},
+	},
+	{
+		Path:        "/listings/{id}",
+		Summary:     "Get a listing, with the other sites it's listed on",
+		PathParams:  []string{"id"},
+		Response:    reflect.TypeOf(WebServiceListing{}),
+		GeoJson:     reflect.TypeOf(WebServiceFeature{}),
+		ErrorStatus: []int{400, 404},
+	},
+	{
+		Path:        "/listings/{id}/photos",
+		Summary:     "Get a listing's photos, from every site it's listed on",
+		PathParams:  []string{"id"},
+		Response:    reflect.TypeOf(WebServiceListingPhotosResponse{}),
+		ErrorStatus: []int{400, 404},
+	},
+	{
+		Path:        "/clusters",
+		Summary:     "Cluster listings in the map bounds, or the listings themselves when zoomed in",
+		QueryType:   reflect.TypeOf(WebServiceClusterRequest{}),
+		Response:    reflect.TypeOf(WebServiceClusterResponse{}),
+		ErrorStatus: []int{400, 503},
+	},
+	{
+		Path:        "/facets",
+		Summary:     "Counts by state, city, zip and price for the listings matching the filters",
+		QueryType:   reflect.TypeOf(WebServiceListingRequest{}),
+		Response:    reflect.TypeOf(WebServiceFacetsResponse{}),
+		ErrorStatus: []int{400, 503},
+	},
+	{
+		Path:        "/market",
+		Summary:     "Daily market snapshots for a zip, or a city and state",
+		QueryType:   reflect.TypeOf(WebServiceMarketTrendRequest{}),
+		Response:    reflect.TypeOf(WebServiceMarketTrendResponse{}),
+		ErrorStatus: []int{400},
+	},
+	{
+		Path:        "/stream",
+		Summary:     "Server-sent events for new and changed listings matching the filters, each event's data is one of these",
+		QueryType:   reflect.TypeOf(WebServiceListingRequest{}),
+		Response:    reflect.TypeOf(WebServiceStreamEvent{}),
+		ContentType: StreamContentType,
+		ErrorStatus: []int{400, 503},
+	},
+}
+
+func openAPIDocument() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+
+	errorSchema := openAPISchema(reflect.TypeOf(WebServiceErrorResponse{}), schemas)
+
+	for _, route := range openAPIRoutes {
+		parameters := []interface{}{}
+		for _, name := range route.PathParams {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		if route.QueryType != nil {
+			for _, field := range queryFields(route.QueryType) {
+				parameters = append(parameters, openAPIQueryParameter(field, schemas))
+			}
+		}
+
+		ok := openAPIResponse("OK", openAPISchema(route.Response, schemas))
+		if route.ContentType != "" {
+			content := ok["content"].(map[string]interface{})
+			content[route.ContentType] = content["application/json"]
+			delete(content, "application/json")
+		}
+		if route.GeoJson != nil {
+			ok["content"].(map[string]interface{})[GeoJsonContentType] = map[string]interface{}{
+				"schema": openAPISchema(route.GeoJson, schemas),
+			}
+		}
+		responses := map[string]interface{}{"200": ok}
+		for _, status := range route.ErrorStatus {
+			responses[strconv.Itoa(status)] = openAPIResponse("Error", errorSchema)
+		}
+		responses["500"] = openAPIResponse("Error", errorSchema)
+
+		paths[route.Path] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":    route.Summary,
+				"parameters": parameters,
+				"responses":  responses,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "PhotoChem",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+func openAPIResponse(description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+func openAPIQueryParameter(field queryField, schemas map[string]interface{}) map[string]interface{} {
+	parameter := map[string]interface{}{
+		"name": field.Name,
+		"in":   "query",
+	}
+	switch field.Kind {
+	case queryList:
+		parameter["style"] = "form"
+		parameter["explode"] = false
+		parameter["schema"] = openAPISchema(field.Type, schemas)
+	case queryJson:
+		parameter["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": openAPISchema(field.Type, schemas)},
+		}
+	default:
+		parameter["schema"] = openAPISchema(field.Type, schemas)
+	}
+	return parameter
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchema describes the type, named structs are added to the
+// schemas and referenced
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIObject(t, schemas)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, done := schemas[t.Name()]; done {
+			return ref
+		}
+		// Claim the name first, in case the type refers to itself
+		schemas[t.Name()] = nil
+		schemas[t.Name()] = openAPIObject(t, schemas)
+		return ref
+	}
+
+	// interface{}, anything goes
+	return map[string]interface{}{}
+}
+
+func openAPIObject(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, field := range jsonFields(t) {
+		properties[field.Name] = openAPISchema(field.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
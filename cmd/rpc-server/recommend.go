@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+// Listings picked for the user from what they've liked and hidden, see
+// home.TasteProfile for how they're scored
+
+const (
+	DefaultRecommendLimit = 20
+	MaxRecommendLimit     = 100
+)
+
+type WebServiceRecommendRequest struct {
+	UserId string `json:"userId"`
+	Limit  uint   `json:"limit"`
+}
+
+type WebServiceRecommendResponse struct {
+	Listings []WebServiceRecommendation `json:"listings"`
+	// No likes to go on yet, or nothing around them, these are the
+	// newest listings
+	ColdStart bool `json:"coldStart"`
+}
+
+type WebServiceRecommendation struct {
+	WebServiceListing
+	Score WebServiceRecommendScore `json:"score"`
+}
+
+type WebServiceRecommendScore struct {
+	Total    float64 `json:"total"`
+	Price    float64 `json:"price"`
+	Location float64 `json:"location"`
+	Rooms    float64 `json:"rooms"`
+	Tags     float64 `json:"tags"`
+	Dislike  float64 `json:"dislike"`
+}
+
+func (self *WebService) GetRecommendedListings(r *http.Request, args *WebServiceRecommendRequest, reply *WebServiceRecommendResponse) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+	limit := DefaultRecommendLimit
+	if args.Limit > MaxRecommendLimit {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: fmt.Sprintf("The limit can't be over %d", MaxRecommendLimit),
+			Data:    map[string]interface{}{"limit": args.Limit},
+		}
+	}
+	if args.Limit != 0 {
+		limit = int(args.Limit)
+	}
+
+	result, err := homeDb.RecommendListings(args.UserId, limit)
+	if err != nil {
+		return queryError(err)
+	}
+	recommendations := result.Listings
+
+	listings := make([]home.Listing, len(recommendations))
+	for i, recommendation := range recommendations {
+		listings[i] = recommendation.Listing
+	}
+	if err := homeDb.MergeDuplicates(listings); err != nil {
+		fmt.Println("[ERR] Problem merging duplicate listings: ", err)
+	}
+
+	reply.ColdStart = result.ColdStart
+	reply.Listings = make([]WebServiceRecommendation, len(recommendations))
+	for i, recommendation := range recommendations {
+		score := recommendation.Score
+		reply.Listings[i] = WebServiceRecommendation{
+			WebServiceListing: newWebServiceListing(listings[i]),
+			Score: WebServiceRecommendScore{
+				Total:    score.Total,
+				Price:    score.Price,
+				Location: score.Location,
+				Rooms:    score.Rooms,
+				Tags:     score.Tags,
+				Dislike:  score.Dislike,
+			},
+		}
+	}
+	return nil
+}
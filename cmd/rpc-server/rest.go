@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// Rest api, the same listing queries as the json-rpc service, with the
+// request fields as query parameters, named after their json tags.
+// Lists can be comma separated or repeated, the fields of a nested
+// object are named with a dot, ie: bounds.west, and anything more
+// complicated, ie: polygon, is passed as json.
+
+type WebServiceListingPhotosResponse struct {
+	Id     string                   `json:"id"`
+	Photos []WebServiceListingPhoto `json:"photos"`
+}
+
+type WebServiceErrorResponse struct {
+	Error json2.Error `json:"error"`
+}
+
+// restHandler handles the cors preflight and errors for the rest api
+type restHandler func(rw http.ResponseWriter, req *http.Request) error
+
+func (self restHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if allowCors(rw, req) {
+		return
+	}
+	if req.Method != "GET" {
+		rw.Header().Set("Allow", "GET, OPTIONS")
+		writeRestError(rw, http.StatusMethodNotAllowed, &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Method not allowed",
+		})
+		return
+	}
+	if err := self(rw, req); err != nil {
+		rpcErr, ok := err.(*json2.Error)
+		if !ok {
+			fmt.Printf("[ERR] Problem serving %s: %s\n", req.URL.Path, err)
+			rpcErr = &json2.Error{Code: json2.E_INTERNAL, Message: "Internal error"}
+		}
+		writeRestError(rw, restStatus(rpcErr.Code), rpcErr)
+	}
+}
+
+// GET /listings
+func restListings(rw http.ResponseWriter, req *http.Request) error {
+	args := WebServiceListingRequest{}
+	if err := decodeQuery(req.URL.Query(), &args); err != nil {
+		return err
+	}
+	if err := authorizeListingUser(req, &args); err != nil {
+		return err
+	}
+
+	if acceptsGeoJson(req) {
+		args.Format = FormatGeoJson
+	}
+
+	reply := WebServiceListingResponse{}
+	if err := queryListings(&args, &reply); err != nil {
+		return err
+	}
+
+	if args.Format == FormatGeoJson {
+		return writeRestGeoJson(rw, WebServiceFeatureCollection{
+			Type:       reply.Type,
+			Features:   reply.Features,
+			Total:      reply.Total,
+			NextCursor: reply.NextCursor,
+		})
+	}
+	return writeRestJson(rw, reply)
+}
+
+// GET /listings/{id} and /listings/{id}/photos
+func restListing(rw http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/listings/"), "/"), "/")
+
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "photos") || parts[0] == "" {
+		return &json2.Error{Code: E_NOT_FOUND, Message: "Not found"}
+	}
+
+	listing, err := lookupListing(parts[0])
+	if err != nil {
+		return err
+	}
+
+	if len(parts) == 2 {
+		response := newWebServiceListing(listing)
+		return writeRestJson(rw, WebServiceListingPhotosResponse{Id: response.Id, Photos: response.Photos})
+	}
+	if acceptsGeoJson(req) || req.URL.Query().Get("format") == FormatGeoJson {
+		return writeRestGeoJson(rw, newWebServiceFeature(listing))
+	}
+	return writeRestJson(rw, newWebServiceListing(listing))
+}
+
+// GET /openapi.json
+func restOpenAPI(rw http.ResponseWriter, req *http.Request) error {
+	return writeRestJson(rw, openAPIDocument())
+}
+
+func writeRestJson(rw http.ResponseWriter, body interface{}) error {
+	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	return json.NewEncoder(rw).Encode(body)
+}
+
+func writeRestGeoJson(rw http.ResponseWriter, body interface{}) error {
+	rw.Header().Set("Content-Type", GeoJsonContentType)
+	return json.NewEncoder(rw).Encode(body)
+}
+
+// acceptsGeoJson is true if the client asked for geojson over json
+func acceptsGeoJson(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		if mediaType == GeoJsonContentType {
+			return true
+		}
+		if mediaType == "application/json" {
+			return false
+		}
+	}
+	return false
+}
+
+func writeRestError(rw http.ResponseWriter, status int, rpcErr *json2.Error) {
+	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(WebServiceErrorResponse{Error: *rpcErr})
+}
+
+// restStatus maps the json-rpc error codes to http statuses
+func restStatus(code json2.ErrorCode) int {
+	switch code {
+	case json2.E_BAD_PARAMS, json2.E_INVALID_REQ, json2.E_PARSE:
+		return http.StatusBadRequest
+	case E_NOT_FOUND, json2.E_NO_METHOD:
+		return http.StatusNotFound
+	case E_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	case E_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// Query parameters
+
+const (
+	queryScalar = iota
+	queryList
+	queryJson
+)
+
+// queryField is one query parameter, and where it goes in the request
+type queryField struct {
+	Name  string
+	Kind  int
+	Index []int
+	Type  reflect.Type
+	// The nested struct pointer to allocate, for dotted names
+	Parent []int
+}
+
+// queryFields lists the query parameters for a request type
+func queryFields(requestType reflect.Type) []queryField {
+	var fields []queryField
+	for _, field := range jsonFields(requestType) {
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct && isFlatStruct(fieldType.Elem()) {
+			for _, sub := range jsonFields(fieldType.Elem()) {
+				fields = append(fields, queryField{
+					Name:   field.Name + "." + sub.Name,
+					Kind:   queryScalar,
+					Index:  append(append([]int{}, field.Index...), sub.Index...),
+					Type:   sub.Type,
+					Parent: field.Index,
+				})
+			}
+			continue
+		}
+
+		kind := queryJson
+		if isScalar(fieldType) {
+			kind = queryScalar
+		} else if fieldType.Kind() == reflect.Slice && isScalar(fieldType.Elem()) {
+			kind = queryList
+		}
+		fields = append(fields, queryField{Name: field.Name, Kind: kind, Index: field.Index, Type: fieldType})
+	}
+	return fields
+}
+
+type jsonField struct {
+	Name  string
+	Index []int
+	Type  reflect.Type
+}
+
+// jsonFields are the exported fields of a struct, by their json names
+func jsonFields(structType reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		// Embedded structs are inlined, like encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for _, inner := range jsonFields(field.Type) {
+				inner.Index = append([]int{i}, inner.Index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{Name: name, Index: field.Index, Type: field.Type})
+	}
+	return fields
+}
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isFlatStruct(t reflect.Type) bool {
+	for _, field := range jsonFields(t) {
+		if !isScalar(field.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeQuery fills in the request from the query parameters, unknown
+// parameters and bad values are reported as a json-rpc bad params error
+func decodeQuery(values url.Values, request interface{}) error {
+	target := reflect.ValueOf(request).Elem()
+
+	known := make(map[string]bool)
+	invalid := make(map[string]string)
+
+	for _, field := range queryFields(target.Type()) {
+		known[field.Name] = true
+		raw, found := values[field.Name]
+		if !found || len(raw) == 0 {
+			continue
+		}
+
+		if field.Parent != nil {
+			parent := target.FieldByIndex(field.Parent)
+			if parent.IsNil() {
+				parent.Set(reflect.New(parent.Type().Elem()))
+			}
+		}
+		value := target.FieldByIndex(field.Index)
+
+		var err error
+		switch field.Kind {
+		case queryScalar:
+			err = setScalar(value, raw[len(raw)-1])
+		case queryList:
+			list := reflect.MakeSlice(field.Type, 0, len(raw))
+			for _, item := range splitList(raw) {
+				element := reflect.New(field.Type.Elem()).Elem()
+				if err = setScalar(element, item); err != nil {
+					break
+				}
+				list = reflect.Append(list, element)
+			}
+			value.Set(list)
+		case queryJson:
+			err = json.Unmarshal([]byte(raw[len(raw)-1]), value.Addr().Interface())
+		}
+		if err != nil {
+			invalid[field.Name] = err.Error()
+		}
+	}
+
+	for name := range values {
+		if !known[name] {
+			invalid[name] = "unknown parameter"
+		}
+	}
+
+	if len(invalid) > 0 {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Invalid query parameters",
+			Data:    map[string]interface{}{"parameters": invalid},
+		}
+	}
+	return nil
+}
+
+func splitList(raw []string) []string {
+	var items []string
+	for _, value := range raw {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func setScalar(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a whole number")
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a positive whole number")
+		}
+		value.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		value.SetFloat(parsed)
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDecodeQuery(t *testing.T) {
+
+	type inOut struct {
+		query  string
+		expect WebServiceListingRequest
+		valid  bool
+	}
+
+	cases := []inOut{
+		{"minPrice=100000&maxPrice=250000&limit=10", WebServiceListingRequest{PriceMin: 100000, PriceMax: 250000, Limit: 10}, true},
+		{"states=CO,CA&states=NM&zip=80203&zip-meters=5000", WebServiceListingRequest{States: []string{"CO", "CA", "NM"}, Zip: "80203", ZipDistance: 5000}, true},
+		{"bounds.west=-105.1&bounds.south=39.6&bounds.east=-104.8&bounds.north=39.8",
+			WebServiceListingRequest{Bounds: &WebServiceBounds{West: -105.1, South: 39.6, East: -104.8, North: 39.8}}, true},
+		{"near.lat=39.7&near.lng=-104.9&near.meters=1000", WebServiceListingRequest{Near: &WebServiceNear{Lat: 39.7, Lng: -104.9, Meters: 1000}}, true},
+		{"minPrice=cheap", WebServiceListingRequest{}, false},
+		{"minPrice=-5", WebServiceListingRequest{}, false},
+		{"colour=blue", WebServiceListingRequest{}, false},
+		{"polygon=[1,2", WebServiceListingRequest{}, false},
+	}
+
+	for _, c := range cases {
+		values, _ := url.ParseQuery(c.query)
+		got := WebServiceListingRequest{}
+		err := decodeQuery(values, &got)
+		if !c.valid {
+			if rpcErr, ok := err.(*json2.Error); !ok || rpcErr.Code != json2.E_BAD_PARAMS {
+				t.Errorf("decodeQuery(%q) == %v, expected a bad params error", c.query, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("decodeQuery(%q) == %+v, %v, expected %+v", c.query, got, err, c.expect)
+		}
+	}
+
+	values, _ := url.ParseQuery(`polygon={"type":"Polygon","coordinates":[[[-105,39],[-104,39],[-104,40],[-105,39]]]}`)
+	got := WebServiceListingRequest{}
+	if err := decodeQuery(values, &got); err != nil || got.Polygon == nil || len(got.Polygon.Coordinates[0]) != 4 {
+		t.Errorf("decodeQuery(polygon) == %+v, %v, expected the polygon from json", got.Polygon, err)
+	}
+}
+
+func TestDecodeQueryEmbedded(t *testing.T) {
+
+	values, _ := url.ParseQuery("zoom=12&minPrice=200000&bounds.west=-105.1&bounds.south=39.6&bounds.east=-104.8&bounds.north=39.8")
+	got := WebServiceClusterRequest{}
+	if err := decodeQuery(values, &got); err != nil {
+		t.Fatalf("decodeQuery() == %v", err)
+	}
+	if got.Zoom != 12 || got.PriceMin != 200000 || got.Bounds == nil || got.Bounds.North != 39.8 {
+		t.Errorf("decodeQuery() == %+v, expected the embedded listing filters filled in", got)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+
+	document := openAPIDocument()
+
+	paths := document["paths"].(map[string]interface{})
+	for _, route := range openAPIRoutes {
+		if _, found := paths[route.Path]; !found {
+			t.Errorf("missing path %s", route.Path)
+		}
+	}
+
+	// Every request field should be a parameter
+	listings := paths["/listings"].(map[string]interface{})["get"].(map[string]interface{})
+	names := make(map[string]bool)
+	for _, parameter := range listings["parameters"].([]interface{}) {
+		names[parameter.(map[string]interface{})["name"].(string)] = true
+	}
+	for _, name := range []string{"minPrice", "zip-meters", "states", "bounds.west", "near.meters", "polygon", "cursor"} {
+		if !names[name] {
+			t.Errorf("missing /listings parameter %s", name)
+		}
+	}
+
+	schemas := document["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, name := range []string{"WebServiceListingResponse", "WebServiceListing", "WebServiceListingPhoto", "WebServiceErrorResponse"} {
+		if schemas[name] == nil {
+			t.Errorf("missing schema %s", name)
+		}
+	}
+}
+
+func TestNewWebServiceFeature(t *testing.T) {
+
+	listing := home.Listing{
+		Id:  bson.NewObjectId(),
+		Url: "https://www.homes.com/property/1",
+		Properties: home.ListingProperties{
+			CurrentPrice: 350000,
+			Location:     home.NewGeoJsonPoint(-104.98, 39.73),
+			Address:      home.ListingAddress{Street: "123 N Main St", City: "Denver", State: "CO", Zip: "80203"},
+		},
+		Images: []home.ListingImage{{Url: "https://img/1.jpg"}, {Url: "https://img/2.jpg"}},
+	}
+
+	feature := newWebServiceFeature(listing)
+	if feature.Type != "Feature" || feature.Geometry == nil || feature.Geometry.Coordinates[0] != -104.98 {
+		t.Errorf("newWebServiceFeature() == %+v, expected a point feature", feature)
+	}
+	if feature.Properties.Price != 350000 || feature.Properties.Photo != "https://img/1.jpg" || feature.Properties.Address.Zip != "80203" {
+		t.Errorf("feature properties == %+v", feature.Properties)
+	}
+
+	// Not located, still a feature, just without a geometry
+	listing.Properties.Location = home.GeoJson{}
+	if feature := newWebServiceFeature(listing); feature.Geometry != nil {
+		t.Errorf("expected a null geometry, got %+v", feature.Geometry)
+	}
+
+	type inOut struct {
+		accept  string
+		geoJson bool
+	}
+	cases := []inOut{
+		{"", false},
+		{"application/json", false},
+		{"application/geo+json", true},
+		{"application/geo+json;q=0.9, application/json", true},
+		{"application/json, application/geo+json", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/listings", nil)
+		req.Header.Set("Accept", c.accept)
+		if got := acceptsGeoJson(req); got != c.geoJson {
+			t.Errorf("acceptsGeoJson(%q) == %v, expected %v", c.accept, got, c.geoJson)
+		}
+	}
+}
+
+func TestEmptyFeatureCollection(t *testing.T) {
+
+	// No matches is still a FeatureCollection, features and all
+	reply := WebServiceListingResponse{Type: "FeatureCollection", Features: newWebServiceFeatures(nil)}
+	encoded, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"features":[]`) {
+		t.Errorf("json.Marshal() == %s, expected empty features", encoded)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+// Saved searches, run after the crawlers to alert users about new
+// listings and price changes
+
+// Most alerts handed back at once
+const SearchAlertLimit = 50
+
+// The listing filters worth saving, named like the GetListings ones
+type WebServiceSearchCriteria struct {
+	PriceMin    uint                 `json:"minPrice"`
+	PriceMax    uint                 `json:"maxPrice"`
+	Zip         string               `json:"zip"`
+	ZipDistance uint                 `json:"zip-meters"`
+	Zips        []string             `json:"zips"`
+	States      []string             `json:"states"`
+	Cities      []string             `json:"cities"`
+	Bounds      *WebServiceBounds    `json:"bounds,omitempty"`
+	Polygon     *home.GeoJsonPolygon `json:"polygon,omitempty"`
+	Near        *WebServiceNear      `json:"near,omitempty"`
+}
+
+type WebServiceSavedSearch struct {
+	// Empty to add a new search
+	Id       string                   `json:"id"`
+	UserId   string                   `json:"userId"`
+	Name     string                   `json:"name"`
+	Criteria WebServiceSearchCriteria `json:"criteria"`
+	Webhook  string                   `json:"webhook,omitempty"`
+	Email    string                   `json:"email,omitempty"`
+}
+
+type WebServiceUserRequest struct {
+	UserId string `json:"userId"`
+}
+
+type WebServiceSavedSearchesResponse struct {
+	Searches []WebServiceSavedSearch `json:"searches"`
+}
+
+type WebServiceSavedSearchRequest struct {
+	UserId string `json:"userId"`
+	Id     string `json:"id"`
+}
+
+type WebServiceSearchAlertsResponse struct {
+	Alerts []WebServiceSearchAlert `json:"alerts"`
+}
+
+type WebServiceSearchAlert struct {
+	Id         string                     `json:"id"`
+	SearchId   string                     `json:"searchId"`
+	SearchName string                     `json:"searchName"`
+	Listings   []home.AlertPayloadListing `json:"listings"`
+	Delivered  bool                       `json:"delivered"`
+	Date       time.Time                  `json:"date"`
+}
+
+func (self *WebService) SaveSearch(r *http.Request, args *WebServiceSavedSearch, reply *WebServiceSavedSearch) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+	if args.Webhook == "" && args.Email == "" {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "A webhook or email is needed to send alerts to",
+		}
+	}
+	// Saved as a polygon, which doesn't mind the corners mixed up
+	if bounds := args.Criteria.Bounds; bounds != nil {
+		if err := home.CheckBounds(bounds.West, bounds.South, bounds.East, bounds.North); err != nil {
+			return queryError(err)
+		}
+	}
+
+	search := home.SavedSearch{
+		UserId:   args.UserId,
+		Name:     args.Name,
+		Criteria: newSearchCriteria(args.Criteria),
+		Webhook:  args.Webhook,
+		Email:    args.Email,
+	}
+	if args.Id != "" {
+		searchId, err := home.ParseListingId(args.Id)
+		if err != nil {
+			return invalidSearchIdError(args.Id)
+		}
+		search.Id = searchId
+	}
+
+	saved, err := homeDb.SaveSearch(search)
+	if err != nil {
+		return searchError(args.Id, err)
+	}
+
+	*reply = newWebServiceSavedSearch(saved)
+	return nil
+}
+
+func (self *WebService) GetSavedSearches(r *http.Request, args *WebServiceUserRequest, reply *WebServiceSavedSearchesResponse) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+
+	searches, err := homeDb.GetSavedSearches(args.UserId)
+	if err != nil {
+		return searchError("", err)
+	}
+
+	reply.Searches = make([]WebServiceSavedSearch, len(searches))
+	for i, search := range searches {
+		reply.Searches[i] = newWebServiceSavedSearch(search)
+	}
+	return nil
+}
+
+func (self *WebService) DeleteSavedSearch(r *http.Request, args *WebServiceSavedSearchRequest, reply *WebServiceSavedSearchRequest) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+	searchId, err := home.ParseListingId(args.Id)
+	if err != nil {
+		return invalidSearchIdError(args.Id)
+	}
+
+	if err := homeDb.DeleteSavedSearch(args.UserId, searchId); err != nil {
+		return searchError(args.Id, err)
+	}
+
+	*reply = *args
+	return nil
+}
+
+func (self *WebService) GetSearchAlerts(r *http.Request, args *WebServiceUserRequest, reply *WebServiceSearchAlertsResponse) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+
+	alerts, err := homeDb.GetSearchAlerts(args.UserId, SearchAlertLimit)
+	if err != nil {
+		return searchError("", err)
+	}
+
+	reply.Alerts = make([]WebServiceSearchAlert, len(alerts))
+	for i, alert := range alerts {
+		payload := home.NewAlertPayload(alert)
+		reply.Alerts[i] = WebServiceSearchAlert{
+			Id:         payload.AlertId,
+			SearchId:   payload.SearchId,
+			SearchName: payload.SearchName,
+			Listings:   payload.Listings,
+			Delivered:  !alert.DeliveredDate.IsZero(),
+			Date:       alert.CreatedDate,
+		}
+	}
+	return nil
+}
+
+func newSearchCriteria(criteria WebServiceSearchCriteria) home.SearchCriteria {
+	search := home.SearchCriteria{
+		PriceMin: criteria.PriceMin,
+		PriceMax: criteria.PriceMax,
+		Zips:     criteria.Zips,
+		States:   criteria.States,
+		Cities:   criteria.Cities,
+		Polygon:  criteria.Polygon,
+	}
+	if criteria.Zip != "" && criteria.ZipDistance != 0 {
+		search.NearZip = criteria.Zip
+		search.ZipDistance = criteria.ZipDistance
+	} else if criteria.Zip != "" {
+		search.Zips = append(search.Zips, criteria.Zip)
+	}
+	// Saved as the polygon it covers
+	if criteria.Bounds != nil && criteria.Polygon == nil {
+		box := home.BoxPolygon(criteria.Bounds.West, criteria.Bounds.South, criteria.Bounds.East, criteria.Bounds.North)
+		search.Polygon = &box
+	}
+	if criteria.Near != nil {
+		search.Near = &home.SearchNear{
+			Longitude: criteria.Near.Lng,
+			Latitude:  criteria.Near.Lat,
+			Meters:    criteria.Near.Meters,
+		}
+	}
+	return search
+}
+
+func newWebServiceSavedSearch(search home.SavedSearch) WebServiceSavedSearch {
+	criteria := search.Criteria
+	response := WebServiceSavedSearch{
+		Id:     search.Id.Hex(),
+		UserId: search.UserId,
+		Name:   search.Name,
+		Criteria: WebServiceSearchCriteria{
+			PriceMin:    criteria.PriceMin,
+			PriceMax:    criteria.PriceMax,
+			Zip:         criteria.NearZip,
+			ZipDistance: criteria.ZipDistance,
+			Zips:        criteria.Zips,
+			States:      criteria.States,
+			Cities:      criteria.Cities,
+			Polygon:     criteria.Polygon,
+		},
+		Webhook: search.Webhook,
+		Email:   search.Email,
+	}
+	if criteria.Near != nil {
+		response.Criteria.Near = &WebServiceNear{
+			Lat:    criteria.Near.Latitude,
+			Lng:    criteria.Near.Longitude,
+			Meters: criteria.Near.Meters,
+		}
+	}
+	return response
+}
+
+func invalidSearchIdError(id string) error {
+	return &json2.Error{
+		Code:    json2.E_BAD_PARAMS,
+		Message: "Invalid saved search id",
+		Data:    map[string]interface{}{"id": id},
+	}
+}
+
+// searchError turns an error from the saved searches into a json-rpc error
+func searchError(id string, err error) error {
+	if err == home.ErrSearchNotFound {
+		return &json2.Error{
+			Code:    E_NOT_FOUND,
+			Message: "Saved search not found",
+			Data:    map[string]interface{}{"id": id},
+		}
+	}
+	if _, ok := err.(*home.QueryError); ok || err == home.ErrNoGeocoder {
+		return queryError(err)
+	}
+	if invalid, ok := err.(*home.InvalidSearchError); ok {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: invalid.Err.Error(),
+			Data:    map[string]interface{}{"field": invalid.Field},
+		}
+	}
+	fmt.Printf("[ERR] Problem with saved searches: %s\n", err)
+	return &json2.Error{
+		Code:    json2.E_INTERNAL,
+		Message: "Problem with saved searches",
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Live listing updates, as server-sent events. The client subscribes
+// with the same filters as GET /listings, and gets each new or changed
+// listing that matches as the crawlers save it, by polling the outbox.
+// Event ids are the outbox seqs, reconnecting browsers send the last one
+// as Last-Event-ID, and pick up from there.
+
+const (
+	StreamContentType = "text/event-stream"
+
+	StreamPollInterval = 2 * time.Second
+	// Comment lines keep proxies from closing a quiet stream
+	StreamHeartbeat = 15 * time.Second
+
+	// Change events read from the outbox at a time
+	streamBatch = 500
+)
+
+// The data of each event, the listing's the same as GetListings, or a
+// Feature for the geojson format
+type WebServiceStreamEvent struct {
+	// The change type, ie: listing.price
+	Type    string             `json:"type"`
+	Listing *WebServiceListing `json:"listing,omitempty"`
+	Feature *WebServiceFeature `json:"feature,omitempty"`
+}
+
+// GET /stream
+func restStream(rw http.ResponseWriter, req *http.Request) error {
+	args := WebServiceListingRequest{}
+	if err := decodeQuery(req.URL.Query(), &args); err != nil {
+		return err
+	}
+	if err := authorizeListingUser(req, &args); err != nil {
+		return err
+	}
+	if args.Format != FormatListings && args.Format != FormatGeoJson {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Unknown format",
+			Data:    map[string]interface{}{"format": args.Format},
+		}
+	}
+	// Paging makes no sense here
+	args.Limit = 0
+	args.Sort = ""
+	args.Cursor = ""
+
+	// Bad filters are reported before the stream starts
+	check := args
+	if err := buildListingsQuery(&check).Err(); err != nil {
+		return queryError(err)
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming not supported by the response writer")
+	}
+
+	lastSeq, err := streamStart(req.Header.Get("Last-Event-ID"))
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", StreamContentType)
+	rw.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer it
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "retry: %d\n\n", StreamPollInterval.Milliseconds())
+	flusher.Flush()
+
+	poll := time.NewTicker(StreamPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case <-poll.C:
+		}
+
+		for {
+			changes, err := homeDb.GetChangesAfter(lastSeq, streamBatch)
+			if err != nil {
+				fmt.Println("[ERR] Problem reading listing changes: ", err)
+				break
+			}
+			if len(changes) == 0 {
+				break
+			}
+
+			events, err := streamEvents(args, changes)
+			if err != nil {
+				fmt.Println("[ERR] Problem matching listing changes: ", err)
+				break
+			}
+			for _, event := range events {
+				if err := writeStreamEvent(rw, event.seq, event.data); err != nil {
+					// Gone away
+					return nil
+				}
+			}
+			if len(events) > 0 {
+				flusher.Flush()
+				lastWrite = time.Now()
+			}
+
+			lastSeq = changes[len(changes)-1].Seq
+			if len(changes) < streamBatch {
+				break
+			}
+		}
+
+		if time.Since(lastWrite) >= StreamHeartbeat {
+			if _, err := io.WriteString(rw, ": ping\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+	}
+}
+
+// streamStart is where to pick up from, after the last event the
+// client saw, or from now
+func streamStart(lastEventId string) (int64, error) {
+	if seq, err := strconv.ParseInt(lastEventId, 10, 64); err == nil && seq > 0 {
+		return seq, nil
+	}
+	lastSeq, err := homeDb.LastChangeSeq()
+	if err != nil {
+		fmt.Println("[ERR] Problem finding the latest listing change: ", err)
+		return lastSeq, &json2.Error{Code: E_UNAVAILABLE, Message: "Listing changes are not available"}
+	}
+	return lastSeq, nil
+}
+
+type streamEvent struct {
+	seq  int64
+	data WebServiceStreamEvent
+}
+
+// streamEvents matches the changed listings against the filters, one
+// event per listing, in the order they last changed
+func streamEvents(args WebServiceListingRequest, changes []home.ChangeEvent) ([]streamEvent, error) {
+	latest := latestChanges(changes, args.IncludeIds)
+	if len(latest) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(latest))
+	for listingId := range latest {
+		ids = append(ids, listingId.Hex())
+	}
+	// Just the changed ones, not everything asked for
+	args.IncludeIds = ids
+
+	listings, _, err := buildListingsQuery(&args).Fetch()
+	if err != nil {
+		return nil, err
+	}
+	if err := homeDb.MergeDuplicates(*listings); err != nil {
+		fmt.Println("[ERR] Problem merging duplicate listings: ", err)
+	}
+
+	var events []streamEvent
+	for _, listing := range *listings {
+		// Asking by id includes duplicates, the primary listing stands in
+		if listing.Duplicate {
+			continue
+		}
+		change := latest[listing.Id]
+		data := WebServiceStreamEvent{Type: change.Type}
+		if args.Format == FormatGeoJson {
+			feature := newWebServiceFeature(listing)
+			data.Feature = &feature
+		} else {
+			response := newWebServiceListing(listing)
+			data.Listing = &response
+		}
+		events = append(events, streamEvent{seq: change.Seq, data: data})
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].seq < events[j].seq })
+	return events, nil
+}
+
+// latestChanges is the last change for each listing, limited to the
+// included ids if there are any
+func latestChanges(changes []home.ChangeEvent, includeIds []string) map[bson.ObjectId]home.ChangeEvent {
+	included := make(map[string]bool, len(includeIds))
+	for _, id := range includeIds {
+		included[id] = true
+	}
+
+	latest := make(map[bson.ObjectId]home.ChangeEvent)
+	for _, change := range changes {
+		if len(included) > 0 && !included[change.ListingId.Hex()] {
+			continue
+		}
+		latest[change.ListingId] = change
+	}
+	return latest
+}
+
+func writeStreamEvent(w io.Writer, seq int64, data WebServiceStreamEvent) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: listing\ndata: %s\n\n", seq, encoded)
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jmshelby/photochem/home"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLatestChanges(t *testing.T) {
+
+	first := bson.ObjectIdHex("5a0000000000000000000001")
+	second := bson.ObjectIdHex("5a0000000000000000000002")
+
+	changes := []home.ChangeEvent{
+		{Id: bson.ObjectIdHex("5b0000000000000000000001"), Type: home.ChangeCreated, ListingId: first},
+		{Id: bson.ObjectIdHex("5b0000000000000000000002"), Type: home.ChangePrice, ListingId: second},
+		{Id: bson.ObjectIdHex("5b0000000000000000000003"), Type: home.ChangePhotos, ListingId: first},
+	}
+
+	type inOut struct {
+		includeIds []string
+		expect     map[bson.ObjectId]string
+	}
+
+	cases := []inOut{
+		{nil, map[bson.ObjectId]string{first: home.ChangePhotos, second: home.ChangePrice}},
+		{[]string{second.Hex()}, map[bson.ObjectId]string{second: home.ChangePrice}},
+		{[]string{"5a0000000000000000000009"}, map[bson.ObjectId]string{}},
+	}
+
+	for _, c := range cases {
+		got := latestChanges(changes, c.includeIds)
+		if len(got) != len(c.expect) {
+			t.Errorf("latestChanges(%v) == %v, expected %v", c.includeIds, got, c.expect)
+			continue
+		}
+		for listingId, changeType := range c.expect {
+			if got[listingId].Type != changeType {
+				t.Errorf("latestChanges(%v)[%s] == %q, expected %q", c.includeIds, listingId.Hex(), got[listingId].Type, changeType)
+			}
+		}
+	}
+}
+
+func TestWriteStreamEvent(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeStreamEvent(&buf, 42, WebServiceStreamEvent{Type: home.ChangePrice}); err != nil {
+		t.Fatal(err)
+	}
+	expect := "id: 42\nevent: listing\ndata: {\"type\":\"listing.price\"}\n\n"
+	if buf.String() != expect {
+		t.Errorf("writeStreamEvent() wrote %q, expected %q", buf.String(), expect)
+	}
+}
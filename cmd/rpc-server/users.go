@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Per user listing state, what they've seen, liked and hidden. GetListings
+// leaves out the seen ones when given the userId.
+//
+// Users sign in with a token, "Authorization: Bearer <token>", see
+// home.UserToken. The userId in the request can be left out, it's
+// taken from the token, but if it's there it has to be the same user.
+
+// Most liked or hidden listings handed back at once
+const UserListingLimit = 200
+
+type WebServiceSeenRequest struct {
+	UserId string   `json:"userId"`
+	Ids    []string `json:"ids"`
+}
+
+type WebServiceReactionRequest struct {
+	UserId string `json:"userId"`
+	Id     string `json:"id"`
+	// "like", "hide", or empty to take it back
+	Reaction string `json:"reaction"`
+}
+
+type WebServiceUserListingsRequest struct {
+	UserId string `json:"userId"`
+	// "like" or "hide", likes by default
+	Reaction string `json:"reaction"`
+	Limit    uint   `json:"limit"`
+}
+
+func (self *WebService) MarkListingsSeen(r *http.Request, args *WebServiceSeenRequest, reply *WebServiceSeenRequest) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+
+	listingIds := make([]bson.ObjectId, 0, len(args.Ids))
+	for _, id := range args.Ids {
+		listingId, err := home.ParseListingId(id)
+		if err != nil {
+			return invalidIdError(id)
+		}
+		listingIds = append(listingIds, listingId)
+	}
+
+	if err := homeDb.MarkSeen(args.UserId, listingIds...); err != nil {
+		return userListingError(err)
+	}
+
+	*reply = *args
+	return nil
+}
+
+func (self *WebService) ReactToListing(r *http.Request, args *WebServiceReactionRequest, reply *WebServiceReactionRequest) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+	listingId, err := home.ParseListingId(args.Id)
+	if err != nil {
+		return invalidIdError(args.Id)
+	}
+	if _, err := homeDb.GetListing(listingId); err != nil {
+		return lookupError(args.Id, err)
+	}
+
+	if err := homeDb.React(args.UserId, listingId, args.Reaction); err != nil {
+		return userListingError(err)
+	}
+
+	*reply = *args
+	return nil
+}
+
+// GetUserListings returns the listings the user liked, or hid, most
+// recent first. Listings gone off the market are still included.
+func (self *WebService) GetUserListings(r *http.Request, args *WebServiceUserListingsRequest, reply *WebServiceListingResponse) error {
+
+	if err := authorizeUser(r, &args.UserId); err != nil {
+		return err
+	}
+	reaction := args.Reaction
+	if reaction == "" {
+		reaction = home.ReactionLike
+	}
+	limit := UserListingLimit
+	if args.Limit != 0 && args.Limit < UserListingLimit {
+		limit = int(args.Limit)
+	}
+
+	userListings, err := homeDb.GetUserListings(args.UserId, reaction, limit)
+	if err != nil {
+		return userListingError(err)
+	}
+
+	reply.Listings = []WebServiceListing{}
+	if len(userListings) > 0 {
+		ids := make([]string, len(userListings))
+		for i, userListing := range userListings {
+			ids[i] = userListing.ListingId.Hex()
+		}
+		query := homeDb.NewListingsQuery()
+		query.Include(ids...)
+		listings, _, err := query.Fetch()
+		if err != nil {
+			return queryError(err)
+		}
+		if err := homeDb.MergeDuplicates(*listings); err != nil {
+			fmt.Println("[ERR] Problem merging duplicate listings: ", err)
+		}
+
+		// Back in the order they were reacted to
+		byId := make(map[string]home.Listing, len(*listings))
+		for _, listing := range *listings {
+			byId[listing.Id.Hex()] = listing
+		}
+		for _, id := range ids {
+			if listing, ok := byId[id]; ok {
+				reply.Listings = append(reply.Listings, newWebServiceListing(listing))
+			}
+		}
+	}
+
+	reply.Total = len(reply.Listings)
+	reply.ResponseTotal = len(reply.Listings)
+	return nil
+}
+
+// authorizeUser checks the request's user token, and fills in the
+// userId from it
+func authorizeUser(r *http.Request, userId *string) error {
+	if userSecret == "" {
+		return &json2.Error{
+			Code:    E_UNAVAILABLE,
+			Message: "User features are not available",
+		}
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	signedIn, err := home.ParseUserToken(userSecret, token)
+	if err != nil {
+		return &json2.Error{
+			Code:    E_UNAUTHORIZED,
+			Message: "A valid user token is required",
+		}
+	}
+	if *userId != "" && *userId != signedIn {
+		return &json2.Error{
+			Code:    E_UNAUTHORIZED,
+			Message: "The userId isn't the signed in user",
+			Data:    map[string]interface{}{"userId": *userId},
+		}
+	}
+	*userId = signedIn
+	return nil
+}
+
+// authorizeListingUser checks the user token for listing requests, which
+// leave out what the user has seen. A signed in user doesn't need to send
+// their userId, and requests without either don't need a token.
+func authorizeListingUser(r *http.Request, args *WebServiceListingRequest) error {
+	if args.UserId == "" && r.Header.Get("Authorization") == "" {
+		return nil
+	}
+	return authorizeUser(r, &args.UserId)
+}
+
+// userListingError turns an error from the user's listings into a
+// json-rpc error
+func userListingError(err error) error {
+	if err == home.ErrUnknownReaction {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: "Unknown reaction, expected like or hide",
+		}
+	}
+	fmt.Printf("[ERR] Problem with user listings: %s\n", err)
+	return &json2.Error{
+		Code:    json2.E_INTERNAL,
+		Message: "Problem with user listings",
+	}
+}
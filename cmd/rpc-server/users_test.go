@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+)
+
+func TestAuthorizeUser(t *testing.T) {
+
+	defer func(secret string) { userSecret = secret }(userSecret)
+
+	type inOut struct {
+		secret string
+		token  string
+		userId string
+		expect string
+		code   json2.ErrorCode
+	}
+
+	cases := []inOut{
+		{"shh", home.UserToken("shh", "user-1"), "", "user-1", 0},
+		{"shh", home.UserToken("shh", "user-1"), "user-1", "user-1", 0},
+		// Can't ask as someone else
+		{"shh", home.UserToken("shh", "user-1"), "user-2", "", E_UNAUTHORIZED},
+		{"shh", home.UserToken("other", "user-1"), "", "", E_UNAUTHORIZED},
+		{"shh", "", "user-1", "", E_UNAUTHORIZED},
+		// Turned off
+		{"", home.UserToken("", "user-1"), "user-1", "", E_UNAVAILABLE},
+	}
+
+	for i, c := range cases {
+		userSecret = c.secret
+		req := httptest.NewRequest("POST", "/rpc", nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		userId := c.userId
+		err := authorizeUser(req, &userId)
+		if c.code == 0 {
+			if err != nil || userId != c.expect {
+				t.Errorf("case %d: authorizeUser() == %v, userId %q, expected %q", i, err, userId, c.expect)
+			}
+			continue
+		}
+		if rpcErr, ok := err.(*json2.Error); !ok || rpcErr.Code != c.code {
+			t.Errorf("case %d: authorizeUser() == %v, expected code %d", i, err, c.code)
+		}
+	}
+
+	// Listing requests without a user don't need a token
+	userSecret = ""
+	if err := authorizeListingUser(httptest.NewRequest("GET", "/listings", nil), &WebServiceListingRequest{}); err != nil {
+		t.Errorf("authorizeListingUser() without a user == %v", err)
+	}
+
+	// Signed in is enough to leave out what they've seen
+	userSecret = "shh"
+	req := httptest.NewRequest("GET", "/listings", nil)
+	req.Header.Set("Authorization", "Bearer "+home.UserToken("shh", "user-1"))
+	args := WebServiceListingRequest{}
+	if err := authorizeListingUser(req, &args); err != nil || args.UserId != "user-1" {
+		t.Errorf("authorizeListingUser() with a token == %v, userId %q, expected user-1", err, args.UserId)
+	}
+
+	// A bad token isn't ignored
+	req.Header.Set("Authorization", "Bearer "+home.UserToken("other", "user-1"))
+	args = WebServiceListingRequest{}
+	if rpcErr, ok := authorizeListingUser(req, &args).(*json2.Error); !ok || rpcErr.Code != E_UNAUTHORIZED {
+		t.Errorf("authorizeListingUser() with a bad token == %v, expected code %d", rpcErr, E_UNAUTHORIZED)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/jmshelby/photochem/home"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Webhooks for listing changes, delivered by the webhook-dispatcher
+
+// Most dead letters handed back at once
+const DeadLetterLimit = 100
+
+type WebServiceWebhook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Made up if not given, only handed back when registering
+	Secret string `json:"secret,omitempty"`
+	// Change types to send, empty for all of them
+	Types       []string  `json:"types"`
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+type WebServiceWebhooksRequest struct{}
+
+type WebServiceWebhooksResponse struct {
+	Webhooks []WebServiceWebhook `json:"webhooks"`
+}
+
+type WebServiceWebhookIdRequest struct {
+	Id string `json:"id"`
+}
+
+type WebServiceDeadLettersRequest struct {
+	// Empty for all of them
+	WebhookId string `json:"webhookId"`
+}
+
+type WebServiceDeadLettersResponse struct {
+	Deliveries []WebServiceWebhookDelivery `json:"deliveries"`
+}
+
+type WebServiceWebhookDelivery struct {
+	Id          string    `json:"id"`
+	WebhookId   string    `json:"webhookId"`
+	EventId     string    `json:"eventId"`
+	EventType   string    `json:"eventType"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+func (self *WebService) RegisterWebhook(r *http.Request, args *WebServiceWebhook, reply *WebServiceWebhook) error {
+
+	webhook := home.Webhook{
+		Url:    args.Url,
+		Secret: args.Secret,
+		Types:  args.Types,
+	}
+	if err := webhook.Validate(); err != nil {
+		return &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: err.Error(),
+		}
+	}
+
+	webhook, err := homeDb.RegisterWebhook(webhook)
+	if err != nil {
+		return webhookError(err)
+	}
+
+	*reply = newWebServiceWebhook(webhook)
+	reply.Secret = webhook.Secret
+	return nil
+}
+
+func (self *WebService) GetWebhooks(r *http.Request, args *WebServiceWebhooksRequest, reply *WebServiceWebhooksResponse) error {
+
+	webhooks, err := homeDb.GetWebhooks()
+	if err != nil {
+		return webhookError(err)
+	}
+
+	reply.Webhooks = make([]WebServiceWebhook, len(webhooks))
+	for i, webhook := range webhooks {
+		reply.Webhooks[i] = newWebServiceWebhook(webhook)
+	}
+	return nil
+}
+
+func (self *WebService) DeleteWebhook(r *http.Request, args *WebServiceWebhookIdRequest, reply *WebServiceWebhookIdRequest) error {
+
+	webhookId, err := home.ParseListingId(args.Id)
+	if err != nil {
+		return invalidWebhookIdError(args.Id)
+	}
+
+	if err := homeDb.DeleteWebhook(webhookId); err != nil {
+		return webhookError(err)
+	}
+
+	*reply = *args
+	return nil
+}
+
+func (self *WebService) GetDeadLetters(r *http.Request, args *WebServiceDeadLettersRequest, reply *WebServiceDeadLettersResponse) error {
+
+	var webhookId bson.ObjectId
+	if args.WebhookId != "" {
+		var err error
+		if webhookId, err = home.ParseListingId(args.WebhookId); err != nil {
+			return invalidWebhookIdError(args.WebhookId)
+		}
+	}
+
+	deliveries, err := homeDb.GetDeadLetters(webhookId, DeadLetterLimit)
+	if err != nil {
+		return webhookError(err)
+	}
+
+	reply.Deliveries = make([]WebServiceWebhookDelivery, len(deliveries))
+	for i, delivery := range deliveries {
+		reply.Deliveries[i] = WebServiceWebhookDelivery{
+			Id:          delivery.Id.Hex(),
+			WebhookId:   delivery.WebhookId.Hex(),
+			EventId:     delivery.EventId.Hex(),
+			EventType:   delivery.EventType,
+			Attempts:    delivery.Attempts,
+			LastError:   delivery.LastError,
+			CreatedDate: delivery.CreatedDate,
+		}
+	}
+	return nil
+}
+
+func (self *WebService) RetryDeadLetter(r *http.Request, args *WebServiceWebhookIdRequest, reply *WebServiceWebhookIdRequest) error {
+
+	deliveryId, err := home.ParseListingId(args.Id)
+	if err != nil {
+		return invalidWebhookIdError(args.Id)
+	}
+
+	if err := homeDb.RetryDeadLetter(deliveryId); err != nil {
+		return webhookError(err)
+	}
+
+	*reply = *args
+	return nil
+}
+
+func newWebServiceWebhook(webhook home.Webhook) WebServiceWebhook {
+	types := webhook.Types
+	if types == nil {
+		types = []string{}
+	}
+	return WebServiceWebhook{
+		Id:          webhook.Id.Hex(),
+		Url:         webhook.Url,
+		Types:       types,
+		CreatedDate: webhook.CreatedDate,
+	}
+}
+
+func invalidWebhookIdError(id string) error {
+	return &json2.Error{
+		Code:    json2.E_BAD_PARAMS,
+		Message: "Invalid id",
+		Data:    map[string]interface{}{"id": id},
+	}
+}
+
+// webhookError turns an error from the webhooks into a json-rpc error
+func webhookError(err error) error {
+	if err == home.ErrWebhookNotFound || err == home.ErrDeliveryNotFound {
+		return &json2.Error{
+			Code:    E_NOT_FOUND,
+			Message: err.Error(),
+		}
+	}
+	fmt.Printf("[ERR] Problem with webhooks: %s\n", err)
+	return &json2.Error{
+		Code:    json2.E_INTERNAL,
+		Message: "Problem with webhooks",
+	}
+}
@@ -3,90 +3,64 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/jmshelby/photochem/config"
 	"github.com/jmshelby/photochem/home"
 )
 
-const (
-	DefaultNumberOfWorkers = 3
-)
-
 var GlobalWG sync.WaitGroup
 
+// Stops queuing up listings once another process has the lock
+var errLockLost = errors.New("Lock lost to another process")
+
+var fetchConfig = config.Defaults().Fetch
+
 func main() {
 
 	fmt.Printf("Started - %v\n", time.Now())
 
-	flag.Parse()
-	args := flag.Args()
-	fmt.Println(args)
-
-	if len(args) < 1 {
-		fmt.Println("Please specify db host")
-		os.Exit(1)
-	}
-	if len(args) < 2 {
-		fmt.Println("Please specify db name")
-		os.Exit(1)
-	}
-	if len(args) < 3 {
-		fmt.Println("Please specify stale days")
-		os.Exit(1)
-	}
-	if len(args) < 4 {
-		fmt.Println("Please specify batch amount")
-		os.Exit(1)
-	}
+	cfg := config.Defaults()
+	config.MustLoad("update-crawler", cfg, &cfg.DB, &cfg.Fetch, &cfg.Lock, &cfg.Update, &cfg.Geocode, &cfg.Notify)
 
-	dbHost := args[0]
-	dbName := args[1]
+	fetchConfig = cfg.Fetch
+	staleDate := time.Now().AddDate(0, 0, -1*cfg.Update.StaleDays)
+	numberOfWorkers := cfg.Fetch.Workers
 
-	var staleDays int
-	staleDays, convErr := strconv.Atoi(args[2])
-	if convErr != nil {
-		fmt.Printf("Bad number for stale days param")
-		os.Exit(2)
-	}
-	staleDate := time.Now().AddDate(0, 0, -1*staleDays)
+	// Start Up access to our listings
+	var homeDb *home.DB
+	homeDb = home.NewDB(cfg.DB.Host, cfg.DB.Name)
 
-	var batchAmount int
-	batchAmount, convErr = strconv.Atoi(args[3])
-	if convErr != nil {
-		fmt.Printf("Bad number for batch amount param")
-		os.Exit(2)
+	geocoder, err := home.NewGeocoder(cfg.Geocode.Provider, cfg.Geocode.ZipCentroids, cfg.Geocode.GoogleAPIKey)
+	if err != nil {
+		fmt.Println("Problem setting up geocoder: ", err)
+		os.Exit(1)
 	}
+	homeDb.Geocoder = geocoder
 
-	var numberOfWorkers int
-	if len(args) > 4 {
-		var convErr error
-		numberOfWorkers, convErr = strconv.Atoi(args[4])
-		if convErr != nil {
-			fmt.Printf("Bad number of workers param")
-			os.Exit(2)
-		}
-	} else {
-		numberOfWorkers = DefaultNumberOfWorkers
+	// Saved search alerts go out after the run
+	notifier, err := home.NewNotifier(cfg.Notify.Provider, cfg.Notify.SmtpAddr, cfg.Notify.SmtpFrom, cfg.Notify.SmtpUser, cfg.Notify.SmtpPassword)
+	if err != nil {
+		fmt.Println("Problem setting up notifier: ", err)
+		os.Exit(1)
 	}
 
-	unlocked := acquireLock(9292)
-	if !unlocked {
+	lock, err := home.AcquireProcessLock(cfg.Lock.Type, "update-crawler", homeDb)
+	if err == home.ErrLockHeld {
 		fmt.Println("Process already running")
 		os.Exit(0)
 	}
-
-	// Start Up access to our listings
-	var homeDb *home.DB
-	homeDb = home.NewDB(dbHost, dbName)
+	if err != nil {
+		fmt.Println("[ERR] Problem acquiring lock: ", err)
+		os.Exit(1)
+	}
+	lost := lock.Lost()
 
 	// Make channel, buffered with expected number of workers
 	listingQueue := make(chan home.Listing, numberOfWorkers)
@@ -94,30 +68,80 @@ func main() {
 	// Start up workers
 	for i := 0; i < numberOfWorkers; i++ {
 		fmt.Println("Starting up worker ", i+1)
-		go queueWorker(listingQueue, homeDb)
+		go queueWorker(listingQueue, homeDb, cfg.Fetch.Wait.Duration())
 	}
 	GlobalWG.Add(numberOfWorkers)
 
 	var count int = 0
-	homeDb.IterateActiveListingsOlderThan(staleDate, batchAmount, func(listing home.Listing, db *home.DB) {
-		listingQueue <- listing
+	err = homeDb.IterateActiveListingsOlderThan(staleDate, cfg.Update.Batch, func(listing home.Listing, db *home.DB) error {
+		// Stop handing out work if another process took over
+		select {
+		case <-lost:
+			return errLockLost
+		case listingQueue <- listing:
+		}
 		count++
+		return nil
 	})
 	fmt.Printf("Finished Queing up: %v listings\n", count)
 
+	if err == errLockLost {
+		// The rest is the other process's to do now, just let the
+		// workers finish what they have
+		fmt.Println("[ERR] Lock lost to another process, stopping")
+		close(listingQueue)
+		GlobalWG.Wait()
+		homeDb.Close()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println("[ERR] Problem finding listings to update: ", err)
+	}
+
+	// Go back over anything saved without a location
+	if homeDb.Geocoder != nil {
+		located, err := homeDb.GeocodeMissingLocations(cfg.Update.Batch)
+		if err != nil {
+			fmt.Println("[ERR] Problem geocoding listings: ", err)
+		}
+		fmt.Printf("Geocoded: %v listings\n", located)
+	}
+
+	// Link up anything saved before properties were tracked, after
+	// geocoding, since good locations help match them
+	linked, err := homeDb.LinkProperties(cfg.Update.Batch)
+	if err != nil {
+		fmt.Println("[ERR] Problem linking listings to properties: ", err)
+	}
+	fmt.Printf("Linked: %v listings to properties\n", linked)
+
 	// Close Queue
 	close(listingQueue)
 
 	GlobalWG.Wait()
 
+	alerts, err := homeDb.RunSavedSearchesLocked(notifier)
+	switch {
+	case err == home.ErrLockHeld:
+		fmt.Println("Saved searches already running")
+	case err != nil:
+		fmt.Println("[ERR] Problem running saved searches: ", err)
+	default:
+		fmt.Printf("Saved search alerts: %v\n", alerts)
+	}
+
+	lock.Release()
+	homeDb.Close()
+
 	fmt.Printf("Done - %v\n", time.Now())
 
 }
 
-func queueWorker(queue <-chan home.Listing, db *home.DB) {
+func queueWorker(queue <-chan home.Listing, db *home.DB, delay time.Duration) {
 	defer GlobalWG.Done()
 	for listing := range queue {
 		updateListing(listing, db)
+		time.Sleep(delay)
 	}
 }
 
@@ -163,16 +187,16 @@ func fetchPageString(uri string) (string, error) {
 func fetchPage(uri string) (io.ReadCloser, error) {
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: fetchConfig.InsecureSkipVerify,
 		},
 	}
-	client := http.Client{Transport: transport}
+	client := http.Client{Transport: transport, Timeout: fetchConfig.Timeout.Duration()}
 
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.3; Trident/7.0; rv:11.0) like Gecko")
+	req.Header.Set("User-Agent", fetchConfig.UserAgent)
 
 	resp, err := client.Do(req)
 
@@ -182,25 +206,5 @@ func fetchPage(uri string) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
-func acquireLock(lockId int) bool {
-
-	// Hacky way to lock this process down to only one process
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", lockId))
-	if err != nil {
-		if strings.Index(err.Error(), "in use") != -1 {
-			return false
-		} else {
-			panic(err)
-		}
-	}
-
-	// TODO - anything else we need to do to keep this open??
-	go func() {
-		listener.Accept()
-	}()
-
-	return true
-}
-
 // ajax image request example
 // http://www.zillow.com/AjaxRender.htm?encparams=9~646157445473039082~CB_-1qRS8CEVNENXoac54dVO6bpQ9JXPqUZQbgBILh8zxZXnO5NWnbZAECg2MhZm7uGut55uir5fNiq3HD0xFN3IJgW48jmzWCnqtH40wSQ5J-n4oSbY_7DOmv61BMVQ4hzXJ0a7oqNjRHLet28PkKEaLs_1uSSusypJdBvpTReWTDJl7HjrFxk2lvx7R_MB
@@ -0,0 +1,67 @@
+package main
+
+// Delivers the listing change events from the outbox to the registered
+// webhooks, checking for new ones every interval until stopped.
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jmshelby/photochem/config"
+	"github.com/jmshelby/photochem/home"
+)
+
+func main() {
+
+	fmt.Printf("Started - %v\n", time.Now())
+
+	cfg := config.Defaults()
+	config.MustLoad("webhook-dispatcher", cfg, &cfg.DB, &cfg.Lock, &cfg.Dispatch)
+
+	homeDb := home.NewDB(cfg.DB.Host, cfg.DB.Name)
+
+	lock, err := home.AcquireProcessLock(cfg.Lock.Type, "webhook-dispatcher", homeDb)
+	if err == home.ErrLockHeld {
+		fmt.Println("Process already running")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("[ERR] Problem acquiring lock: ", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	dispatcher := homeDb.NewWebhookDispatcher(cfg.Dispatch.MaxAttempts)
+	ticker := time.NewTicker(cfg.Dispatch.Interval.Duration())
+
+	for running := true; running; {
+		stats, err := dispatcher.Dispatch()
+		if err != nil {
+			fmt.Println("[ERR] Problem dispatching webhooks: ", err)
+		}
+		if stats != (home.DispatchStats{}) {
+			fmt.Printf("Events: %v, delivered: %v, failed: %v, dead: %v, skipped: %v\n", stats.Events, stats.Delivered, stats.Failed, stats.Dead, stats.Skipped)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			fmt.Println("Caught Interupt Signal, stopping...")
+			running = false
+		case <-lock.Lost():
+			fmt.Println("[ERR] Lost the lock, stopping...")
+			running = false
+		}
+	}
+
+	ticker.Stop()
+	lock.Release()
+	homeDb.Close()
+
+	fmt.Printf("Done - %v\n", time.Now())
+}
@@ -0,0 +1,456 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EnvPrefix     = "PHOTOCHEM_"
+	ConfigFlag    = "config"
+	ConfigFileEnv = EnvPrefix + "CONFIG"
+
+	DefaultUserAgent = "Mozilla/5.0 (Windows NT 6.3; Trident/7.0; rv:11.0) like Gecko"
+)
+
+// Config holds the settings for all of the commands, each command only
+// looks at (and validates) the sections it needs. Values are loaded
+// from defaults, then the config file, then environment variables,
+// and finally flags, each overriding the last.
+//
+// The config file is JSON, laid out like this struct, ie:
+//
+//	{"db": {"host": "localhost", "name": "homes"}, "fetch": {"wait": "2s"}}
+//
+// Every flag can also be set through an environment variable, named
+// after the flag, ie: -db-host => PHOTOCHEM_DB_HOST
+type Config struct {
+	DB       DBConfig       `json:"db"`
+	Fetch    FetchConfig    `json:"fetch"`
+	Filters  FilterConfig   `json:"filters"`
+	Lock     LockConfig     `json:"lock"`
+	Crawl    CrawlConfig    `json:"crawl"`
+	Update   UpdateConfig   `json:"update"`
+	Server   ServerConfig   `json:"server"`
+	Geocode  GeocodeConfig  `json:"geocode"`
+	Notify   NotifyConfig   `json:"notify"`
+	Dispatch DispatchConfig `json:"dispatch"`
+}
+
+// Section is a part of the config a command can ask for
+type Section interface {
+	RegisterFlags(fs *flag.FlagSet)
+	Validate() error
+}
+
+func Defaults() *Config {
+	return &Config{
+		DB: DBConfig{
+			Host: "localhost",
+		},
+		Fetch: FetchConfig{
+			Workers:            3,
+			Wait:               Duration(2 * time.Second),
+			Timeout:            Duration(30 * time.Second),
+			UserAgent:          DefaultUserAgent,
+			InsecureSkipVerify: true,
+		},
+		Filters: FilterConfig{
+			States:       StringList{"co", "ca", "ny", "hi"},
+			ExcludePaths: StringList{"rentals", "off-campus-housing"},
+		},
+		Lock: LockConfig{
+			Type: "db",
+		},
+		Update: UpdateConfig{
+			StaleDays: 7,
+		},
+		Server: ServerConfig{
+			Listen: ":10000",
+		},
+		Dispatch: DispatchConfig{
+			Interval:    Duration(10 * time.Second),
+			MaxAttempts: 8,
+		},
+	}
+}
+
+// Load fills in the config for the named command from the sources
+// above, using args for the flags. Returns flag.ErrHelp if help was
+// asked for.
+func Load(command string, args []string, cfg *Config, sections ...Section) error {
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.String(ConfigFlag, "", "Path to a JSON config file (or set "+ConfigFileEnv+")")
+	for _, section := range sections {
+		section.RegisterFlags(fs)
+	}
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", command)
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nEvery flag can also be set with an environment variable, ie: -db-host => %sDB_HOST\n", EnvPrefix)
+	}
+
+	// The file goes first, so find it before the rest of the flags
+	path := os.Getenv(ConfigFileEnv)
+	if flagPath := findConfigFlag(args); flagPath != "" {
+		path = flagPath
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return err
+		}
+	}
+
+	// Then the environment
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == ConfigFlag || envErr != nil {
+			return
+		}
+		value, found := os.LookupEnv(envName(f.Name))
+		if !found {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	// And flags last
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	for _, section := range sections {
+		if err := section.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MustLoad is Load for a command's main, it exits on errors, or
+// after printing help.
+func MustLoad(command string, cfg *Config, sections ...Section) {
+	err := Load(command, os.Args[1:], cfg, sections...)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("Bad config: ", err)
+		os.Exit(2)
+	}
+}
+
+func (self *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(self); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func findConfigFlag(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == ConfigFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, ConfigFlag+"=") {
+			return strings.TrimPrefix(name, ConfigFlag+"=")
+		}
+	}
+	return ""
+}
+
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Database
+
+type DBConfig struct {
+	Host string `json:"host"`
+	Name string `json:"name"`
+}
+
+func (self *DBConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.Host, "db-host", self.Host, "MongoDB host to connect to")
+	fs.StringVar(&self.Name, "db-name", self.Name, "MongoDB database name")
+}
+
+func (self *DBConfig) Validate() error {
+	if self.Host == "" {
+		return errors.New("db host is required")
+	}
+	if self.Name == "" {
+		return errors.New("db name is required")
+	}
+	return nil
+}
+
+// Fetching
+
+type FetchConfig struct {
+	Workers            int      `json:"workers"`
+	Wait               Duration `json:"wait"`
+	Timeout            Duration `json:"timeout"`
+	UserAgent          string   `json:"userAgent"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify"`
+}
+
+func (self *FetchConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&self.Workers, "workers", self.Workers, "Number of fetch workers")
+	fs.Var(&self.Wait, "wait", "How long to wait between fetches, to be polite, ie: 2s")
+	fs.Var(&self.Timeout, "fetch-timeout", "Give up on a fetch after this long")
+	fs.StringVar(&self.UserAgent, "user-agent", self.UserAgent, "User-Agent header to send")
+	fs.BoolVar(&self.InsecureSkipVerify, "insecure-tls", self.InsecureSkipVerify, "Skip verifying TLS certificates")
+}
+
+func (self *FetchConfig) Validate() error {
+	if self.Workers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+	if self.Wait < 0 {
+		return errors.New("wait can't be negative")
+	}
+	if self.Timeout <= 0 {
+		return errors.New("fetch timeout must be positive")
+	}
+	return nil
+}
+
+// Crawl Filters
+
+type FilterConfig struct {
+	// Only follow listings in these states, empty for all of them
+	States StringList `json:"states"`
+	// Don't follow links with any of these path segments
+	ExcludePaths StringList `json:"excludePaths"`
+}
+
+func (self *FilterConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&self.States, "states", "Comma separated state codes to crawl listings for, empty for all")
+	fs.Var(&self.ExcludePaths, "exclude-paths", "Comma separated path segments not to follow")
+}
+
+func (self *FilterConfig) Validate() error {
+	for _, state := range self.States {
+		if len(state) != 2 {
+			return fmt.Errorf("bad state code: %q", state)
+		}
+	}
+	return nil
+}
+
+// Process Lock
+
+type LockConfig struct {
+	Type string `json:"type"`
+}
+
+func (self *LockConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.Type, "lock", self.Type, "How to make sure only one process does the same work: db or file")
+}
+
+func (self *LockConfig) Validate() error {
+	if self.Type != "db" && self.Type != "file" {
+		return fmt.Errorf("unknown lock type: %q", self.Type)
+	}
+	return nil
+}
+
+// Crawler
+
+type CrawlConfig struct {
+	StartUrl string `json:"start"`
+
+	MaxPages       int      `json:"maxPages"`
+	MaxNewListings int      `json:"maxNewListings"`
+	MaxDuration    Duration `json:"maxDuration"`
+	MaxErrorsInRow int      `json:"maxErrorsInRow"`
+
+	Distributed bool   `json:"distributed"`
+	Name        string `json:"name"`
+}
+
+func (self *CrawlConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.StartUrl, "start", self.StartUrl, "Page to start crawling from")
+	fs.IntVar(&self.MaxPages, "max-pages", self.MaxPages, "Stop after fetching this many pages (0 for no limit)")
+	fs.IntVar(&self.MaxNewListings, "max-new-listings", self.MaxNewListings, "Stop after registering this many new listings (0 for no limit)")
+	fs.Var(&self.MaxDuration, "max-duration", "Stop after crawling for this long, ie: 2h30m (0 for no limit)")
+	fs.IntVar(&self.MaxErrorsInRow, "max-errors", self.MaxErrorsInRow, "Stop after this many fetch errors in a row (0 for no limit)")
+	fs.BoolVar(&self.Distributed, "distributed", self.Distributed, "Share the crawl frontier through the database with other crawler processes")
+	fs.StringVar(&self.Name, "crawl-name", self.Name, "Name of the shared crawl to join when distributed (defaults to the start page host)")
+}
+
+func (self *CrawlConfig) Validate() error {
+	if self.StartUrl == "" {
+		return errors.New("start page is required")
+	}
+	start, err := url.Parse(self.StartUrl)
+	if err != nil || start.Host == "" {
+		return fmt.Errorf("bad start page: %q", self.StartUrl)
+	}
+	if self.MaxPages < 0 || self.MaxNewListings < 0 || self.MaxDuration < 0 || self.MaxErrorsInRow < 0 {
+		return errors.New("crawl limits can't be negative")
+	}
+	return nil
+}
+
+// Update Crawler
+
+type UpdateConfig struct {
+	StaleDays int `json:"staleDays"`
+	Batch     int `json:"batch"`
+}
+
+func (self *UpdateConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&self.StaleDays, "stale-days", self.StaleDays, "Re-check listings not updated in this many days")
+	fs.IntVar(&self.Batch, "batch", self.Batch, "Max number of listings to re-check (0 for no limit)")
+}
+
+func (self *UpdateConfig) Validate() error {
+	if self.StaleDays < 0 {
+		return errors.New("stale days can't be negative")
+	}
+	if self.Batch < 0 {
+		return errors.New("batch can't be negative")
+	}
+	return nil
+}
+
+// Geocoding
+
+type GeocodeConfig struct {
+	// local, google, or empty for none
+	Provider     string `json:"provider"`
+	ZipCentroids string `json:"zipCentroids"`
+	GoogleAPIKey string `json:"googleApiKey"`
+}
+
+func (self *GeocodeConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.Provider, "geocoder", self.Provider, "Where to look up locations: local, google, or empty for none")
+	fs.StringVar(&self.ZipCentroids, "zip-centroids", self.ZipCentroids, "Zip code centroid file for the local geocoder, ie: the Census ZCTA gazetteer")
+	fs.StringVar(&self.GoogleAPIKey, "google-api-key", self.GoogleAPIKey, "API key for the google geocoder")
+}
+
+func (self *GeocodeConfig) Validate() error {
+	switch self.Provider {
+	case "":
+	case "local":
+		if self.ZipCentroids == "" {
+			return errors.New("the local geocoder needs a zip centroids file")
+		}
+	case "google":
+		if self.GoogleAPIKey == "" {
+			return errors.New("the google geocoder needs an API key")
+		}
+	default:
+		return fmt.Errorf("unknown geocoder: %q", self.Provider)
+	}
+	return nil
+}
+
+// Saved Search Alerts
+
+type NotifyConfig struct {
+	// log, live, or empty to only save alerts
+	Provider     string `json:"provider"`
+	SmtpAddr     string `json:"smtpAddr"`
+	SmtpFrom     string `json:"smtpFrom"`
+	SmtpUser     string `json:"smtpUser"`
+	SmtpPassword string `json:"smtpPassword"`
+}
+
+func (self *NotifyConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.Provider, "notifier", self.Provider, "How to send saved search alerts: log, live, or empty to only save them")
+	fs.StringVar(&self.SmtpAddr, "smtp-addr", self.SmtpAddr, "SMTP server for alert emails, ie: smtp.example.com:587, empty for no email")
+	fs.StringVar(&self.SmtpFrom, "smtp-from", self.SmtpFrom, "Address alert emails are sent from")
+	fs.StringVar(&self.SmtpUser, "smtp-user", self.SmtpUser, "SMTP login, if the server needs one")
+	fs.StringVar(&self.SmtpPassword, "smtp-password", self.SmtpPassword, "SMTP password")
+}
+
+func (self *NotifyConfig) Validate() error {
+	switch self.Provider {
+	case "", "log":
+	case "live":
+		if self.SmtpAddr != "" && self.SmtpFrom == "" {
+			return errors.New("alert emails need a from address")
+		}
+	default:
+		return fmt.Errorf("unknown notifier: %q", self.Provider)
+	}
+	return nil
+}
+
+// Webhook Dispatcher
+
+type DispatchConfig struct {
+	Interval    Duration `json:"interval"`
+	MaxAttempts int      `json:"maxAttempts"`
+}
+
+func (self *DispatchConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&self.Interval, "interval", "How often to check the outbox for changes to deliver, ie: 10s")
+	fs.IntVar(&self.MaxAttempts, "max-attempts", self.MaxAttempts, "Give up delivering to a webhook after this many tries")
+}
+
+func (self *DispatchConfig) Validate() error {
+	if self.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if self.MaxAttempts < 1 {
+		return errors.New("max attempts must be at least 1")
+	}
+	return nil
+}
+
+// RPC Server
+
+type ServerConfig struct {
+	Listen string `json:"listen"`
+	// Checks the user tokens, see home.UserToken
+	UserSecret string `json:"userSecret"`
+}
+
+func (self *ServerConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&self.Listen, "listen", self.Listen, "Address to serve on")
+	fs.StringVar(&self.UserSecret, "user-secret", self.UserSecret, "Secret user tokens are signed with, empty turns off the per user calls")
+}
+
+func (self *ServerConfig) Validate() error {
+	if self.Listen == "" {
+		return errors.New("listen address is required")
+	}
+	return nil
+}
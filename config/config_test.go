@@ -0,0 +1,73 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"db": {"host": "file-host", "name": "file-name"},
+		"fetch": {"workers": 5, "wait": "5s"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(EnvPrefix+"DB_NAME", "env-name")
+	os.Setenv(EnvPrefix+"WORKERS", "7")
+	defer os.Unsetenv(EnvPrefix + "DB_NAME")
+	defer os.Unsetenv(EnvPrefix + "WORKERS")
+
+	cfg := Defaults()
+	err = Load("test", []string{"-config", path, "-workers", "9"}, cfg, &cfg.DB, &cfg.Fetch)
+	if err != nil {
+		t.Fatalf("Load() == %v", err)
+	}
+
+	if cfg.DB.Host != "file-host" {
+		t.Errorf("db host == %q, expected value from file", cfg.DB.Host)
+	}
+	if cfg.DB.Name != "env-name" {
+		t.Errorf("db name == %q, expected env to override file", cfg.DB.Name)
+	}
+	if cfg.Fetch.Workers != 9 {
+		t.Errorf("workers == %d, expected flag to override env", cfg.Fetch.Workers)
+	}
+	if cfg.Fetch.Wait.Duration() != 5*time.Second {
+		t.Errorf("wait == %v, expected value from file", cfg.Fetch.Wait)
+	}
+	if cfg.Fetch.UserAgent != DefaultUserAgent {
+		t.Errorf("user agent == %q, expected default", cfg.Fetch.UserAgent)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+
+	type inOut struct {
+		args      []string
+		expectErr bool
+	}
+
+	cases := []inOut{
+		{[]string{"-db-name", "homes"}, false},
+		{[]string{}, true},
+		{[]string{"-db-name", "homes", "-workers", "0"}, true},
+		{[]string{"-db-name", "homes", "-wait", "soon"}, true},
+		{[]string{"-db-name", "homes", "-states", "co,colorado"}, true},
+		{[]string{"-db-name", "homes", "localhost"}, true},
+	}
+
+	for _, c := range cases {
+		cfg := Defaults()
+		err := Load("test", c.args, cfg, &cfg.DB, &cfg.Fetch, &cfg.Filters)
+		if (err != nil) != c.expectErr {
+			t.Errorf("Load(%q) == %v, expected error: %v", c.args, err, c.expectErr)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that reads as "2s", "1h30m" etc, from
+// both flags and the config file.
+type Duration time.Duration
+
+func (self Duration) Duration() time.Duration {
+	return time.Duration(self)
+}
+
+func (self Duration) String() string {
+	return time.Duration(self).String()
+}
+
+func (self *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*self = Duration(parsed)
+	return nil
+}
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.String())
+}
+
+func (self *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return self.Set(value)
+}
+
+// StringList is a comma separated list on the command line, and a
+// regular array in the config file.
+type StringList []string
+
+func (self StringList) String() string {
+	return strings.Join(self, ",")
+}
+
+func (self *StringList) Set(value string) error {
+	list := StringList{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	*self = list
+	return nil
+}
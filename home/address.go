@@ -0,0 +1,335 @@
+package home
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// NormalizeAddress puts a scraped address into a standard form, USPS
+// style abbreviations for the street, the unit split out, a two letter
+// state and a 5 digit zip. The address as scraped is kept in Original.
+func NormalizeAddress(raw RawAddress) ListingAddress {
+	address := ListingAddress{
+		City:     normalizeCity(raw.City),
+		State:    normalizeState(raw.State),
+		Original: raw,
+	}
+	address.Zip, address.Zip4 = splitZip(raw.Zip)
+
+	number, name, unit := parseStreet(raw.Street)
+	address.Number = number
+	address.StreetName = name
+	address.Unit = unit
+	address.Street = strings.TrimSpace(number + " " + name)
+
+	return address
+}
+
+// Key is the same for two addresses that normalize to the same place,
+// regardless of how the unit was written, or if the zip had a +4.
+// Empty if there isn't enough of the address to tell.
+func (self ListingAddress) Key() string {
+	if self.Number == "" || self.StreetName == "" || self.Zip == "" {
+		return ""
+	}
+	parts := []string{self.Number, self.StreetName}
+	if id := unitId(self.Unit); id != "" {
+		parts = append(parts, "#"+id)
+	}
+	parts = append(parts, self.Zip)
+	return strings.ToUpper(strings.Join(parts, " "))
+}
+
+// StreetKey groups everything on the same street in the same zip
+func (self ListingAddress) StreetKey() string {
+	if self.StreetName == "" || self.Zip == "" {
+		return ""
+	}
+	return strings.ToUpper(self.StreetName + " " + self.Zip)
+}
+
+// Street
+
+var streetPunctuation = strings.NewReplacer(",", " ", ".", " ", ";", " ")
+
+// parseStreet splits the street line into the house number, the
+// normalized street name, and the unit, ie:
+//
+//	"123 north Main Street, Apt. 4b" -> "123", "N Main St", "Apt 4B"
+func parseStreet(street string) (number, name, unit string) {
+	words := strings.Fields(streetPunctuation.Replace(street))
+
+	// Everything from a unit designator on is the unit, so long as
+	// there's something before it to be the street
+	first := 1
+	if len(words) > 0 && startsWithDigit(words[0]) {
+		first = 2
+	}
+	for i := first; i < len(words); i++ {
+		upper := strings.ToUpper(words[i])
+		if strings.HasPrefix(upper, "#") {
+			unit = formatUnit("", append([]string{strings.TrimPrefix(upper, "#")}, words[i+1:]...))
+			words = words[:i]
+			break
+		}
+		if designator, found := unitDesignators[upper]; found && i+1 < len(words) {
+			unit = formatUnit(designator, words[i+1:])
+			words = words[:i]
+			break
+		}
+		if designator, found := unitDesignators[upper]; found && unitsWithoutNumbers[designator] {
+			unit = designator
+			words = words[:i]
+			break
+		}
+	}
+
+	if len(words) > 0 && startsWithDigit(words[0]) {
+		number = strings.ToUpper(words[0])
+		words = words[1:]
+	}
+
+	// Directions before and after, and the suffix, only when there's
+	// still a name left in between, so "North St" and "Park Ave" stay
+	// as they are
+	var pre, suffix, post string
+	if len(words) > 2 {
+		if abbr, found := directionals[strings.ToUpper(words[0])]; found {
+			pre = abbr
+			words = words[1:]
+		}
+	}
+	if len(words) > 2 {
+		if abbr, found := directionals[strings.ToUpper(words[len(words)-1])]; found {
+			post = abbr
+			words = words[:len(words)-1]
+		}
+	}
+	if len(words) > 1 {
+		if abbr, found := streetSuffixes[strings.ToUpper(words[len(words)-1])]; found {
+			suffix = abbr
+			words = words[:len(words)-1]
+		}
+	}
+
+	parts := []string{}
+	if pre != "" {
+		parts = append(parts, pre)
+	}
+	for _, word := range words {
+		if abbr, found := directionals[strings.ToUpper(word)]; found && len(word) <= 2 {
+			parts = append(parts, abbr)
+			continue
+		}
+		parts = append(parts, titleWord(word))
+	}
+	for _, part := range []string{suffix, post} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return number, strings.Join(parts, " "), unit
+}
+
+func formatUnit(designator string, rest []string) string {
+	id := strings.ToUpper(strings.TrimPrefix(strings.Join(rest, ""), "#"))
+	if designator == "" {
+		return "#" + id
+	}
+	return designator + " " + id
+}
+
+// unitId is just the identifier part of the unit, ie: "Apt 4B" -> "4B"
+func unitId(unit string) string {
+	unit = strings.TrimPrefix(unit, "#")
+	if space := strings.LastIndex(unit, " "); space != -1 {
+		unit = unit[space+1:]
+	}
+	return strings.ToUpper(unit)
+}
+
+func startsWithDigit(word string) bool {
+	return word != "" && unicode.IsDigit(rune(word[0]))
+}
+
+// titleWord capitalizes words that came in all one case, mixed case
+// ones like "McKinney" are left alone
+func titleWord(word string) string {
+	if word != strings.ToUpper(word) && word != strings.ToLower(word) {
+		return word
+	}
+	if startsWithDigit(word) {
+		// Ordinals, ie: 1st, 42nd
+		return strings.ToLower(word)
+	}
+	lower := []rune(strings.ToLower(word))
+	lower[0] = unicode.ToUpper(lower[0])
+	return string(lower)
+}
+
+// City, State, Zip
+
+func normalizeCity(city string) string {
+	words := strings.Fields(streetPunctuation.Replace(city))
+	for i, word := range words {
+		words[i] = titleWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func normalizeState(state string) string {
+	state = strings.ToUpper(strings.Join(strings.Fields(streetPunctuation.Replace(state)), " "))
+	if code, found := stateCodes[state]; found {
+		return code
+	}
+	return state
+}
+
+var zipPlus4Pattern = regexp.MustCompile(`^([0-9]{5})-?([0-9]{4})$`)
+
+// splitZip splits off the +4, if there is one, and puts back leading
+// zeros a spreadsheet may have eaten
+func splitZip(zip string) (string, string) {
+	zip = strings.TrimSpace(zip)
+	if match := zipPlus4Pattern.FindStringSubmatch(zip); match != nil {
+		return match[1], match[2]
+	}
+	return normalizeZip(zip), ""
+}
+
+// USPS abbreviations, Publication 28
+
+var directionals = map[string]string{
+	"N": "N", "NORTH": "N",
+	"S": "S", "SOUTH": "S",
+	"E": "E", "EAST": "E",
+	"W": "W", "WEST": "W",
+	"NE": "NE", "NORTHEAST": "NE",
+	"NW": "NW", "NORTHWEST": "NW",
+	"SE": "SE", "SOUTHEAST": "SE",
+	"SW": "SW", "SOUTHWEST": "SW",
+}
+
+var unitDesignators = map[string]string{
+	"APT": "Apt", "APARTMENT": "Apt",
+	"UNIT": "Unit",
+	"STE":  "Ste", "SUITE": "Ste",
+	"BLDG": "Bldg", "BUILDING": "Bldg",
+	"FL": "Fl", "FLOOR": "Fl",
+	"RM": "Rm", "ROOM": "Rm",
+	"LOT": "Lot",
+	"SPC": "Spc", "SPACE": "Spc",
+	"TRLR": "Trlr", "TRAILER": "Trlr",
+	"DEPT": "Dept",
+	"PH":   "Ph", "PENTHOUSE": "Ph",
+	"BSMT": "Bsmt", "BASEMENT": "Bsmt",
+	"FRNT": "Frnt", "FRONT": "Frnt",
+	"REAR": "Rear",
+	"UPPR": "Uppr", "UPPER": "Uppr",
+	"LOWR": "Lowr", "LOWER": "Lowr",
+}
+
+// Designators that can stand on their own, ie: "12 Oak St Rear"
+var unitsWithoutNumbers = map[string]bool{
+	"Ph": true, "Bsmt": true, "Frnt": true, "Rear": true, "Uppr": true, "Lowr": true,
+}
+
+var streetSuffixes = map[string]string{
+	"ALLEY": "Aly", "ALY": "Aly",
+	"AVENUE": "Ave", "AVE": "Ave", "AV": "Ave", "AVEN": "Ave",
+	"BEND": "Bnd", "BND": "Bnd",
+	"BLUFF": "Blf", "BLF": "Blf",
+	"BOULEVARD": "Blvd", "BLVD": "Blvd", "BOUL": "Blvd",
+	"BRANCH": "Br", "BR": "Br",
+	"BRIDGE": "Brg", "BRG": "Brg",
+	"BYPASS": "Byp", "BYP": "Byp",
+	"CANYON": "Cyn", "CYN": "Cyn",
+	"CAUSEWAY": "Cswy", "CSWY": "Cswy",
+	"CENTER": "Ctr", "CTR": "Ctr",
+	"CIRCLE": "Cir", "CIR": "Cir", "CIRC": "Cir",
+	"CLIFF": "Clf", "CLF": "Clf",
+	"COMMON": "Cmn", "CMN": "Cmn",
+	"CORNER": "Cor", "COR": "Cor",
+	"COURSE": "Crse", "CRSE": "Crse",
+	"COURT": "Ct", "CT": "Ct", "CRT": "Ct",
+	"COVE": "Cv", "CV": "Cv",
+	"CREEK": "Crk", "CRK": "Crk",
+	"CRESCENT": "Cres", "CRES": "Cres",
+	"CROSSING": "Xing", "XING": "Xing",
+	"DRIVE": "Dr", "DR": "Dr", "DRV": "Dr",
+	"ESTATE": "Est", "EST": "Est",
+	"ESTATES": "Ests", "ESTS": "Ests",
+	"EXPRESSWAY": "Expy", "EXPY": "Expy",
+	"EXTENSION": "Ext", "EXT": "Ext",
+	"FREEWAY": "Fwy", "FWY": "Fwy",
+	"GARDEN": "Gdn", "GDN": "Gdn",
+	"GARDENS": "Gdns", "GDNS": "Gdns",
+	"GLEN": "Gln", "GLN": "Gln",
+	"GREEN": "Grn", "GRN": "Grn",
+	"GROVE": "Grv", "GRV": "Grv",
+	"HARBOR": "Hbr", "HBR": "Hbr",
+	"HEIGHTS": "Hts", "HTS": "Hts",
+	"HIGHWAY": "Hwy", "HWY": "Hwy",
+	"HILL": "Hl", "HL": "Hl",
+	"HILLS": "Hls", "HLS": "Hls",
+	"HOLLOW": "Holw", "HOLW": "Holw",
+	"ISLAND": "Is", "IS": "Is",
+	"JUNCTION": "Jct", "JCT": "Jct",
+	"KNOLL": "Knl", "KNL": "Knl",
+	"LAKE": "Lk", "LK": "Lk",
+	"LANDING": "Lndg", "LNDG": "Lndg",
+	"LANE": "Ln", "LN": "Ln",
+	"LOOP":  "Loop",
+	"MANOR": "Mnr", "MNR": "Mnr",
+	"MEADOW": "Mdw", "MDW": "Mdw",
+	"MEADOWS": "Mdws", "MDWS": "Mdws",
+	"MILL": "Ml", "ML": "Ml",
+	"MOUNTAIN": "Mtn", "MTN": "Mtn",
+	"PARKWAY": "Pkwy", "PKWY": "Pkwy", "PKY": "Pkwy",
+	"PASS":  "Pass",
+	"PATH":  "Path",
+	"PIKE":  "Pike",
+	"PLACE": "Pl", "PL": "Pl",
+	"PLAZA": "Plz", "PLZ": "Plz",
+	"POINT": "Pt", "PT": "Pt",
+	"PRAIRIE": "Pr", "PR": "Pr",
+	"RANCH": "Rnch", "RNCH": "Rnch",
+	"RIDGE": "Rdg", "RDG": "Rdg",
+	"RIVER": "Riv", "RIV": "Riv",
+	"ROAD": "Rd", "RD": "Rd",
+	"ROUTE": "Rte", "RTE": "Rte",
+	"ROW":    "Row",
+	"RUN":    "Run",
+	"SQUARE": "Sq", "SQ": "Sq",
+	"STATION": "Sta", "STA": "Sta",
+	"STREET": "St", "ST": "St", "STR": "St",
+	"SUMMIT": "Smt", "SMT": "Smt",
+	"TERRACE": "Ter", "TER": "Ter", "TERR": "Ter",
+	"TRACE": "Trce", "TRCE": "Trce",
+	"TRAIL": "Trl", "TRL": "Trl",
+	"TURNPIKE": "Tpke", "TPKE": "Tpke",
+	"VALLEY": "Vly", "VLY": "Vly",
+	"VIEW": "Vw", "VW": "Vw",
+	"VILLAGE": "Vlg", "VLG": "Vlg",
+	"VISTA": "Vis", "VIS": "Vis",
+	"WALK": "Walk",
+	"WAY":  "Way", "WY": "Way",
+}
+
+var stateCodes = map[string]string{
+	"ALABAMA": "AL", "ALASKA": "AK", "ARIZONA": "AZ", "ARKANSAS": "AR",
+	"CALIFORNIA": "CA", "COLORADO": "CO", "CONNECTICUT": "CT", "DELAWARE": "DE",
+	"DISTRICT OF COLUMBIA": "DC", "FLORIDA": "FL", "GEORGIA": "GA", "HAWAII": "HI",
+	"IDAHO": "ID", "ILLINOIS": "IL", "INDIANA": "IN", "IOWA": "IA",
+	"KANSAS": "KS", "KENTUCKY": "KY", "LOUISIANA": "LA", "MAINE": "ME",
+	"MARYLAND": "MD", "MASSACHUSETTS": "MA", "MICHIGAN": "MI", "MINNESOTA": "MN",
+	"MISSISSIPPI": "MS", "MISSOURI": "MO", "MONTANA": "MT", "NEBRASKA": "NE",
+	"NEVADA": "NV", "NEW HAMPSHIRE": "NH", "NEW JERSEY": "NJ", "NEW MEXICO": "NM",
+	"NEW YORK": "NY", "NORTH CAROLINA": "NC", "NORTH DAKOTA": "ND", "OHIO": "OH",
+	"OKLAHOMA": "OK", "OREGON": "OR", "PENNSYLVANIA": "PA", "PUERTO RICO": "PR",
+	"RHODE ISLAND": "RI", "SOUTH CAROLINA": "SC", "SOUTH DAKOTA": "SD", "TENNESSEE": "TN",
+	"TEXAS": "TX", "UTAH": "UT", "VERMONT": "VT", "VIRGINIA": "VA",
+	"WASHINGTON": "WA", "WEST VIRGINIA": "WV", "WISCONSIN": "WI", "WYOMING": "WY",
+}
@@ -0,0 +1,65 @@
+package home
+
+import (
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+
+	type inOut struct {
+		in  RawAddress
+		out ListingAddress
+	}
+
+	cases := []inOut{
+		{RawAddress{"123 north Main Street, Apt. 4b", "  denver ", "co", "80203-1234"},
+			ListingAddress{Street: "123 N Main St", Unit: "Apt 4B", City: "Denver", State: "CO", Zip: "80203", Zip4: "1234", Number: "123", StreetName: "N Main St"}},
+		{RawAddress{"4500 E. COLFAX AVENUE #210", "Denver", "Colorado", "802201234"},
+			ListingAddress{Street: "4500 E Colfax Ave", Unit: "#210", City: "Denver", State: "CO", Zip: "80220", Zip4: "1234", Number: "4500", StreetName: "E Colfax Ave"}},
+		{RawAddress{"77 Ocean Blvd Southwest Suite 3", "Palm Beach", "FL", "33480"},
+			ListingAddress{Street: "77 Ocean Blvd SW", Unit: "Ste 3", City: "Palm Beach", State: "FL", Zip: "33480", Number: "77", StreetName: "Ocean Blvd SW"}},
+		// Short names keep their direction and suffix words as is
+		{RawAddress{"9 North St", "Salem", "ma", "1970"},
+			ListingAddress{Street: "9 North St", City: "Salem", State: "MA", Zip: "01970", Number: "9", StreetName: "North St"}},
+		{RawAddress{"12 W 42nd St Rear", "new york", "new york", "10036"},
+			ListingAddress{Street: "12 W 42nd St", Unit: "Rear", City: "New York", State: "NY", Zip: "10036", Number: "12", StreetName: "W 42nd St"}},
+		{RawAddress{"Lot 5 McKinney Ranch Road", "", "", ""},
+			ListingAddress{Street: "Lot 5 McKinney Ranch Rd", StreetName: "Lot 5 McKinney Ranch Rd"}},
+	}
+
+	for _, c := range cases {
+		c.out.Original = c.in
+		got := NormalizeAddress(c.in)
+		if got != c.out {
+			t.Errorf("NormalizeAddress(%+v) ==\n  %+v\nexpected\n  %+v", c.in, got, c.out)
+		}
+	}
+}
+
+func TestListingAddressKey(t *testing.T) {
+
+	type inOut struct {
+		a, b  RawAddress
+		equal bool
+	}
+
+	cases := []inOut{
+		{RawAddress{"123 North Main Street Apt 4", "", "", "80203"}, RawAddress{"123 N. Main St. #4", "", "", "80203-1234"}, true},
+		{RawAddress{"123 N Main St Unit 4", "", "", "80203"}, RawAddress{"123 N Main St Unit 5", "", "", "80203"}, false},
+		{RawAddress{"123 N Main St", "", "", "80203"}, RawAddress{"125 N Main St", "", "", "80203"}, false},
+	}
+
+	for _, c := range cases {
+		a, b := NormalizeAddress(c.a), NormalizeAddress(c.b)
+		if (a.Key() == b.Key()) != c.equal {
+			t.Errorf("Key() %q vs %q, expected equal: %v", a.Key(), b.Key(), c.equal)
+		}
+		if a.StreetKey() != b.StreetKey() {
+			t.Errorf("StreetKey() %q vs %q, expected the same street", a.StreetKey(), b.StreetKey())
+		}
+	}
+
+	if key := NormalizeAddress(RawAddress{Street: "Main St", Zip: "80203"}).Key(); key != "" {
+		t.Errorf("Key() == %q for an address without a number, expected empty", key)
+	}
+}
@@ -0,0 +1,162 @@
+package home
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Size of a cluster on screen, as a share of a 256 pixel map tile
+	ClusterCellPixels = 64
+	// From this zoom on it's individual listings, not clusters
+	ClusterListingsZoom = 16
+	MaxZoom             = 22
+	// Web mercator stops here
+	maxMercatorLatitude = 85.05112878
+)
+
+// ListingCluster is the listings in one cell of the map grid
+type ListingCluster struct {
+	Count int
+	// Average position of the listings in it
+	Center      GeoJson
+	PriceMin    uint
+	PriceMedian uint
+	PriceMax    uint
+	// Set when the cluster is just one listing
+	ListingId bson.ObjectId
+}
+
+// CheckZoom returns a *QueryError if the zoom isn't a map zoom level
+func CheckZoom(zoom int) error {
+	if zoom < 0 || zoom > MaxZoom {
+		return &QueryError{Fields: []QueryFieldError{
+			{Field: "zoom", Message: "zoom must be between 0 and 22", Values: []string{strconv.Itoa(zoom)}},
+		}}
+	}
+	return nil
+}
+
+// ClusterListings groups the listings matching the query into a grid
+// over the map at the zoom level, the grouping is done by the database.
+// Cells are square on screen around the latitude, the middle of the map
+// view, use it with a WithinBox filter for the view. A *QueryError is
+// returned for bad filters or zoom level.
+func (self *DB) ClusterListings(query ListingsQuery, zoom int, latitude float64) ([]ListingCluster, error) {
+
+	if err := CheckZoom(zoom); err != nil {
+		return nil, err
+	}
+	if err := query.Err(); err != nil {
+		return nil, err
+	}
+
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	var cells []clusterCell
+	err := collection.Pipe(clusterPipeline(query.buildMatchQuery(), zoom, latitude)).All(&cells)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]ListingCluster, len(cells))
+	for i, cell := range cells {
+		clusters[i] = cell.cluster()
+	}
+	return clusters, nil
+}
+
+// clusterCellSize is the width and height of a grid cell in degrees, at
+// the zoom level and latitude. Going north, a degree of latitude takes
+// up more of the screen in web mercator.
+func clusterCellSize(zoom int, latitude float64) (float64, float64) {
+	cellsPerSide := math.Exp2(float64(zoom)) * 256 / ClusterCellPixels
+	width := 360 / cellsPerSide
+
+	latitude = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, latitude))
+	return width, width * math.Cos(latitude*math.Pi/180)
+}
+
+// clusterPipeline groups the matching listings with a location by grid
+// cell, biggest first, then north to south and west to east
+func clusterPipeline(match bson.M, zoom int, latitude float64) []bson.M {
+	width, height := clusterCellSize(zoom, latitude)
+
+	lng := bson.M{"$arrayElemAt": []interface{}{"$properties.geoLocation.coordinates", 0}}
+	lat := bson.M{"$arrayElemAt": []interface{}{"$properties.geoLocation.coordinates", 1}}
+	// No price is no price, not free, $min and friends skip nulls
+	price := bson.M{"$cond": []interface{}{
+		bson.M{"$gt": []interface{}{"$properties.currentPrice", 0}}, "$properties.currentPrice", nil,
+	}}
+
+	return []bson.M{
+		{"$match": match},
+		{"$match": bson.M{
+			"properties.geoLocation.coordinates.1": bson.M{"$exists": true},
+			"properties.geoLocation.coordinates":   bson.M{"$ne": []float64{0, 0}},
+		}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"x": bson.M{"$floor": bson.M{"$divide": []interface{}{bson.M{"$add": []interface{}{lng, 180}}, width}}},
+				"y": bson.M{"$floor": bson.M{"$divide": []interface{}{bson.M{"$add": []interface{}{lat, 90}}, height}}},
+			},
+			"count":    bson.M{"$sum": 1},
+			"lng":      bson.M{"$avg": lng},
+			"lat":      bson.M{"$avg": lat},
+			"priceMin": bson.M{"$min": price},
+			// Mongo has no median, the prices come back for medianPrice
+			"prices":    bson.M{"$push": "$properties.currentPrice"},
+			"priceMax":  bson.M{"$max": price},
+			"listingId": bson.M{"$first": "$_id"},
+		}},
+		{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id.y", Value: -1}, {Name: "_id.x", Value: 1}}},
+	}
+}
+
+// clusterCell is a group from the cluster pipeline
+type clusterCell struct {
+	Count     int           `bson:"count"`
+	Lng       float64       `bson:"lng"`
+	Lat       float64       `bson:"lat"`
+	PriceMin  float64       `bson:"priceMin"`
+	Prices    []uint        `bson:"prices"`
+	PriceMax  float64       `bson:"priceMax"`
+	ListingId bson.ObjectId `bson:"listingId"`
+}
+
+func (self clusterCell) cluster() ListingCluster {
+	cluster := ListingCluster{
+		Count:    self.Count,
+		Center:   NewGeoJsonPoint(self.Lng, self.Lat),
+		PriceMin: uint(self.PriceMin),
+		PriceMax: uint(self.PriceMax),
+	}
+
+	prices := make([]uint, 0, len(self.Prices))
+	for _, price := range self.Prices {
+		if price != 0 {
+			prices = append(prices, price)
+		}
+	}
+	if len(prices) > 0 {
+		sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+		cluster.PriceMedian = medianPrice(prices)
+	}
+	if self.Count == 1 {
+		cluster.ListingId = self.ListingId
+	}
+	return cluster
+}
+
+// medianPrice of sorted prices
+func medianPrice(prices []uint) uint {
+	middle := len(prices) / 2
+	if len(prices)%2 == 1 {
+		return prices[middle]
+	}
+	return (prices[middle-1] + prices[middle]) / 2
+}
@@ -0,0 +1,70 @@
+package home
+
+import (
+	"math"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClusterCellSize(t *testing.T) {
+
+	type inOut struct {
+		zoom     int
+		latitude float64
+		width    float64
+		height   float64
+	}
+
+	cases := []inOut{
+		// Whole world is 4 cells across
+		{0, 0, 90, 90},
+		{10, 0, 360.0 / 4096, 360.0 / 4096},
+		// Half as tall at 60 north, or south
+		{0, 60, 90, 45},
+		{0, -60, 90, 45},
+		// Past where the map stops it's as tall as at the edge
+		{0, 89, 90, 90 * math.Cos(maxMercatorLatitude*math.Pi/180)},
+	}
+
+	for _, c := range cases {
+		width, height := clusterCellSize(c.zoom, c.latitude)
+		if !closeTo(width, c.width) || !closeTo(height, c.height) {
+			t.Errorf("clusterCellSize(%d, %v) == %v, %v, expected %v, %v", c.zoom, c.latitude, width, height, c.width, c.height)
+		}
+	}
+}
+
+func TestClusterCell(t *testing.T) {
+
+	id := bson.NewObjectId()
+
+	type inOut struct {
+		cell   clusterCell
+		expect ListingCluster
+	}
+
+	cases := []inOut{
+		// Three around downtown Denver
+		{clusterCell{Count: 3, Lng: -104.989, Lat: 39.74, PriceMin: 300000, PriceMax: 500000, Prices: []uint{500000, 300000, 350000}, ListingId: id},
+			ListingCluster{Count: 3, Center: NewGeoJsonPoint(-104.989, 39.74), PriceMin: 300000, PriceMedian: 350000, PriceMax: 500000}},
+		// Unpriced ones aren't free, the median's between the other two
+		{clusterCell{Count: 3, Lng: -104.989, Lat: 39.74, PriceMin: 300000, PriceMax: 500000, Prices: []uint{500000, 0, 300000}},
+			ListingCluster{Count: 3, Center: NewGeoJsonPoint(-104.989, 39.74), PriceMin: 300000, PriceMedian: 400000, PriceMax: 500000}},
+		// One on its own keeps its id
+		{clusterCell{Count: 1, Lng: -105.27, Lat: 40.015, PriceMin: 900000, PriceMax: 900000, Prices: []uint{900000}, ListingId: id},
+			ListingCluster{Count: 1, Center: NewGeoJsonPoint(-105.27, 40.015), PriceMin: 900000, PriceMedian: 900000, PriceMax: 900000, ListingId: id}},
+		// Without prices they stay 0
+		{clusterCell{Count: 2, Lng: -104.9, Lat: 39.7},
+			ListingCluster{Count: 2, Center: NewGeoJsonPoint(-104.9, 39.7)}},
+	}
+
+	for _, c := range cases {
+		got := c.cell.cluster()
+		if got.Count != c.expect.Count || got.PriceMin != c.expect.PriceMin || got.PriceMedian != c.expect.PriceMedian ||
+			got.PriceMax != c.expect.PriceMax || got.ListingId != c.expect.ListingId ||
+			got.Center.Coordinates[0] != c.expect.Center.Coordinates[0] || got.Center.Coordinates[1] != c.expect.Center.Coordinates[1] {
+			t.Errorf("cluster() == %+v, expected %+v", got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package home
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Listing sort keys
+const (
+	SortNewest    = "newest"
+	SortUpdated   = "updated"
+	SortPriceLow  = "price"
+	SortPriceHigh = "-price"
+	SortDistance  = "distance"
+)
+
+type listingSort struct {
+	field string
+	desc  bool
+	// Some listings don't have the field, mongo sorts them before any
+	// value, ie: unpriced listings
+	optional bool
+}
+
+var listingSorts = map[string]listingSort{
+	SortNewest:    {"_id", true, false},
+	SortUpdated:   {"updatedDate", true, false},
+	SortPriceLow:  {"properties.currentPrice", false, true},
+	SortPriceHigh: {"properties.currentPrice", true, true},
+	// Ordered by $nearSphere itself
+	SortDistance: {"", false, false},
+}
+
+func (self listingSort) mongoSort() []string {
+	if self.field == "" {
+		return nil
+	}
+	direction := ""
+	if self.desc {
+		direction = "-"
+	}
+	if self.field == "_id" {
+		return []string{direction + "_id"}
+	}
+	// Ties are broken by id, so paging is stable
+	return []string{direction + self.field, direction + "_id"}
+}
+
+// listingCursor marks where the last page left off, it's handed to
+// clients as an opaque string.
+type listingCursor struct {
+	Sort   string        `bson:"s"`
+	Value  interface{}   `bson:"v,omitempty"`
+	Id     bson.ObjectId `bson:"i,omitempty"`
+	Offset int           `bson:"o,omitempty"`
+}
+
+func (self listingCursor) encode() string {
+	data, err := bson.Marshal(self)
+	if err != nil {
+		// Only simple types go in here, so this shouldn't happen
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListingCursor(encoded string) (listingCursor, error) {
+	cursor := listingCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = bson.Unmarshal(data, &cursor)
+	if err != nil {
+		return cursor, err
+	}
+	if _, found := listingSorts[cursor.Sort]; !found {
+		return cursor, fmt.Errorf("unknown sort: %q", cursor.Sort)
+	}
+	return cursor, nil
+}
+
+// mongoQuery returns the condition for everything past the cursor,
+// nil if the sort pages by offset instead.
+func (self listingCursor) mongoQuery() bson.M {
+	sort := listingSorts[self.Sort]
+	if sort.field == "" {
+		return nil
+	}
+
+	op := "$gt"
+	if sort.desc {
+		op = "$lt"
+	}
+
+	if sort.field == "_id" {
+		return bson.M{"_id": bson.M{op: self.Id}}
+	}
+
+	// Left off in the ones without the field, first going up, last
+	// going down
+	if sort.optional && self.Value == nil {
+		missing := bson.M{sort.field: nil, "_id": bson.M{op: self.Id}}
+		if sort.desc {
+			return missing
+		}
+		return bson.M{"$or": []bson.M{missing, {sort.field: bson.M{"$ne": nil}}}}
+	}
+
+	conditions := []bson.M{
+		{sort.field: bson.M{op: self.Value}},
+		{sort.field: self.Value, "_id": bson.M{op: self.Id}},
+	}
+	if sort.optional && sort.desc {
+		conditions = append(conditions, bson.M{sort.field: nil})
+	}
+	return bson.M{"$or": conditions}
+}
+
+// addTo merges the cursor condition into the top level of the query,
+// rather than an $and, since $nearSphere has to stay top level.
+// Returns false if the sort pages by offset instead.
+func (self listingCursor) addTo(query bson.M) bool {
+	condition := self.mongoQuery()
+	if condition == nil {
+		return false
+	}
+	for key, value := range condition {
+		existing, isMap := query[key].(bson.M)
+		operators, hasOperators := value.(bson.M)
+		if isMap && hasOperators {
+			for op, operand := range operators {
+				existing[op] = operand
+			}
+			continue
+		}
+		if _, taken := query[key]; taken {
+			query["$and"] = append(andConditions(query), bson.M{key: value})
+			continue
+		}
+		query[key] = value
+	}
+	return true
+}
+
+func andConditions(query bson.M) []bson.M {
+	conditions, _ := query["$and"].([]bson.M)
+	return conditions
+}
+
+// SortBy orders the listings by one of the sort keys. Sorting by
+// distance needs one of the location filters.
+func (self *ListingsQuery) SortBy(key string) {
+	if _, found := listingSorts[key]; !found {
+		self.addInvalid("sort", "unknown sort", key)
+		return
+	}
+	self.sortFl = true
+	self.sortKey = key
+}
+
+// After continues from a cursor handed back by NextCursor
+func (self *ListingsQuery) After(cursor string) {
+	decoded, err := decodeListingCursor(cursor)
+	if err != nil {
+		self.addInvalid("cursor", "invalid cursor", cursor)
+		return
+	}
+	self.cursorFl = true
+	self.cursor = decoded
+}
+
+// currentSort is the sort asked for, or the default for the query,
+// closest first for location queries, otherwise newest first.
+func (self *ListingsQuery) currentSort() string {
+	if self.sortFl {
+		return self.sortKey
+	}
+	if self.locationFl {
+		return SortDistance
+	}
+	return SortNewest
+}
+
+// NextCursor returns the cursor to get the page after the given
+// listings, or an empty string if there's nothing after them.
+func (self *ListingsQuery) NextCursor(listings []Listing) string {
+	if !self.limitFl || len(listings) < int(self.limit) || len(listings) == 0 {
+		return ""
+	}
+
+	last := listings[len(listings)-1]
+	cursor := listingCursor{Sort: self.currentSort(), Id: last.Id}
+
+	switch cursor.Sort {
+	case SortUpdated:
+		cursor.Value = last.UpdatedDate.UTC().Truncate(time.Millisecond)
+	case SortPriceLow, SortPriceHigh:
+		// Unpriced is no value, not 0
+		if last.Properties.CurrentPrice != 0 {
+			cursor.Value = int64(last.Properties.CurrentPrice)
+		}
+	case SortDistance:
+		cursor.Offset = len(listings)
+		if self.cursorFl {
+			cursor.Offset += self.cursor.Offset
+		}
+	}
+
+	return cursor.encode()
+}
+
+// sortErrors checks the sort and cursor make sense together with
+// the rest of the query.
+func (self *ListingsQuery) sortErrors() []QueryFieldError {
+	var invalid []QueryFieldError
+	sort := self.currentSort()
+	if sort == SortDistance && !self.locationFl {
+		invalid = append(invalid, QueryFieldError{Field: "sort", Message: "sorting by distance needs a location filter", Values: []string{sort}})
+	}
+	if self.cursorFl && self.cursor.Sort != sort {
+		invalid = append(invalid, QueryFieldError{Field: "cursor", Message: "cursor is for a different sort", Values: []string{self.cursor.Sort}})
+	}
+	return invalid
+}
@@ -3,12 +3,13 @@ package home
 import (
 	"errors"
 	"fmt"
-	"github.com/nf/geocode"
 	//"github.com/tdewolff/minify"
 	//"github.com/tdewolff/minify/html"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,8 +18,12 @@ const (
 	ListingMarkeupCollectionName = "ListingsMarkup"
 	PageHistoryCollectionPrefix  = "PageHistory"
 	PageQueueCollectionPrefix    = "PageQueue"
+	FrontierCollectionName       = "CrawlFrontier"
+	HistoryCollectionName        = "ListingHistory"
 )
 
+var ErrListingNotFound = errors.New("Listing not found")
+
 func NewDB(host, name string) *DB {
 	newDb := &DB{
 		Host:        host,
@@ -33,8 +38,11 @@ func NewDB(host, name string) *DB {
 }
 
 type DB struct {
-	Host        string
-	Name        string
+	Host string
+	Name string
+	// Used for location queries, ie: NearZipCode
+	Geocoder Geocoder
+
 	mongoBroker *mongoBroker
 }
 
@@ -47,6 +55,32 @@ func (self *DB) ensureIndexes() {
 	collection.EnsureIndex(mgo.Index{Key: []string{"properties.currentPrice"}})
 	collection.EnsureIndex(mgo.Index{Key: []string{"properties.address.state"}})
 	collection.EnsureIndex(mgo.Index{Key: []string{"properties.address.city"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"properties.address.zip"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"properties.address.streetName", "properties.address.zip"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"propertyId"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"isDuplicate"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"firstSeenDate"}})
+
+	properties := self.mongoBroker.propertyCollection()
+	defer self.mongoBroker.closeCollection(properties)
+	properties.EnsureIndex(mgo.Index{Key: []string{"mls", "zip"}})
+	// What new properties are upserted on, see newPropertyUpsert
+	properties.EnsureIndex(mgo.Index{Key: []string{"addressKey"}, Unique: true, Sparse: true})
+	properties.EnsureIndex(mgo.Index{Key: []string{"mlsKeys"}, Unique: true, Sparse: true})
+	properties.EnsureIndex(mgo.Index{Key: []string{"$2dsphere:geoLocation"}})
+
+	history := self.mongoBroker.historyCollection()
+	defer self.mongoBroker.closeCollection(history)
+	history.EnsureIndex(mgo.Index{Key: []string{"listingId", "date"}})
+
+	markup := self.mongoBroker.listingMarkupCollection()
+	defer self.mongoBroker.closeCollection(markup)
+	markup.EnsureIndex(mgo.Index{Key: []string{"listingId", "createdDate"}})
+
+	self.ensureMarketIndexes()
+	self.ensureSearchIndexes()
+	self.ensureOutboxIndexes()
+	self.ensureUserIndexes()
 }
 
 func (self *DB) Cleanup() {
@@ -71,6 +105,12 @@ func (self *DB) Cleanup() {
 
 }
 
+// Close releases the connections to the database, anything written
+// before this is flushed by then.
+func (self *DB) Close() {
+	self.mongoBroker.sessionPool.Close()
+}
+
 // Page History
 
 func (self *DB) MarkPageVisited(uri string) {
@@ -149,6 +189,48 @@ func (self *DB) DeQueuePage(uri string) {
 	}
 }
 
+// Crawl Frontier
+
+// SaveFrontier persists uris that were found but not crawled yet,
+// so a later crawl can pick up where this one stopped.
+func (self *DB) SaveFrontier(uris []string) error {
+	collection := self.mongoBroker.frontierCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	for _, uri := range uris {
+		_, err := collection.Upsert(bson.M{"url": uri}, bson.M{"url": uri, "savedDate": time.Now()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TakeFrontier returns all saved frontier uris, and removes them
+// from the database.
+func (self *DB) TakeFrontier() ([]string, error) {
+	collection := self.mongoBroker.frontierCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	type document struct {
+		Url string `bson:"url"`
+	}
+	var result []document
+
+	err := collection.Find(nil).All(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, len(result))
+	for i, doc := range result {
+		uris[i] = doc.Url
+	}
+
+	_, err = collection.RemoveAll(nil)
+	return uris, err
+}
+
 func (self *DB) GetListingIdFromUrl(uri string) (bson.ObjectId, error) {
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
@@ -162,12 +244,25 @@ func (self *DB) GetListingIdFromUrl(uri string) (bson.ObjectId, error) {
 
 	if err != nil {
 		// Not found
-		return listing.Id, errors.New("Listing not found")
+		return listing.Id, ErrListingNotFound
 	}
 
 	return listing.Id, nil
 }
 
+// GetListing returns ErrListingNotFound if there's no listing with the id
+func (self *DB) GetListing(listingId bson.ObjectId) (Listing, error) {
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	listing := Listing{}
+	err := collection.FindId(listingId).One(&listing)
+	if err == mgo.ErrNotFound {
+		return listing, ErrListingNotFound
+	}
+	return listing, err
+}
+
 func (self *DB) RegisterListing(uri, source, markup string) (Listing, bool, error) {
 
 	listing := Listing{}
@@ -198,6 +293,11 @@ func (self *DB) RegisterListing(uri, source, markup string) (Listing, bool, erro
 	properties := scraper.ScrapeListingProperties()
 	// TODO - find a way to validate these, to update status
 
+	// Fill in the location from the address, if the page didn't have it
+	if self.Geocoder != nil && !properties.Location.IsSet() {
+		GeocodeProperties(self.Geocoder, &properties)
+	}
+
 	// Create Listing object
 	listing = Listing{
 		Url:         uri,
@@ -208,6 +308,9 @@ func (self *DB) RegisterListing(uri, source, markup string) (Listing, bool, erro
 		Properties:  properties,
 	}
 
+	// Keep the link to its property, saving replaces the whole thing
+	listing.PropertyId, listing.Duplicate = self.propertyLink(uri)
+
 	// Save Listing
 	listingId, insertedFl, err := self.SaveListing(listing)
 	if err != nil {
@@ -218,6 +321,13 @@ func (self *DB) RegisterListing(uri, source, markup string) (Listing, bool, erro
 	// Add the ID
 	listing.Id = listingId
 
+	// Match it up with the same house from other sites
+	if propertyId, err := self.LinkProperty(listing); err != nil {
+		fmt.Println("[ERR] Problem linking listing to its property: ", err)
+	} else {
+		listing.PropertyId = propertyId
+	}
+
 	// return new listing
 	return listing, !insertedFl, nil
 }
@@ -231,6 +341,17 @@ func (self *DB) SaveListing(listing Listing) (bson.ObjectId, bool, error) {
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
 
+	// Grab what it looked like before, for the history
+	previous, hadPrevious := self.listingState(bson.M{"listingUrl": listing.Url})
+
+	// Saving replaces the whole thing, so carry the dates over
+	listing.seen(previous, hadPrevious, time.Now())
+	// Along with the geocoding backoff, while it's still not located
+	if !listing.Properties.Location.IsSet() {
+		listing.GeocodeFailures = previous.GeocodeFailures
+		listing.GeocodeRetryDate = previous.GeocodeRetryDate
+	}
+
 	changeInfo, err := collection.Upsert(bson.M{"listingUrl": listing.Url}, listing)
 	if err != nil {
 		var nothing bson.ObjectId
@@ -241,13 +362,25 @@ func (self *DB) SaveListing(listing Listing) (bson.ObjectId, bool, error) {
 	listingId, cast := changeInfo.UpsertedId.(bson.ObjectId)
 	if !cast {
 		// Get the id from the url
-		listingId, idErr := self.GetListingIdFromUrl(listing.Url)
+		var idErr error
+		listingId, idErr = self.GetListingIdFromUrl(listing.Url)
 		if idErr != nil {
 			// This should never happen
 			return listingId, false, idErr
 		}
 	}
 
+	current := listingState{Url: listing.Url, Price: listing.Properties.CurrentPrice, ForSale: listing.ForSale}
+	for _, image := range listing.Images {
+		current.Images = append(current.Images, image.Url)
+	}
+	if hadPrevious {
+		self.recordChanges(listingId, previous, current)
+	} else {
+		self.recordEvent(ListingEvent{ListingId: listingId, Type: EventCreated, Price: current.Price, ForSale: current.ForSale})
+	}
+	self.emitChanges(listingId, previous, hadPrevious, current)
+
 	if changeInfo.Updated != 0 {
 		// It was updated, return false
 		return listingId, false, nil
@@ -262,12 +395,17 @@ func (self *DB) UpdateListingStatus(listingId bson.ObjectId, forSale bool) error
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
 
-	err := collection.UpdateId(listingId, bson.M{
-		"$set": bson.M{
-			"isForSale":   forSale,
-			"updatedDate": time.Now(),
-		},
-	})
+	previous, hadPrevious := self.listingState(bson.M{"_id": listingId})
+
+	err := collection.UpdateId(listingId, statusUpdate(previous, forSale, time.Now()))
+	if err == nil && hadPrevious {
+		current := listingState{Url: previous.Url, Price: previous.Price, ForSale: forSale}
+		self.recordChanges(listingId, previous, current)
+		self.emitChanges(listingId, previous, true, current)
+	}
+	if err == nil {
+		self.reelectPrimary(bson.M{"_id": listingId})
+	}
 	return err
 }
 
@@ -275,16 +413,21 @@ func (self *DB) UpdateListingStatusByUrl(listingUrl string, forSale bool) error
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
 
+	previous, hadPrevious := self.listingState(bson.M{"listingUrl": listingUrl})
+
 	err := collection.Update(
 		bson.M{
 			"listingUrl": listingUrl,
 		},
-		bson.M{
-			"$set": bson.M{
-				"isForSale":   forSale,
-				"updatedDate": time.Now(),
-			},
-		})
+		statusUpdate(previous, forSale, time.Now()))
+	if err == nil && hadPrevious {
+		current := listingState{Url: listingUrl, Price: previous.Price, ForSale: forSale}
+		self.recordChanges(previous.Id, previous, current)
+		self.emitChanges(previous.Id, previous, true, current)
+	}
+	if err == nil {
+		self.reelectPrimary(bson.M{"listingUrl": listingUrl})
+	}
 	return err
 }
 
@@ -292,13 +435,21 @@ func (self *DB) UpdateListingProperties(listingId bson.ObjectId, properties List
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
 
-	err := collection.UpdateId(listingId, bson.M{
-		"$set": bson.M{
-			"isForSale":   true,
-			"properties":  properties,
-			"updatedDate": time.Now(),
-		},
-	})
+	if self.Geocoder != nil && !properties.Location.IsSet() {
+		GeocodeProperties(self.Geocoder, &properties)
+	}
+
+	previous, hadPrevious := self.listingState(bson.M{"_id": listingId})
+
+	update := statusUpdate(previous, true, time.Now())
+	update["$set"].(bson.M)["properties"] = properties
+
+	err := collection.UpdateId(listingId, update)
+	if err == nil && hadPrevious {
+		current := listingState{Url: previous.Url, Price: properties.CurrentPrice, ForSale: true}
+		self.recordChanges(listingId, previous, current)
+		self.emitChanges(listingId, previous, true, current)
+	}
 
 	return err
 }
@@ -409,7 +560,10 @@ func (self *DB) IterateAllListings(handler func(Listing, *DB)) error {
 	return nil
 }
 
-func (self *DB) IterateActiveListingsOlderThan(staleDate time.Time, limit int, handler func(Listing, *DB)) error {
+// IterateActiveListingsOlderThan hands the listings for sale not updated
+// since staleDate to the handler, up to limit of them (0 for all). An
+// error from the handler stops it, and is returned.
+func (self *DB) IterateActiveListingsOlderThan(staleDate time.Time, limit int, handler func(Listing, *DB) error) error {
 
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
@@ -425,7 +579,10 @@ func (self *DB) IterateActiveListingsOlderThan(staleDate time.Time, limit int, h
 	var result Listing
 
 	for iter.Next(&result) {
-		handler(result, self)
+		if err := handler(result, self); err != nil {
+			iter.Close()
+			return err
+		}
 	}
 
 	if err := iter.Close(); err != nil {
@@ -435,7 +592,14 @@ func (self *DB) IterateActiveListingsOlderThan(staleDate time.Time, limit int, h
 
 }
 
-func (self *DB) QueryListings(query ListingsQuery) (*[]Listing, int) {
+// QueryListings returns the matching listings, and the total count of
+// matches without the limit. A *QueryError is returned if the query
+// was given values it can't use.
+func (self *DB) QueryListings(query ListingsQuery) (*[]Listing, int, error) {
+
+	if err := query.Err(); err != nil {
+		return nil, 0, err
+	}
 
 	collection := self.mongoBroker.listingCollection()
 	defer self.mongoBroker.closeCollection(collection)
@@ -443,7 +607,24 @@ func (self *DB) QueryListings(query ListingsQuery) (*[]Listing, int) {
 	q := collection.Find(query.buildMongoQuery())
 
 	// Get the total count from the query
-	count, _ := q.Count()
+	count, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Page from the cursor, after counting, so the count is the total
+	if query.cursorFl {
+		paged := query.buildMongoQuery()
+		if query.cursor.addTo(paged) {
+			q = collection.Find(paged)
+		} else {
+			q.Skip(query.cursor.Offset)
+		}
+	}
+
+	if sort := listingSorts[query.currentSort()].mongoSort(); sort != nil {
+		q.Sort(sort...)
+	}
 
 	if query.limitFl {
 		q.Limit(int(query.limit))
@@ -451,9 +632,12 @@ func (self *DB) QueryListings(query ListingsQuery) (*[]Listing, int) {
 
 	var result []Listing
 
-	q.All(&result)
+	err = q.All(&result)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	return &result, count
+	return &result, count, nil
 }
 
 func (self *DB) NewListingsQuery() *ListingsQuery {
@@ -470,37 +654,101 @@ type ListingsQuery struct {
 	limit   uint
 
 	excludeFl bool
-	excluding []string
+	excluding []bson.ObjectId
 	includeFl bool
-	including []string
+	including []bson.ObjectId
 
 	priceMinFl bool
 	priceMin   uint
 	priceMaxFl bool
 	priceMax   uint
 
-	locationFl          bool
-	locationZip         string
-	locationZipDistance uint
-	location            GeoJson
+	locationFl       bool
+	locationZip      string
+	locationDistance uint
+	location         GeoJson
+
+	within []bson.M
+
+	states []string
+	cities []string
+	zips   []string
+
+	sortFl  bool
+	sortKey string
+
+	cursorFl bool
+	cursor   listingCursor
+
+	duplicatesFl bool
+
+	firstSeenFl    bool
+	firstSeenSince time.Time
+
+	invalid   []QueryFieldError
+	lookupErr error
 
 	db *DB
 }
 
-func (self *ListingsQuery) Fetch() (*[]Listing, int) {
+// QueryError is returned when a query was given values it can't use
+type QueryError struct {
+	Fields []QueryFieldError
+}
+
+type QueryFieldError struct {
+	Field   string   `json:"field"`
+	Message string   `json:"message"`
+	Values  []string `json:"values,omitempty"`
+}
+
+func (self *QueryError) Error() string {
+	message := "Invalid query:"
+	for _, field := range self.Fields {
+		message += fmt.Sprintf(" %s: %s %v;", field.Field, field.Message, field.Values)
+	}
+	return message
+}
+
+func (self *ListingsQuery) Fetch() (*[]Listing, int, error) {
 	return self.db.QueryListings(*self)
 }
 
+// Err returns a *QueryError if any of the filters were given bad values,
+// or the error from looking up a location.
+func (self *ListingsQuery) Err() error {
+	if self.lookupErr != nil {
+		return self.lookupErr
+	}
+	invalid := append(append([]QueryFieldError{}, self.invalid...), self.sortErrors()...)
+	if len(invalid) == 0 {
+		return nil
+	}
+	return &QueryError{Fields: invalid}
+}
+
+func (self *ListingsQuery) addInvalid(field, message string, values ...string) {
+	self.invalid = append(self.invalid, QueryFieldError{Field: field, Message: message, Values: values})
+}
+
 func (self *ListingsQuery) Init() {
 	self.forSaleFl = false
 	self.limitFl = false
 	self.excludeFl = false
-	self.excluding = []string{}
+	self.excluding = []bson.ObjectId{}
 	self.includeFl = false
-	self.including = []string{}
+	self.including = []bson.ObjectId{}
 	self.priceMinFl = false
 	self.priceMaxFl = false
 	self.locationFl = false
+	self.within = nil
+	self.states = nil
+	self.cities = nil
+	self.zips = nil
+	self.sortFl = false
+	self.cursorFl = false
+	self.duplicatesFl = false
+	self.firstSeenFl = false
 }
 
 func (self *ListingsQuery) ForSale(forSale bool) {
@@ -513,16 +761,38 @@ func (self *ListingsQuery) LimitTo(limit uint) {
 	self.limitFl = true
 }
 
+// Exclude skips the listings with these ids, invalid ids are reported by Err
 func (self *ListingsQuery) Exclude(ids ...string) {
-	self.excluding = append(self.excluding, ids...)
+	valid, invalid := objectIds(ids)
+	if len(invalid) > 0 {
+		self.addInvalid("excludeIds", "invalid ids", invalid...)
+	}
+	self.excluding = append(self.excluding, valid...)
 	self.excludeFl = true
 }
 
+// Include limits to the listings with these ids, invalid ids are reported by Err
 func (self *ListingsQuery) Include(ids ...string) {
-	self.including = append(self.including, ids...)
+	valid, invalid := objectIds(ids)
+	if len(invalid) > 0 {
+		self.addInvalid("includeIds", "invalid ids", invalid...)
+	}
+	self.including = append(self.including, valid...)
 	self.includeFl = true
 }
 
+// IncludeDuplicates returns every listing, instead of one per property
+func (self *ListingsQuery) IncludeDuplicates() {
+	self.duplicatesFl = true
+}
+
+// FirstSeenSince limits to listings first found on or after the date,
+// ie: new this week
+func (self *ListingsQuery) FirstSeenSince(since time.Time) {
+	self.firstSeenSince = since
+	self.firstSeenFl = true
+}
+
 func (self *ListingsQuery) PriceAbove(filter uint) {
 	self.priceMin = filter
 	self.priceMinFl = true
@@ -538,14 +808,75 @@ func (self *ListingsQuery) PriceBetween(min uint, max uint) {
 	self.PriceUnder(max)
 }
 
-// TODO - Add error handling here later
-func (self *ListingsQuery) NearZipCode(zip string, distance uint) {
+// InStates limits to listings in any of the states, by 2 letter code
+func (self *ListingsQuery) InStates(states ...string) {
+	for _, state := range states {
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if !statePattern.MatchString(state) {
+			self.addInvalid("states", "invalid state code", state)
+			continue
+		}
+		self.states = append(self.states, state)
+	}
+}
+
+// InCities limits to listings in any of the cities, matched exactly
+// once normalized the same way listing addresses are
+func (self *ListingsQuery) InCities(cities ...string) {
+	for _, city := range cities {
+		city = normalizeCity(city)
+		if city == "" {
+			self.addInvalid("cities", "empty city")
+			continue
+		}
+		self.cities = append(self.cities, city)
+	}
+}
+
+// InZipCodes limits to listings in any of the 5 digit zip codes
+func (self *ListingsQuery) InZipCodes(zips ...string) {
+	for _, zip := range zips {
+		zip = strings.TrimSpace(zip)
+		if !zipPattern.MatchString(zip) {
+			self.addInvalid("zips", "invalid zip code", zip)
+			continue
+		}
+		self.zips = append(self.zips, zip)
+	}
+}
+
+// NearZipCode limits to listings within distance meters of the center
+// of the zip code. Unknown zip codes are reported as a *QueryError,
+// any other problem looking it up is returned as is, both here and
+// from Err.
+func (self *ListingsQuery) NearZipCode(zip string, distance uint) error {
+	if self.locationFl {
+		self.addInvalid("zip", "only one location to search around is allowed", zip)
+		return self.Err()
+	}
+
+	if self.db == nil || self.db.Geocoder == nil {
+		self.lookupErr = ErrNoGeocoder
+		return self.lookupErr
+	}
+
+	// Get the actual geo json coords
+	location, err := self.db.Geocoder.ZipCodeLocation(zip)
+	if err == ErrZipNotFound {
+		self.addInvalid("zip", "unknown zip code", zip)
+		return self.Err()
+	}
+	if err != nil {
+		self.lookupErr = err
+		return err
+	}
+
 	self.locationFl = true
 	// Just set the recevied data so we have it
 	self.locationZip = zip
-	self.locationZipDistance = distance
-	// Get the actual geo json coords
-	self.location = FetchZipCodeCoords(zip)
+	self.locationDistance = distance
+	self.location = location
+	return nil
 }
 
 func (self *ListingsQuery) buildMongoQuery() bson.M {
@@ -557,15 +888,20 @@ func (self *ListingsQuery) buildMongoQuery() bson.M {
 
 	idQuery := bson.M{}
 	if self.excludeFl {
-		idQuery["$nin"] = objectIds(self.excluding)
+		idQuery["$nin"] = self.excluding
 	}
 	if self.includeFl {
-		idQuery["$in"] = objectIds(self.including)
+		idQuery["$in"] = self.including
 	}
 	if self.includeFl || self.excludeFl {
 		query["_id"] = idQuery
 	}
 
+	// One listing per property, unless asking for listings by id
+	if !self.duplicatesFl && !self.includeFl {
+		query["isDuplicate"] = bson.M{"$ne": true}
+	}
+
 	priceQuery := bson.M{}
 	if self.priceMaxFl {
 		priceQuery["$lt"] = self.priceMax
@@ -577,20 +913,70 @@ func (self *ListingsQuery) buildMongoQuery() bson.M {
 		query["properties.currentPrice"] = priceQuery
 	}
 
+	if self.firstSeenFl {
+		query["firstSeenDate"] = bson.M{"$gte": self.firstSeenSince}
+	}
+
+	if len(self.states) > 0 {
+		query["properties.address.state"] = oneOf(self.states)
+	}
+	if len(self.cities) > 0 {
+		query["properties.address.city"] = oneOf(self.cities)
+	}
+	if len(self.zips) > 0 {
+		query["properties.address.zip"] = oneOf(self.zips)
+	}
+
 	if self.locationFl {
 		query["properties.geoLocation"] = bson.M{
 			"$nearSphere": bson.M{
 				"$geometry":    self.location,
 				"$minDistance": 0,
-				"$maxDistance": self.locationZipDistance,
+				"$maxDistance": self.locationDistance,
 			},
 		}
 	}
+
+	// Areas go in an $and, since they share the field with each
+	// other and $nearSphere
+	if len(self.within) == 1 && !self.locationFl {
+		query["properties.geoLocation"] = self.within[0]
+	} else {
+		for _, area := range self.within {
+			query["$and"] = append(andConditions(query), bson.M{"properties.geoLocation": area})
+		}
+	}
 	fmt.Printf("mongo query: %+v\n", query)
 
 	return query
 }
 
+// buildMatchQuery is buildMongoQuery for aggregations, $nearSphere
+// isn't allowed in a $match, so a search around a location is matched
+// by distance alone, without the ordering
+func (self *ListingsQuery) buildMatchQuery() bson.M {
+	query := self.buildMongoQuery()
+	if self.locationFl {
+		query["properties.geoLocation"] = bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{self.location.Coordinates, float64(self.locationDistance) / earthRadiusMeters},
+			},
+		}
+	}
+	return query
+}
+
+var statePattern = regexp.MustCompile("^[A-Z]{2}$")
+var zipPattern = regexp.MustCompile("^[0-9]{5}$")
+
+// oneOf matches exactly for a single value, or any of several
+func oneOf(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return bson.M{"$in": values}
+}
+
 // Cleanup the markup for storage
 func prepareMarkupForStorage(rawMarkup string) string {
 
@@ -674,55 +1060,72 @@ func (self *mongoBroker) pageQueueCollection() *mgo.Collection {
 	return self.collection(self.pageQueueCollectionName)
 }
 
-func (self *mongoBroker) closeCollection(collection *mgo.Collection) {
-	collection.Database.Session.Close()
+func (self *mongoBroker) frontierCollection() *mgo.Collection {
+	return self.collection(FrontierCollectionName)
 }
 
-// TODO - add error handling here later
-var zipCache map[string]GeoJson = make(map[string]GeoJson)
+func (self *mongoBroker) leaseCollection() *mgo.Collection {
+	return self.collection(LeaseCollectionName)
+}
 
-func FetchZipCodeCoords(zip string) GeoJson {
+func (self *mongoBroker) hostThrottleCollection() *mgo.Collection {
+	return self.collection(HostThrottleCollectionName)
+}
 
-	cache, cacheFound := zipCache[zip]
-	if cacheFound {
-		fmt.Println("returning cached zip data")
-		return cache
-	}
+func (self *mongoBroker) historyCollection() *mgo.Collection {
+	return self.collection(HistoryCollectionName)
+}
 
-	req := &geocode.Request{Provider: geocode.GOOGLE, Region: "us", Address: zip}
+func (self *mongoBroker) propertyCollection() *mgo.Collection {
+	return self.collection(PropertyCollectionName)
+}
 
-	resp, err := req.Lookup(nil)
+func (self *mongoBroker) marketSnapshotCollection() *mgo.Collection {
+	return self.collection(MarketSnapshotCollectionName)
+}
 
-	if err != nil {
-		fmt.Println("Error when fetching zip coords: ", err)
-		return GeoJson{Type: "Point"}
-	}
+func (self *mongoBroker) savedSearchCollection() *mgo.Collection {
+	return self.collection(SavedSearchCollectionName)
+}
 
-	if resp.Status != "OK" {
-		fmt.Println("Bad response when fetching zip coords: ", resp)
-		return GeoJson{Type: "Point"}
-	}
+func (self *mongoBroker) searchAlertCollection() *mgo.Collection {
+	return self.collection(SearchAlertCollectionName)
+}
 
-	fmt.Printf("google resp: %+v\n", resp)
+func (self *mongoBroker) outboxCollection() *mgo.Collection {
+	return self.collection(OutboxCollectionName)
+}
 
-	lat := resp.GoogleResponse.Results[0].Geometry.Location.Lat
-	lng := resp.GoogleResponse.Results[0].Geometry.Location.Lng
+func (self *mongoBroker) outboxSequenceCollection() *mgo.Collection {
+	return self.collection(OutboxSequenceCollectionName)
+}
 
-	returnCoords := GeoJson{
-		Type:        "Point",
-		Coordinates: []float64{lng, lat},
-	}
+func (self *mongoBroker) webhookCollection() *mgo.Collection {
+	return self.collection(WebhookCollectionName)
+}
 
-	// Cache it
-	zipCache[zip] = returnCoords
+func (self *mongoBroker) webhookDeliveryCollection() *mgo.Collection {
+	return self.collection(WebhookDeliveryCollectionName)
+}
 
-	return returnCoords
+func (self *mongoBroker) userListingCollection() *mgo.Collection {
+	return self.collection(UserListingCollectionName)
 }
 
-func objectIds(idStrings []string) []bson.ObjectId {
-	objectIds := make([]bson.ObjectId, len(idStrings))
-	for i, idString := range idStrings {
-		objectIds[i] = bson.ObjectIdHex(idString)
+func (self *mongoBroker) closeCollection(collection *mgo.Collection) {
+	collection.Database.Session.Close()
+}
+
+// objectIds converts the valid hex ids, and hands back the invalid ones
+func objectIds(idStrings []string) ([]bson.ObjectId, []string) {
+	objectIds := make([]bson.ObjectId, 0, len(idStrings))
+	var invalid []string
+	for _, idString := range idStrings {
+		if bson.IsObjectIdHex(idString) {
+			objectIds = append(objectIds, bson.ObjectIdHex(idString))
+		} else {
+			invalid = append(invalid, idString)
+		}
 	}
-	return objectIds
+	return objectIds, invalid
 }
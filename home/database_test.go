@@ -0,0 +1,232 @@
+package home
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListingsQueryInvalidIds(t *testing.T) {
+
+	valid := bson.NewObjectId().Hex()
+
+	query := ListingsQuery{}
+	query.Init()
+	query.Exclude(valid, "not-an-id")
+	query.Include("123", valid, "")
+
+	err := query.Err()
+	queryErr, ok := err.(*QueryError)
+	if !ok {
+		t.Fatalf("query.Err() == %v, expected a *QueryError", err)
+	}
+
+	expect := []QueryFieldError{
+		{Field: "excludeIds", Message: "invalid ids", Values: []string{"not-an-id"}},
+		{Field: "includeIds", Message: "invalid ids", Values: []string{"123", ""}},
+	}
+	if !reflect.DeepEqual(queryErr.Fields, expect) {
+		t.Errorf("query.Err().Fields == %+v, expected %+v", queryErr.Fields, expect)
+	}
+
+	// The valid ones still make it through
+	if len(query.excluding) != 1 || len(query.including) != 1 {
+		t.Errorf("expected the valid id to be kept, got excluding: %v, including: %v", query.excluding, query.including)
+	}
+}
+
+func TestListingsQueryValid(t *testing.T) {
+
+	query := ListingsQuery{}
+	query.Init()
+	query.Exclude(bson.NewObjectId().Hex())
+
+	if err := query.Err(); err != nil {
+		t.Errorf("query.Err() == %v, expected nil", err)
+	}
+}
+
+func TestListingsQueryCursor(t *testing.T) {
+
+	type inOut struct {
+		sort   string
+		last   Listing
+		expect bson.M
+	}
+
+	id := bson.NewObjectId()
+	// Times come back out of bson as local time
+	updated := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC).Local()
+
+	cases := []inOut{
+		{SortNewest, Listing{Id: id}, bson.M{"_id": bson.M{"$lt": id}}},
+		{SortPriceLow, Listing{Id: id, Properties: ListingProperties{CurrentPrice: 250000}}, bson.M{"$or": []bson.M{
+			{"properties.currentPrice": bson.M{"$gt": int64(250000)}},
+			{"properties.currentPrice": int64(250000), "_id": bson.M{"$gt": id}},
+		}}},
+		// Unpriced ones come after going down
+		{SortPriceHigh, Listing{Id: id, Properties: ListingProperties{CurrentPrice: 250000}}, bson.M{"$or": []bson.M{
+			{"properties.currentPrice": bson.M{"$lt": int64(250000)}},
+			{"properties.currentPrice": int64(250000), "_id": bson.M{"$lt": id}},
+			{"properties.currentPrice": nil},
+		}}},
+		// And before going up
+		{SortPriceLow, Listing{Id: id}, bson.M{"$or": []bson.M{
+			{"properties.currentPrice": nil, "_id": bson.M{"$gt": id}},
+			{"properties.currentPrice": bson.M{"$ne": nil}},
+		}}},
+		{SortPriceHigh, Listing{Id: id}, bson.M{"properties.currentPrice": nil, "_id": bson.M{"$lt": id}}},
+		{SortUpdated, Listing{Id: id, UpdatedDate: updated}, bson.M{"$or": []bson.M{
+			{"updatedDate": bson.M{"$lt": updated}},
+			{"updatedDate": updated, "_id": bson.M{"$lt": id}},
+		}}},
+	}
+
+	for _, c := range cases {
+		query := ListingsQuery{}
+		query.Init()
+		query.LimitTo(1)
+		query.SortBy(c.sort)
+
+		encoded := query.NextCursor([]Listing{c.last})
+		if encoded == "" {
+			t.Fatalf("NextCursor() for sort %q was empty", c.sort)
+		}
+
+		next := ListingsQuery{}
+		next.Init()
+		next.SortBy(c.sort)
+		next.After(encoded)
+		if err := next.Err(); err != nil {
+			t.Fatalf("After(%q) == %v", encoded, err)
+		}
+
+		got := next.cursor.mongoQuery()
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("cursor query for sort %q == %#v, expected %#v", c.sort, got, c.expect)
+		}
+	}
+}
+
+func TestListingsQueryCursorErrors(t *testing.T) {
+
+	query := ListingsQuery{}
+	query.Init()
+	query.LimitTo(1)
+	encoded := query.NextCursor([]Listing{{Id: bson.NewObjectId()}})
+
+	// Cursor from the default newest sort, used with a price sort
+	other := ListingsQuery{}
+	other.Init()
+	other.SortBy(SortPriceLow)
+	other.After(encoded)
+	if other.Err() == nil {
+		t.Errorf("expected an error using a cursor with a different sort")
+	}
+
+	bad := ListingsQuery{}
+	bad.Init()
+	bad.After("garbage!")
+	bad.SortBy("cheapest")
+	if err, _ := bad.Err().(*QueryError); err == nil || len(err.Fields) != 2 {
+		t.Errorf("expected errors for bad cursor and sort, got %v", bad.Err())
+	}
+
+	distance := ListingsQuery{}
+	distance.Init()
+	distance.SortBy(SortDistance)
+	if distance.Err() == nil {
+		t.Errorf("expected an error sorting by distance without a location")
+	}
+}
+
+func TestListingsQueryAddressFilters(t *testing.T) {
+
+	query := ListingsQuery{}
+	query.Init()
+	query.InStates("co", " CA ")
+	query.InCities("Denver")
+	query.InZipCodes("80203")
+
+	if err := query.Err(); err != nil {
+		t.Fatalf("query.Err() == %v", err)
+	}
+
+	got := query.buildMongoQuery()
+	expect := bson.M{
+		"properties.address.state": bson.M{"$in": []string{"CO", "CA"}},
+		"properties.address.city":  "Denver",
+		"properties.address.zip":   "80203",
+		"isDuplicate":              bson.M{"$ne": true},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("buildMongoQuery() == %#v, expected %#v", got, expect)
+	}
+
+	bad := ListingsQuery{}
+	bad.Init()
+	bad.InStates("Colorado")
+	bad.InZipCodes("8020", "80203-1234")
+	bad.InCities(" ")
+	if err, _ := bad.Err().(*QueryError); err == nil || len(err.Fields) != 4 {
+		t.Errorf("expected 4 invalid fields, got %v", bad.Err())
+	}
+}
+
+func TestListingsQueryGeoFilters(t *testing.T) {
+
+	box := BoxPolygon(-105.1, 39.6, -104.8, 39.8)
+
+	query := ListingsQuery{}
+	query.Init()
+	query.WithinBox(-105.1, 39.6, -104.8, 39.8)
+	if got, expect := query.buildMongoQuery()["properties.geoLocation"], geoWithin(box); !reflect.DeepEqual(got, expect) {
+		t.Errorf("box query == %#v, expected %#v", got, expect)
+	}
+
+	// With a radius search too, the area moves to an $and
+	query.NearPoint(-104.98, 39.73, 1000)
+	if err := query.Err(); err != nil {
+		t.Fatalf("query.Err() == %v", err)
+	}
+	built := query.buildMongoQuery()
+	if _, found := built["properties.geoLocation"].(bson.M)["$nearSphere"]; !found {
+		t.Errorf("expected $nearSphere at the top level, got %#v", built)
+	}
+	if and := andConditions(built); len(and) != 1 || !reflect.DeepEqual(and[0], bson.M{"properties.geoLocation": geoWithin(box)}) {
+		t.Errorf("expected the box in an $and, got %#v", built)
+	}
+
+	type inOut struct {
+		polygon GeoJsonPolygon
+		valid   bool
+	}
+
+	cases := []inOut{
+		{box, true},
+		{GeoJsonPolygon{Type: "Point", Coordinates: box.Coordinates}, false},
+		{GeoJsonPolygon{Type: "Polygon"}, false},
+		{GeoJsonPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 1}}}}, false},
+		{GeoJsonPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {1, 0}, {0, 0}}}}, false},
+		{GeoJsonPolygon{Type: "Polygon", Coordinates: [][][]float64{{{0, 0}, {200, 0}, {1, 1}, {0, 0}}}}, false},
+	}
+
+	for _, c := range cases {
+		query := ListingsQuery{}
+		query.Init()
+		query.WithinPolygon(c.polygon)
+		if got := query.Err() == nil; got != c.valid {
+			t.Errorf("WithinPolygon(%v) valid == %v, expected %v", c.polygon, got, c.valid)
+		}
+	}
+
+	bad := ListingsQuery{}
+	bad.Init()
+	bad.WithinBox(-104.8, 39.6, -105.1, 39.8)
+	bad.NearPoint(0, 95, 10)
+	if err, _ := bad.Err().(*QueryError); err == nil || len(err.Fields) != 2 {
+		t.Errorf("expected errors for a flipped box and bad point, got %v", bad.Err())
+	}
+}
@@ -0,0 +1,154 @@
+package home
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Geocode precisions, best first
+const (
+	// From the listing page itself
+	PrecisionPage = "page"
+	// Geocoded to the building
+	PrecisionRooftop = "rooftop"
+	// Geocoded somewhere along the street
+	PrecisionStreet = "street"
+	// Geocoded to the area around the address, ie: a neighborhood
+	PrecisionArea = "area"
+	// Only the center of the zip code
+	PrecisionZip = "zip"
+)
+
+// Listings that couldn't be geocoded wait this long to be tried again,
+// doubling each time, up to the max
+const (
+	GeocodeRetryWait    = 24 * time.Hour
+	GeocodeRetryMaxWait = 30 * 24 * time.Hour
+)
+
+// AddressGeocoder is a Geocoder that can also look up street addresses
+type AddressGeocoder interface {
+	Geocoder
+	// AddressLocation returns the location of the address, and how
+	// precise it is. ErrAddressNotFound if it can't be resolved.
+	AddressLocation(address ListingAddress) (GeoJson, string, error)
+}
+
+// GeocodeProperties fills in the location of scraped properties from
+// their address, using the street address when the geocoder can, or
+// the zip code otherwise. The location is left unset if neither can
+// be resolved. Returns true if a location was set.
+func GeocodeProperties(geocoder Geocoder, properties *ListingProperties) bool {
+
+	address := properties.Address
+
+	if addressGeocoder, ok := geocoder.(AddressGeocoder); ok && strings.TrimSpace(address.Street) != "" {
+		location, precision, err := addressGeocoder.AddressLocation(address)
+		if err == nil {
+			properties.Location = location
+			properties.GeocodePrecision = precision
+			return true
+		}
+		if err != ErrAddressNotFound {
+			fmt.Printf("[ERR] Problem geocoding address %+v: %s\n", address, err)
+		}
+	}
+
+	if strings.TrimSpace(address.Zip) != "" {
+		location, err := geocoder.ZipCodeLocation(address.Zip)
+		if err == nil {
+			properties.Location = location
+			properties.GeocodePrecision = PrecisionZip
+			return true
+		}
+		if err != ErrZipNotFound {
+			fmt.Printf("[ERR] Problem geocoding zip %s: %s\n", address.Zip, err)
+		}
+	}
+
+	properties.Location = GeoJson{}
+	properties.GeocodePrecision = ""
+	return false
+}
+
+// GeocodeMissingLocations goes back over listings saved without a
+// location, or with the old [0, 0] placeholder, and geocodes them
+// from their address. Placeholders that can't be resolved are
+// removed, and the listing waits a while before it's tried again, see
+// geocodeRetryWait. Returns the number of listings that got a location.
+func (self *DB) GeocodeMissingLocations(limit int) (int, error) {
+	if self.Geocoder == nil {
+		return 0, ErrNoGeocoder
+	}
+
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	query := collection.Find(bson.M{
+		"$or": []bson.M{
+			{"properties.geoLocation": bson.M{"$exists": false}},
+			{"properties.geoLocation.coordinates": []float64{0, 0}},
+		},
+		// Never tried, or due to be tried again
+		"geocodeRetryDate": bson.M{"$not": bson.M{"$gt": now}},
+	})
+	if limit != 0 {
+		query.Limit(limit)
+	}
+
+	var listings []Listing
+	if err := query.All(&listings); err != nil {
+		return 0, err
+	}
+
+	located := 0
+	for _, listing := range listings {
+		properties := listing.Properties
+
+		var update bson.M
+		if GeocodeProperties(self.Geocoder, &properties) {
+			located++
+			update = bson.M{
+				"$set": bson.M{
+					"properties.geoLocation":      properties.Location,
+					"properties.geocodePrecision": properties.GeocodePrecision,
+				},
+				"$unset": bson.M{"geocodeFailures": "", "geocodeRetryDate": ""},
+			}
+		} else {
+			update = bson.M{
+				"$set": bson.M{
+					"geocodeFailures":  listing.GeocodeFailures + 1,
+					"geocodeRetryDate": now.Add(geocodeRetryWait(listing.GeocodeFailures + 1)),
+				},
+				"$unset": bson.M{
+					"properties.geoLocation":      "",
+					"properties.geocodePrecision": "",
+				},
+			}
+		}
+
+		if err := collection.UpdateId(listing.Id, update); err != nil {
+			return located, err
+		}
+	}
+
+	return located, nil
+}
+
+// geocodeRetryWait is how long to wait after the address failed to
+// geocode that many times
+func geocodeRetryWait(failures int) time.Duration {
+	wait := GeocodeRetryWait
+	for i := 1; i < failures && wait < GeocodeRetryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > GeocodeRetryMaxWait {
+		wait = GeocodeRetryMaxWait
+	}
+	return wait
+}
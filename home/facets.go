@@ -0,0 +1,232 @@
+package home
+
+import (
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Most values returned for each of the state, city and zip facets
+const FacetLimit = 50
+
+// Price bucket edges, the last bucket has no top
+var PriceBucketEdges = []uint{
+	0, 100000, 200000, 300000, 400000, 500000, 750000, 1000000, 1500000, 2000000,
+}
+
+// ListingFacets breaks down the listings matching a query, for filter
+// sliders and drill downs
+type ListingFacets struct {
+	Total int
+
+	States []FacetCount
+	Cities []FacetCount
+	Zips   []FacetCount
+
+	PriceBuckets []PriceBucket
+	PriceMin     uint
+	PriceMedian  uint
+	PriceMax     uint
+}
+
+// FacetCount is how many listings have the value, most first
+type FacetCount struct {
+	Value string
+	Count int
+}
+
+// PriceBucket counts prices from Min up to, not including, Max. Max is
+// 0 for the last bucket.
+type PriceBucket struct {
+	Min   uint
+	Max   uint
+	Count int
+}
+
+// ListingFacets counts the listings matching the query by state, city,
+// zip and price, ignoring its limit, sort and cursor. The counting is done
+// by the database, apart from the median price which is looked up after.
+func (self *DB) ListingFacets(query ListingsQuery) (ListingFacets, error) {
+
+	if err := query.Err(); err != nil {
+		return ListingFacets{}, err
+	}
+
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	match := query.buildMatchQuery()
+	result := facetResult{}
+	if err := collection.Pipe(facetPipeline(match)).One(&result); err != nil {
+		return ListingFacets{}, err
+	}
+	facets := result.facets()
+
+	// Mongo has no median, so it's the middle one or two by price
+	priced := result.pricedCount()
+	if priced == 0 {
+		return facets, nil
+	}
+	skip, limit := medianWindow(priced)
+	var middle []Listing
+	err := collection.Find(bson.M{"$and": []bson.M{match, pricedQuery()}}).
+		Select(bson.M{"properties.currentPrice": 1}).
+		Sort("properties.currentPrice").
+		Skip(skip).
+		Limit(limit).
+		All(&middle)
+	if err != nil {
+		return ListingFacets{}, err
+	}
+	prices := make([]uint, len(middle))
+	for i, listing := range middle {
+		prices[i] = listing.Properties.CurrentPrice
+	}
+	if len(prices) > 0 {
+		facets.PriceMedian = medianPrice(prices)
+	}
+
+	return facets, nil
+}
+
+// medianWindow is where the middle one, or two for an even count, are
+// in a sorted list of count
+func medianWindow(count int) (int, int) {
+	return (count - 1) / 2, 2 - count%2
+}
+
+// No price is no price, not free
+func pricedQuery() bson.M {
+	return bson.M{"properties.currentPrice": bson.M{"$gt": 0}}
+}
+
+// facetPipeline counts the matching listings every way at once, into a
+// single facetResult
+func facetPipeline(match bson.M) []bson.M {
+
+	top := func(field string) []bson.M {
+		return []bson.M{
+			{"$match": bson.M{field: bson.M{"$nin": []interface{}{"", nil}}}},
+			{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+			{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+			{"$limit": FacetLimit},
+		}
+	}
+
+	edges := make([]interface{}, len(PriceBucketEdges))
+	for i, edge := range PriceBucketEdges {
+		edges[i] = int64(edge)
+	}
+
+	return []bson.M{
+		{"$match": match},
+		{"$facet": bson.M{
+			"total":  []bson.M{{"$count": "count"}},
+			"states": top("properties.address.state"),
+			"cities": top("properties.address.city"),
+			"zips":   top("properties.address.zip"),
+			"prices": []bson.M{
+				{"$match": pricedQuery()},
+				{"$group": bson.M{
+					"_id":   nil,
+					"min":   bson.M{"$min": "$properties.currentPrice"},
+					"max":   bson.M{"$max": "$properties.currentPrice"},
+					"count": bson.M{"$sum": 1},
+				}},
+			},
+			// Past the last edge goes in the last bucket, as "top"
+			"buckets": []bson.M{
+				{"$match": pricedQuery()},
+				{"$bucket": bson.M{
+					"groupBy":    "$properties.currentPrice",
+					"boundaries": edges,
+					"default":    "top",
+				}},
+			},
+		}},
+	}
+}
+
+// facetResult is what comes back from the facet pipeline
+type facetResult struct {
+	Total   []facetGroup `bson:"total"`
+	States  []facetGroup `bson:"states"`
+	Cities  []facetGroup `bson:"cities"`
+	Zips    []facetGroup `bson:"zips"`
+	Prices  []facetGroup `bson:"prices"`
+	Buckets []facetGroup `bson:"buckets"`
+}
+
+type facetGroup struct {
+	Id    interface{} `bson:"_id"`
+	Count int         `bson:"count"`
+	Min   uint        `bson:"min"`
+	Max   uint        `bson:"max"`
+}
+
+func (self facetResult) pricedCount() int {
+	if len(self.Prices) == 0 {
+		return 0
+	}
+	return self.Prices[0].Count
+}
+
+func (self facetResult) facets() ListingFacets {
+	facets := ListingFacets{
+		States: facetCounts(self.States),
+		Cities: facetCounts(self.Cities),
+		Zips:   facetCounts(self.Zips),
+	}
+	if len(self.Total) > 0 {
+		facets.Total = self.Total[0].Count
+	}
+	if len(self.Prices) > 0 {
+		facets.PriceMin = self.Prices[0].Min
+		facets.PriceMax = self.Prices[0].Max
+	}
+
+	facets.PriceBuckets = make([]PriceBucket, len(PriceBucketEdges))
+	for i, min := range PriceBucketEdges {
+		facets.PriceBuckets[i].Min = min
+		if i+1 < len(PriceBucketEdges) {
+			facets.PriceBuckets[i].Max = PriceBucketEdges[i+1]
+		}
+	}
+	last := len(PriceBucketEdges) - 1
+	for _, bucket := range self.Buckets {
+		// Buckets come back by their lower edge, the number type
+		// depends on how it was stored
+		var min uint
+		switch id := bucket.Id.(type) {
+		case int:
+			min = uint(id)
+		case int64:
+			min = uint(id)
+		case float64:
+			min = uint(id)
+		default:
+			facets.PriceBuckets[last].Count += bucket.Count
+			continue
+		}
+		i := sort.Search(len(PriceBucketEdges), func(i int) bool { return PriceBucketEdges[i] > min }) - 1
+		if i < 0 {
+			continue
+		}
+		facets.PriceBuckets[i].Count += bucket.Count
+	}
+
+	return facets
+}
+
+// facetCounts are the grouped values, the pipeline sorts and limits them
+func facetCounts(groups []facetGroup) []FacetCount {
+	counts := make([]FacetCount, 0, len(groups))
+	for _, group := range groups {
+		value, ok := group.Id.(string)
+		if !ok {
+			continue
+		}
+		counts = append(counts, FacetCount{Value: value, Count: group.Count})
+	}
+	return counts
+}
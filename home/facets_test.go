@@ -0,0 +1,98 @@
+package home
+
+import (
+	"testing"
+)
+
+func TestFacetResult(t *testing.T) {
+
+	group := func(id interface{}, count int) facetGroup {
+		return facetGroup{Id: id, Count: count}
+	}
+
+	// Denver and Boulder listings, one in Santa Fe without a price
+	result := facetResult{
+		Total:  []facetGroup{group(nil, 5)},
+		States: []facetGroup{group("CO", 4), group("NM", 1)},
+		Cities: []facetGroup{group("Denver", 3), group("Boulder", 1), group("Santa Fe", 1)},
+		// Missing ones are left out
+		Zips:   []facetGroup{group("80203", 2), group("80205", 1), group(nil, 1)},
+		Prices: []facetGroup{{Count: 4, Min: 150000, Max: 2500000}},
+		// Lower edges come back however the prices were stored
+		Buckets: []facetGroup{group(100000, 1), group(int64(200000), 1), group(float64(400000), 1), group("top", 1)},
+	}
+	facets := result.facets()
+
+	if facets.Total != 5 {
+		t.Errorf("Total == %d, expected 5", facets.Total)
+	}
+	if result.pricedCount() != 4 {
+		t.Errorf("pricedCount() == %d, expected 4", result.pricedCount())
+	}
+
+	type inOut struct {
+		name   string
+		got    []FacetCount
+		expect []FacetCount
+	}
+	cases := []inOut{
+		{"States", facets.States, []FacetCount{{"CO", 4}, {"NM", 1}}},
+		{"Cities", facets.Cities, []FacetCount{{"Denver", 3}, {"Boulder", 1}, {"Santa Fe", 1}}},
+		{"Zips", facets.Zips, []FacetCount{{"80203", 2}, {"80205", 1}}},
+	}
+	for _, c := range cases {
+		if len(c.got) != len(c.expect) {
+			t.Errorf("%s == %v, expected %v", c.name, c.got, c.expect)
+			continue
+		}
+		for i := range c.got {
+			if c.got[i] != c.expect[i] {
+				t.Errorf("%s == %v, expected %v", c.name, c.got, c.expect)
+				break
+			}
+		}
+	}
+
+	if facets.PriceMin != 150000 || facets.PriceMax != 2500000 {
+		t.Errorf("prices == %d/%d, expected 150000/2500000", facets.PriceMin, facets.PriceMax)
+	}
+
+	counts := map[uint]int{}
+	for _, bucket := range facets.PriceBuckets {
+		counts[bucket.Min] = bucket.Count
+	}
+	if counts[100000] != 1 || counts[200000] != 1 || counts[400000] != 1 || counts[2000000] != 1 || counts[0] != 0 {
+		t.Errorf("PriceBuckets == %+v", facets.PriceBuckets)
+	}
+	if last := facets.PriceBuckets[len(facets.PriceBuckets)-1]; last.Max != 0 {
+		t.Errorf("last bucket == %+v, expected no max", last)
+	}
+
+	// Nothing matched
+	if empty := (facetResult{}).facets(); empty.Total != 0 || len(empty.PriceBuckets) != len(PriceBucketEdges) {
+		t.Errorf("empty facets == %+v", empty)
+	}
+}
+
+func TestMedianWindow(t *testing.T) {
+
+	type inOut struct {
+		count int
+		skip  int
+		limit int
+	}
+
+	cases := []inOut{
+		{1, 0, 1},
+		{2, 0, 2},
+		{4, 1, 2},
+		{5, 2, 1},
+	}
+
+	for _, c := range cases {
+		skip, limit := medianWindow(c.count)
+		if skip != c.skip || limit != c.limit {
+			t.Errorf("medianWindow(%d) == %d, %d, expected %d, %d", c.count, skip, limit, c.skip, c.limit)
+		}
+	}
+}
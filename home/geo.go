@@ -0,0 +1,129 @@
+package home
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GeoJsonPolygon - a GeoJSON polygon, the first ring is the outside
+// border, any others are holes. Coordinates are [longitude, latitude].
+type GeoJsonPolygon struct {
+	Type        string        `bson:"type" json:"type"`
+	Coordinates [][][]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// For converting distances on the map to angles
+const earthRadiusMeters = 6371000
+
+func NewGeoJsonPoint(longitude, latitude float64) GeoJson {
+	return GeoJson{Type: "Point", Coordinates: []float64{longitude, latitude}}
+}
+
+// NearPoint limits to listings within distance meters of the point,
+// closest first.
+func (self *ListingsQuery) NearPoint(longitude, latitude float64, distance uint) {
+	if !validLongitude(longitude) || !validLatitude(latitude) {
+		self.addInvalid("near", "invalid coordinates", fmt.Sprint(longitude), fmt.Sprint(latitude))
+		return
+	}
+	if self.locationFl {
+		self.addInvalid("near", "only one location to search around is allowed")
+		return
+	}
+	self.locationFl = true
+	self.locationDistance = distance
+	self.location = NewGeoJsonPoint(longitude, latitude)
+}
+
+// WithinBox limits to listings inside the bounding box, ie: a map
+// viewport. Boxes crossing the antimeridian aren't supported.
+func (self *ListingsQuery) WithinBox(west, south, east, north float64) {
+	if invalid := boundsError(west, south, east, north); invalid != nil {
+		self.addInvalid(invalid.Field, invalid.Message, invalid.Values...)
+		return
+	}
+
+	self.within = append(self.within, geoWithin(BoxPolygon(west, south, east, north)))
+}
+
+// CheckBounds returns a *QueryError for a bad map box, the same as
+// WithinBox, for boxes that aren't going straight into a query
+func CheckBounds(west, south, east, north float64) error {
+	if invalid := boundsError(west, south, east, north); invalid != nil {
+		return &QueryError{Fields: []QueryFieldError{*invalid}}
+	}
+	return nil
+}
+
+func boundsError(west, south, east, north float64) *QueryFieldError {
+	values := []string{fmt.Sprint(west), fmt.Sprint(south), fmt.Sprint(east), fmt.Sprint(north)}
+	if !validLongitude(west) || !validLongitude(east) || !validLatitude(south) || !validLatitude(north) {
+		return &QueryFieldError{Field: "bounds", Message: "invalid coordinates", Values: values}
+	}
+	if west >= east || south >= north {
+		return &QueryFieldError{Field: "bounds", Message: "west/south must be less than east/north", Values: values}
+	}
+	return nil
+}
+
+// WithinPolygon limits to listings inside the polygon, ie: a drawn
+// neighborhood.
+func (self *ListingsQuery) WithinPolygon(polygon GeoJsonPolygon) {
+	if err := validatePolygon(polygon); err != nil {
+		self.addInvalid("polygon", err.Error())
+		return
+	}
+
+	self.within = append(self.within, geoWithin(polygon))
+}
+
+// BoxPolygon returns the box as a polygon, counter-clockwise
+func BoxPolygon(west, south, east, north float64) GeoJsonPolygon {
+	return GeoJsonPolygon{
+		Type: "Polygon",
+		Coordinates: [][][]float64{{
+			{west, south},
+			{east, south},
+			{east, north},
+			{west, north},
+			{west, south},
+		}},
+	}
+}
+
+func geoWithin(polygon GeoJsonPolygon) bson.M {
+	return bson.M{"$geoWithin": bson.M{"$geometry": polygon}}
+}
+
+func validatePolygon(polygon GeoJsonPolygon) error {
+	if polygon.Type != "Polygon" {
+		return fmt.Errorf("unsupported geometry type: %q", polygon.Type)
+	}
+	if len(polygon.Coordinates) == 0 {
+		return fmt.Errorf("polygon has no coordinates")
+	}
+	for _, ring := range polygon.Coordinates {
+		if len(ring) < 4 {
+			return fmt.Errorf("polygon rings need at least 4 positions")
+		}
+		for _, position := range ring {
+			if len(position) != 2 || !validLongitude(position[0]) || !validLatitude(position[1]) {
+				return fmt.Errorf("invalid position: %v", position)
+			}
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("polygon rings must be closed")
+		}
+	}
+	return nil
+}
+
+func validLongitude(longitude float64) bool {
+	return longitude >= -180 && longitude <= 180
+}
+
+func validLatitude(latitude float64) bool {
+	return latitude >= -90 && latitude <= 90
+}
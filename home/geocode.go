@@ -0,0 +1,340 @@
+package home
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrZipNotFound = errors.New("Zip code not found")
+var ErrAddressNotFound = errors.New("Address not found")
+var ErrNoGeocoder = errors.New("No geocoder configured")
+
+// Geocoder looks up coordinates for places
+type Geocoder interface {
+	// ZipCodeLocation returns the center point of the zip code, or
+	// ErrZipNotFound if it's not a known zip.
+	ZipCodeLocation(zip string) (GeoJson, error)
+}
+
+// Geocoder providers
+const (
+	GeocoderNone   = ""
+	GeocoderLocal  = "local"
+	GeocoderGoogle = "google"
+)
+
+// NewGeocoder builds a cached geocoder for the provider, the local one
+// is loaded from the zip centroid file, the google one needs an API
+// key. Returns nil for no provider.
+func NewGeocoder(provider, zipCentroidsPath, googleAPIKey string) (Geocoder, error) {
+	switch provider {
+	case GeocoderNone:
+		return nil, nil
+	case GeocoderLocal:
+		local := NewLocalGeocoder()
+		loaded, err := local.LoadZipCentroidsFile(zipCentroidsPath)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Loaded %d zip code centroids\n", loaded)
+		return local, nil
+	case GeocoderGoogle:
+		return NewCachingGeocoder(NewGoogleGeocoder(googleAPIKey)), nil
+	}
+	return nil, fmt.Errorf("Unknown geocoder: %q", provider)
+}
+
+// Local Geocoder
+
+// LocalGeocoder answers from a zip code centroid dataset held in
+// memory, loaded with LoadZipCentroids.
+type LocalGeocoder struct {
+	mu   sync.RWMutex
+	zips map[string]GeoJson
+}
+
+func NewLocalGeocoder() *LocalGeocoder {
+	return &LocalGeocoder{zips: make(map[string]GeoJson)}
+}
+
+func (self *LocalGeocoder) ZipCodeLocation(zip string) (GeoJson, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	location, found := self.zips[normalizeZip(zip)]
+	if !found {
+		return GeoJson{}, ErrZipNotFound
+	}
+	return location, nil
+}
+
+// AddressLocation only knows zip codes, so that's as close as it gets
+func (self *LocalGeocoder) AddressLocation(address ListingAddress) (GeoJson, string, error) {
+	location, err := self.ZipCodeLocation(address.Zip)
+	if err == ErrZipNotFound {
+		return location, "", ErrAddressNotFound
+	}
+	return location, PrecisionZip, err
+}
+
+// AddZipCode adds (or replaces) a single zip centroid
+func (self *LocalGeocoder) AddZipCode(zip string, longitude, latitude float64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.zips[normalizeZip(zip)] = NewGeoJsonPoint(longitude, latitude)
+}
+
+func (self *LocalGeocoder) LoadZipCentroidsFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return self.LoadZipCentroids(file)
+}
+
+// LoadZipCentroids reads a delimited dataset with a header row, it
+// takes the Census ZCTA gazetteer file as is (tab separated, with
+// GEOID, INTPTLAT and INTPTLONG columns), or any comma separated file
+// with zip, latitude/lat and longitude/lng/lon columns. Returns the
+// number of zip codes loaded.
+func (self *LocalGeocoder) LoadZipCentroids(reader io.Reader) (int, error) {
+
+	// Look at the header to figure out the delimiter
+	buffered := bufio.NewReader(reader)
+	firstLine, err := buffered.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	delimiter := ','
+	if strings.Contains(firstLine, "\t") {
+		delimiter = '\t'
+	}
+
+	records := csv.NewReader(io.MultiReader(strings.NewReader(firstLine), buffered))
+	records.Comma = delimiter
+	records.FieldsPerRecord = -1
+	records.TrimLeadingSpace = true
+
+	header, err := records.Read()
+	if err != nil {
+		return 0, err
+	}
+	zipColumn := findColumn(header, "zip", "zipcode", "zcta", "zcta5", "geoid", "postal_code")
+	latColumn := findColumn(header, "latitude", "lat", "intptlat")
+	lngColumn := findColumn(header, "longitude", "lng", "lon", "long", "intptlong")
+	if zipColumn < 0 || latColumn < 0 || lngColumn < 0 {
+		return 0, fmt.Errorf("zip centroid header needs zip, latitude and longitude columns, got: %v", header)
+	}
+
+	loaded := 0
+	for line := 2; ; line++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, err
+		}
+		if len(record) <= zipColumn || len(record) <= latColumn || len(record) <= lngColumn {
+			return loaded, fmt.Errorf("zip centroid line %d: not enough columns", line)
+		}
+
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(record[latColumn]), 64)
+		lng, lngErr := strconv.ParseFloat(strings.TrimSpace(record[lngColumn]), 64)
+		if latErr != nil || lngErr != nil {
+			return loaded, fmt.Errorf("zip centroid line %d: bad coordinates", line)
+		}
+
+		self.AddZipCode(record[zipColumn], lng, lat)
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+func findColumn(header []string, names ...string) int {
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		for _, name := range names {
+			if column == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Zips are keyed by the 5 digit part, with any leading zeros
+// that a spreadsheet may have eaten put back
+func normalizeZip(zip string) string {
+	zip = strings.TrimSpace(zip)
+	if dash := strings.Index(zip, "-"); dash != -1 {
+		zip = zip[:dash]
+	}
+	for len(zip) < 5 && len(zip) > 0 {
+		zip = "0" + zip
+	}
+	return zip
+}
+
+// Caching Geocoder
+
+// CachingGeocoder remembers successful lookups from another geocoder,
+// it's safe to share between goroutines.
+type CachingGeocoder struct {
+	Geocoder Geocoder
+
+	mu    sync.RWMutex
+	cache map[string]GeoJson
+}
+
+func NewCachingGeocoder(geocoder Geocoder) *CachingGeocoder {
+	return &CachingGeocoder{
+		Geocoder: geocoder,
+		cache:    make(map[string]GeoJson),
+	}
+}
+
+func (self *CachingGeocoder) ZipCodeLocation(zip string) (GeoJson, error) {
+	key := normalizeZip(zip)
+
+	self.mu.RLock()
+	cached, found := self.cache[key]
+	self.mu.RUnlock()
+	if found {
+		return cached, nil
+	}
+
+	location, err := self.Geocoder.ZipCodeLocation(zip)
+	if err != nil {
+		return location, err
+	}
+
+	self.mu.Lock()
+	self.cache[key] = location
+	self.mu.Unlock()
+
+	return location, nil
+}
+
+// AddressLocation isn't cached, addresses rarely repeat
+func (self *CachingGeocoder) AddressLocation(address ListingAddress) (GeoJson, string, error) {
+	addressGeocoder, ok := self.Geocoder.(AddressGeocoder)
+	if !ok {
+		location, err := self.ZipCodeLocation(address.Zip)
+		if err == ErrZipNotFound {
+			return location, "", ErrAddressNotFound
+		}
+		return location, PrecisionZip, err
+	}
+	return addressGeocoder.AddressLocation(address)
+}
+
+// Google Geocoder
+
+const GoogleGeocodeUrl = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// GoogleGeocoder looks places up with the Google geocoding API, which
+// needs an API key.
+type GoogleGeocoder struct {
+	APIKey string
+	Client *http.Client
+}
+
+func NewGoogleGeocoder(apiKey string) *GoogleGeocoder {
+	return &GoogleGeocoder{
+		APIKey: apiKey,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (self *GoogleGeocoder) ZipCodeLocation(zip string) (GeoJson, error) {
+	params := url.Values{}
+	params.Set("components", "country:US|postal_code:"+normalizeZip(zip))
+	location, _, err := self.lookup(params)
+	if err == errGoogleZeroResults {
+		return location, ErrZipNotFound
+	}
+	return location, err
+}
+
+// Google location types, to our precisions
+var googlePrecisions = map[string]string{
+	"ROOFTOP":            PrecisionRooftop,
+	"RANGE_INTERPOLATED": PrecisionStreet,
+	"GEOMETRIC_CENTER":   PrecisionArea,
+	"APPROXIMATE":        PrecisionArea,
+}
+
+func (self *GoogleGeocoder) AddressLocation(address ListingAddress) (GeoJson, string, error) {
+	params := url.Values{}
+	params.Set("address", strings.Join([]string{address.Street, address.City, address.State + " " + address.Zip}, ", "))
+	params.Set("components", "country:US")
+	location, locationType, err := self.lookup(params)
+	if err == errGoogleZeroResults {
+		return location, "", ErrAddressNotFound
+	}
+	if err != nil {
+		return location, "", err
+	}
+	precision, found := googlePrecisions[locationType]
+	if !found {
+		precision = PrecisionArea
+	}
+	return location, precision, nil
+}
+
+var errGoogleZeroResults = errors.New("No results")
+
+// lookup returns the first result's location, and its location type
+func (self *GoogleGeocoder) lookup(params url.Values) (GeoJson, string, error) {
+	if self.APIKey == "" {
+		return GeoJson{}, "", errors.New("Google geocoder needs an API key")
+	}
+	params.Set("key", self.APIKey)
+
+	resp, err := self.Client.Get(GoogleGeocodeUrl + "?" + params.Encode())
+	if err != nil {
+		return GeoJson{}, "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Results      []struct {
+			Geometry struct {
+				Location struct {
+					Lat float64 `json:"lat"`
+					Lng float64 `json:"lng"`
+				} `json:"location"`
+				LocationType string `json:"location_type"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return GeoJson{}, "", err
+	}
+
+	if body.Status == "ZERO_RESULTS" || (body.Status == "OK" && len(body.Results) == 0) {
+		return GeoJson{}, "", errGoogleZeroResults
+	}
+	if body.Status != "OK" {
+		return GeoJson{}, "", fmt.Errorf("Google geocoder: %s %s", body.Status, body.ErrorMessage)
+	}
+
+	result := body.Results[0].Geometry
+	return NewGeoJsonPoint(result.Location.Lng, result.Location.Lat), result.LocationType, nil
+}
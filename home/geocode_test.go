@@ -0,0 +1,186 @@
+package home
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalGeocoderLoadZipCentroids(t *testing.T) {
+
+	type inOut struct {
+		data   string
+		loaded int
+	}
+
+	cases := []inOut{
+		// Census ZCTA gazetteer layout
+		{"GEOID\tALAND\tAWATER\tALAND_SQMI\tAWATER_SQMI\tINTPTLAT\tINTPTLONG\n" +
+			"80203\t2837456\t0\t1.096\t0.000\t39.731\t-104.983\n" +
+			"00601\t166659789\t799296\t64.348\t0.309\t18.180\t-66.752\n", 2},
+		// Plain csv, with the leading zero lost
+		{"zip,latitude,longitude\n80203,39.731,-104.983\n601,18.180,-66.752\n", 2},
+	}
+
+	for _, c := range cases {
+		geocoder := NewLocalGeocoder()
+		loaded, err := geocoder.LoadZipCentroids(strings.NewReader(c.data))
+		if err != nil || loaded != c.loaded {
+			t.Fatalf("LoadZipCentroids() == %d, %v, expected %d, nil", loaded, err, c.loaded)
+		}
+
+		got, err := geocoder.ZipCodeLocation("80203")
+		if expect := NewGeoJsonPoint(-104.983, 39.731); err != nil || !reflect.DeepEqual(got, expect) {
+			t.Errorf("ZipCodeLocation(80203) == %v, %v, expected %v", got, err, expect)
+		}
+		if _, err := geocoder.ZipCodeLocation("00601-1234"); err != nil {
+			t.Errorf("ZipCodeLocation(00601-1234) == %v, expected to find the 5 digit zip", err)
+		}
+		if _, err := geocoder.ZipCodeLocation("99999"); err != ErrZipNotFound {
+			t.Errorf("ZipCodeLocation(99999) == %v, expected ErrZipNotFound", err)
+		}
+	}
+
+	_, err := NewLocalGeocoder().LoadZipCentroids(strings.NewReader("zip,name\n80203,Denver\n"))
+	if err == nil {
+		t.Errorf("expected an error loading a file without coordinates")
+	}
+}
+
+type countingGeocoder struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (self *countingGeocoder) ZipCodeLocation(zip string) (GeoJson, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.calls++
+	if zip == "00000" {
+		return GeoJson{}, ErrZipNotFound
+	}
+	return NewGeoJsonPoint(-104.983, 39.731), nil
+}
+
+func TestCachingGeocoder(t *testing.T) {
+
+	counting := &countingGeocoder{}
+	geocoder := NewCachingGeocoder(counting)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			geocoder.ZipCodeLocation("80203")
+		}()
+	}
+	wg.Wait()
+
+	before := counting.calls
+	geocoder.ZipCodeLocation("80203")
+	if counting.calls != before {
+		t.Errorf("expected a cached lookup, geocoder was called again")
+	}
+
+	// Misses aren't cached
+	geocoder.ZipCodeLocation("00000")
+	if _, err := geocoder.ZipCodeLocation("00000"); err != ErrZipNotFound || counting.calls != before+2 {
+		t.Errorf("expected misses to go through to the geocoder each time")
+	}
+}
+
+func TestListingsQueryNearZipCode(t *testing.T) {
+
+	local := NewLocalGeocoder()
+	local.AddZipCode("80203", -104.983, 39.731)
+
+	query := (&DB{Geocoder: local}).NewListingsQuery()
+	if err := query.NearZipCode("80203", 1000); err != nil {
+		t.Fatalf("NearZipCode(80203) == %v", err)
+	}
+
+	unknown := (&DB{Geocoder: local}).NewListingsQuery()
+	if _, ok := unknown.NearZipCode("99999", 1000).(*QueryError); !ok {
+		t.Errorf("expected a *QueryError for an unknown zip code, got %v", unknown.Err())
+	}
+
+	none := (&DB{}).NewListingsQuery()
+	if err := none.NearZipCode("80203", 1000); err != ErrNoGeocoder || none.Err() != ErrNoGeocoder {
+		t.Errorf("expected ErrNoGeocoder without a geocoder, got %v", err)
+	}
+}
+
+type addressGeocoder struct {
+	*LocalGeocoder
+}
+
+func (self *addressGeocoder) AddressLocation(address ListingAddress) (GeoJson, string, error) {
+	if address.Street == "1 Main St" {
+		return NewGeoJsonPoint(-104.99, 39.74), PrecisionRooftop, nil
+	}
+	return GeoJson{}, "", ErrAddressNotFound
+}
+
+func TestGeocodeProperties(t *testing.T) {
+
+	local := NewLocalGeocoder()
+	local.AddZipCode("80203", -104.983, 39.731)
+	withAddresses := &addressGeocoder{LocalGeocoder: NewLocalGeocoder()}
+	withAddresses.AddZipCode("80203", -104.983, 39.731)
+
+	type inOut struct {
+		geocoder  Geocoder
+		address   ListingAddress
+		located   bool
+		location  GeoJson
+		precision string
+	}
+
+	cases := []inOut{
+		{withAddresses, ListingAddress{Street: "1 Main St", Zip: "80203"}, true, NewGeoJsonPoint(-104.99, 39.74), PrecisionRooftop},
+		// Falls back to the zip when the street can't be found
+		{withAddresses, ListingAddress{Street: "2 Nowhere Rd", Zip: "80203"}, true, NewGeoJsonPoint(-104.983, 39.731), PrecisionZip},
+		{local, ListingAddress{Street: "1 Main St", Zip: "80203"}, true, NewGeoJsonPoint(-104.983, 39.731), PrecisionZip},
+		// Nothing to go on, stays unset rather than [0, 0]
+		{local, ListingAddress{Street: "1 Main St", Zip: "99999"}, false, GeoJson{}, ""},
+		{local, ListingAddress{}, false, GeoJson{}, ""},
+	}
+
+	for _, c := range cases {
+		properties := ListingProperties{Address: c.address, Location: NewGeoJsonPoint(0, 0)}
+		located := GeocodeProperties(c.geocoder, &properties)
+		if located != c.located || !reflect.DeepEqual(properties.Location, c.location) || properties.GeocodePrecision != c.precision {
+			t.Errorf("GeocodeProperties(%+v) == %v, %v, %q, expected %v, %v, %q", c.address,
+				located, properties.Location, properties.GeocodePrecision, c.located, c.location, c.precision)
+		}
+	}
+
+	if (GeoJson{}).IsSet() || NewGeoJsonPoint(0, 0).IsSet() || !NewGeoJsonPoint(-104.9, 39.7).IsSet() {
+		t.Errorf("IsSet() should only be true for real coordinates")
+	}
+}
+
+func TestGeocodeRetryWait(t *testing.T) {
+
+	type inOut struct {
+		failures int
+		expect   time.Duration
+	}
+
+	cases := []inOut{
+		{1, GeocodeRetryWait},
+		{2, 2 * GeocodeRetryWait},
+		{4, 8 * GeocodeRetryWait},
+		{6, GeocodeRetryMaxWait},
+		{100, GeocodeRetryMaxWait},
+	}
+
+	for _, c := range cases {
+		if got := geocodeRetryWait(c.failures); got != c.expect {
+			t.Errorf("geocodeRetryWait(%d) == %v, expected %v", c.failures, got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package home
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Listing event types
+const (
+	EventCreated   = "created"
+	EventPrice     = "price"
+	EventOnMarket  = "onMarket"
+	EventOffMarket = "offMarket"
+)
+
+// The parts of a listing we keep history for
+type listingState struct {
+	Id      bson.ObjectId
+	Price   uint
+	ForSale bool
+
+	// For the change events, image urls are only known when saving
+	Url    string
+	Images []string
+
+	// Not history, but needed when saving replaces the listing
+	FirstSeenDate time.Time
+	LastSeenDate  time.Time
+	OffMarketDate time.Time
+
+	GeocodeFailures  int
+	GeocodeRetryDate time.Time
+}
+
+func (self *DB) listingState(selector bson.M) (listingState, bool) {
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	type document struct {
+		Id         bson.ObjectId `bson:"_id"`
+		Url        string        `bson:"listingUrl"`
+		ForSale    bool          `bson:"isForSale"`
+		Properties struct {
+			CurrentPrice uint `bson:"currentPrice"`
+		} `bson:"properties"`
+		Images []struct {
+			Url string `bson:"url"`
+		} `bson:"images"`
+		FirstSeenDate time.Time `bson:"firstSeenDate"`
+		LastSeenDate  time.Time `bson:"lastSeenDate"`
+		OffMarketDate time.Time `bson:"offMarketDate"`
+
+		GeocodeFailures  int       `bson:"geocodeFailures"`
+		GeocodeRetryDate time.Time `bson:"geocodeRetryDate"`
+	}
+	doc := document{}
+
+	err := collection.Find(selector).Select(bson.M{
+		"listingUrl":              1,
+		"isForSale":               1,
+		"properties.currentPrice": 1,
+		"images.url":              1,
+		"firstSeenDate":           1,
+		"lastSeenDate":            1,
+		"offMarketDate":           1,
+		"geocodeFailures":         1,
+		"geocodeRetryDate":        1,
+	}).One(&doc)
+	if err != nil {
+		return listingState{}, false
+	}
+	images := make([]string, len(doc.Images))
+	for i, image := range doc.Images {
+		images[i] = image.Url
+	}
+	return listingState{
+		Id:            doc.Id,
+		Url:           doc.Url,
+		Price:         doc.Properties.CurrentPrice,
+		ForSale:       doc.ForSale,
+		Images:        images,
+		FirstSeenDate: doc.FirstSeenDate,
+		LastSeenDate:  doc.LastSeenDate,
+		OffMarketDate: doc.OffMarketDate,
+
+		GeocodeFailures:  doc.GeocodeFailures,
+		GeocodeRetryDate: doc.GeocodeRetryDate,
+	}, true
+}
+
+// recordChanges adds history events for whatever is different between
+// the two states.
+func (self *DB) recordChanges(listingId bson.ObjectId, previous, current listingState) {
+	if previous.Price != current.Price {
+		self.recordEvent(ListingEvent{
+			ListingId: listingId,
+			Type:      EventPrice,
+			Price:     current.Price,
+			OldPrice:  previous.Price,
+			ForSale:   current.ForSale,
+		})
+	}
+	if previous.ForSale != current.ForSale {
+		eventType := EventOffMarket
+		if current.ForSale {
+			eventType = EventOnMarket
+		}
+		self.recordEvent(ListingEvent{
+			ListingId: listingId,
+			Type:      eventType,
+			Price:     current.Price,
+			ForSale:   current.ForSale,
+		})
+	}
+}
+
+// History is a nice to have, so problems recording it are only logged
+func (self *DB) recordEvent(event ListingEvent) {
+	collection := self.mongoBroker.historyCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	if event.Date.IsZero() {
+		event.Date = time.Now()
+	}
+
+	err := collection.Insert(event)
+	if err != nil {
+		fmt.Println("Error when recording listing history: ", err)
+	}
+}
+
+// GetListingHistory returns the price and status changes for a listing,
+// and the times its page was fetched, oldest first. Returns
+// ErrListingNotFound if there's no listing with the id.
+func (self *DB) GetListingHistory(listingId bson.ObjectId) (ListingHistory, error) {
+	history := ListingHistory{ListingId: listingId}
+
+	if _, err := self.GetListing(listingId); err != nil {
+		return history, err
+	}
+
+	events := self.mongoBroker.historyCollection()
+	defer self.mongoBroker.closeCollection(events)
+
+	err := events.Find(bson.M{"listingId": listingId}).Sort("date").All(&history.Events)
+	if err != nil {
+		return history, err
+	}
+
+	markup := self.mongoBroker.listingMarkupCollection()
+	defer self.mongoBroker.closeCollection(markup)
+
+	err = markup.Find(bson.M{"listingId": listingId}).
+		Select(bson.M{"createdDate": 1, "scrapedDate": 1}).
+		Sort("createdDate").
+		All(&history.Scrapes)
+
+	return history, err
+}
+
+// ParseListingId returns an error instead of panicking on bad ids
+func ParseListingId(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		var nothing bson.ObjectId
+		return nothing, fmt.Errorf("Invalid listing id: %q", id)
+	}
+	return bson.ObjectIdHex(id), nil
+}
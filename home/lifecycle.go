@@ -0,0 +1,85 @@
+package home
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// When listings were seen on and off the market. Listings saved before
+// these dates were kept fall back to when they were created, which is
+// in their id.
+
+// FirstSeen is when the listing was first found
+func (self Listing) FirstSeen() time.Time {
+	return firstSeen(self.FirstSeenDate, self.Id)
+}
+
+// DaysOnMarket counts whole days from when the listing was first found
+// to when it went off the market, or to now if it's still for sale.
+// A relisted listing keeps counting from when it was first found.
+func (self Listing) DaysOnMarket(now time.Time) int {
+	start := self.FirstSeen()
+	if start.IsZero() {
+		return 0
+	}
+	end := now
+	if !self.ForSale && !self.OffMarketDate.IsZero() {
+		end = self.OffMarketDate
+	}
+	if end.Before(start) {
+		return 0
+	}
+	return int(end.Sub(start) / (24 * time.Hour))
+}
+
+func firstSeen(date time.Time, id bson.ObjectId) time.Time {
+	if date.IsZero() && id.Valid() {
+		return id.Time()
+	}
+	return date
+}
+
+// seen fills in the dates for a listing about to be saved over what
+// was there before
+func (self *Listing) seen(previous listingState, hadPrevious bool, now time.Time) {
+	self.FirstSeenDate = now
+	if hadPrevious {
+		self.FirstSeenDate = firstSeen(previous.FirstSeenDate, previous.Id)
+	}
+
+	if self.ForSale {
+		self.LastSeenDate = now
+		self.OffMarketDate = time.Time{}
+		return
+	}
+
+	self.LastSeenDate = previous.LastSeenDate
+	self.OffMarketDate = previous.OffMarketDate
+	if self.OffMarketDate.IsZero() {
+		self.OffMarketDate = now
+	}
+}
+
+// statusUpdate is the mongo update for a listing's status changing,
+// keeping its dates in line
+func statusUpdate(previous listingState, forSale bool, now time.Time) bson.M {
+	set := bson.M{
+		"isForSale":   forSale,
+		"updatedDate": now,
+	}
+	update := bson.M{"$set": set}
+
+	if previous.FirstSeenDate.IsZero() && previous.Id.Valid() {
+		set["firstSeenDate"] = previous.Id.Time()
+	}
+
+	if forSale {
+		set["lastSeenDate"] = now
+		update["$unset"] = bson.M{"offMarketDate": ""}
+	} else if previous.OffMarketDate.IsZero() {
+		set["offMarketDate"] = now
+	}
+
+	return update
+}
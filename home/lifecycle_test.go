@@ -0,0 +1,103 @@
+package home
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDaysOnMarket(t *testing.T) {
+
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	created := time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	type inOut struct {
+		listing Listing
+		expect  int
+	}
+
+	cases := []inOut{
+		{Listing{ForSale: true, FirstSeenDate: now.AddDate(0, 0, -10)}, 10},
+		{Listing{ForSale: true, FirstSeenDate: now.Add(-23 * time.Hour)}, 0},
+		{Listing{ForSale: false, FirstSeenDate: now.AddDate(0, 0, -10), OffMarketDate: now.AddDate(0, 0, -3)}, 7},
+		// Saved before first seen was kept, uses the id
+		{Listing{ForSale: true, Id: bson.NewObjectIdWithTime(created)}, 14},
+		{Listing{ForSale: true}, 0},
+		{Listing{ForSale: true, FirstSeenDate: now.AddDate(0, 0, 1)}, 0},
+	}
+
+	for _, c := range cases {
+		if got := c.listing.DaysOnMarket(now); got != c.expect {
+			t.Errorf("DaysOnMarket() for %+v == %d, expected %d", c.listing, got, c.expect)
+		}
+	}
+}
+
+func TestListingSeen(t *testing.T) {
+
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	before := now.AddDate(0, 0, -5)
+
+	type inOut struct {
+		forSale     bool
+		previous    listingState
+		hadPrevious bool
+		first       time.Time
+		last        time.Time
+		offMarket   time.Time
+	}
+
+	cases := []inOut{
+		// New listing
+		{true, listingState{}, false, now, now, time.Time{}},
+		// Seen again
+		{true, listingState{FirstSeenDate: before, LastSeenDate: before}, true, before, now, time.Time{}},
+		// Back on the market
+		{true, listingState{FirstSeenDate: before, OffMarketDate: before}, true, before, now, time.Time{}},
+		// Went off the market, and stays off
+		{false, listingState{FirstSeenDate: before, LastSeenDate: before, ForSale: true}, true, before, before, now},
+		{false, listingState{FirstSeenDate: before, LastSeenDate: before, OffMarketDate: before}, true, before, before, before},
+	}
+
+	for i, c := range cases {
+		listing := Listing{ForSale: c.forSale}
+		listing.seen(c.previous, c.hadPrevious, now)
+		if !listing.FirstSeenDate.Equal(c.first) || !listing.LastSeenDate.Equal(c.last) || !listing.OffMarketDate.Equal(c.offMarket) {
+			t.Errorf("case %d: seen() dates == %v, %v, %v, expected %v, %v, %v", i,
+				listing.FirstSeenDate, listing.LastSeenDate, listing.OffMarketDate, c.first, c.last, c.offMarket)
+		}
+	}
+}
+
+func TestStatusUpdate(t *testing.T) {
+
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	before := now.AddDate(0, 0, -5)
+
+	type inOut struct {
+		previous listingState
+		forSale  bool
+		expect   bson.M
+	}
+
+	cases := []inOut{
+		{listingState{FirstSeenDate: before, ForSale: true}, false, bson.M{
+			"$set": bson.M{"isForSale": false, "updatedDate": now, "offMarketDate": now},
+		}},
+		{listingState{FirstSeenDate: before, OffMarketDate: before}, false, bson.M{
+			"$set": bson.M{"isForSale": false, "updatedDate": now},
+		}},
+		{listingState{FirstSeenDate: before, OffMarketDate: before}, true, bson.M{
+			"$set":   bson.M{"isForSale": true, "updatedDate": now, "lastSeenDate": now},
+			"$unset": bson.M{"offMarketDate": ""},
+		}},
+	}
+
+	for _, c := range cases {
+		if got := statusUpdate(c.previous, c.forSale, now); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("statusUpdate(%+v, %v) == %#v, expected %#v", c.previous, c.forSale, got, c.expect)
+		}
+	}
+}
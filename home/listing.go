@@ -17,6 +17,24 @@ type Listing struct {
 
 	ForSale     bool      `bson:"isForSale"`
 	UpdatedDate time.Time `bson:"updatedDate,omitempty"`
+
+	// When the crawlers first and last found it for sale, and when it
+	// went off the market, see DaysOnMarket
+	FirstSeenDate time.Time `bson:"firstSeenDate,omitempty"`
+	LastSeenDate  time.Time `bson:"lastSeenDate,omitempty"`
+	OffMarketDate time.Time `bson:"offMarketDate,omitempty"`
+
+	// Times geocoding the address failed, it's not tried again until
+	// the retry date, see GeocodeMissingLocations
+	GeocodeFailures  int       `bson:"geocodeFailures,omitempty"`
+	GeocodeRetryDate time.Time `bson:"geocodeRetryDate,omitempty"`
+
+	// The property this is a listing of, see LinkProperty
+	PropertyId bson.ObjectId `bson:"propertyId,omitempty"`
+	// Another listing of the same property stands in for this one
+	Duplicate bool `bson:"isDuplicate,omitempty"`
+	// All the listings of the property, filled in by MergeDuplicates
+	Sources []ListingSource `bson:"-"`
 }
 
 // Listing Model - Images
@@ -28,15 +46,37 @@ type ListingImage struct {
 
 // Listing Model - Properties
 type ListingProperties struct {
-	CurrentPrice uint                   `bson:"currentPrice,omitempty"`
-	MLS          string                 `bson:"mls"`
-	Address      ListingAddress         `bson:"address,omitempty"`
-	Location     GeoJson                `bson:"geoLocation,omitempty"`
-	Meta         map[string]interface{} `bson:",inline" json:"-"` // All extra data on this sub document.. aka super scheama
+	CurrentPrice uint           `bson:"currentPrice,omitempty"`
+	SquareFeet   uint           `bson:"squareFeet,omitempty"`
+	Beds         uint           `bson:"beds,omitempty"`
+	Baths        float64        `bson:"baths,omitempty"`
+	MLS          string         `bson:"mls"`
+	Address      ListingAddress `bson:"address,omitempty"`
+	Location     GeoJson        `bson:"geoLocation,omitempty"`
+	// Where the location came from, see the Precision constants
+	GeocodePrecision string                 `bson:"geocodePrecision,omitempty"`
+	Meta             map[string]interface{} `bson:",inline" json:"-"` // All extra data on this sub document.. aka super scheama
 }
 
 // Listing Model - Properties / Address
+// Normalized with NormalizeAddress, Street is the number and the
+// street name, without the unit.
 type ListingAddress struct {
+	Street string `bson:"street"`
+	Unit   string `bson:"unit,omitempty"`
+	City   string `bson:"city"`
+	State  string `bson:"state"`
+	Zip    string `bson:"zip"`
+	Zip4   string `bson:"zip4,omitempty"`
+
+	Number     string `bson:"number,omitempty"`
+	StreetName string `bson:"streetName,omitempty"`
+
+	Original RawAddress `bson:"original,omitempty"`
+}
+
+// Listing Model - Properties / Address as scraped
+type RawAddress struct {
 	Street string `bson:"street"`
 	City   string `bson:"city"`
 	State  string `bson:"state"`
@@ -49,6 +89,15 @@ type GeoJson struct {
 	Coordinates []float64 `bson:"coordinates"`
 }
 
+// IsSet is false for missing locations, and the [0, 0] placeholder
+// older listings were saved with.
+func (self GeoJson) IsSet() bool {
+	if len(self.Coordinates) != 2 {
+		return false
+	}
+	return self.Coordinates[0] != 0 || self.Coordinates[1] != 0
+}
+
 // ListingMarkup Model
 type ListingMarkup struct {
 	Id          bson.ObjectId `bson:"_id,omitempty"`
@@ -59,3 +108,27 @@ type ListingMarkup struct {
 	CreatedDate time.Time     `bson:"createdDate"`
 	ScrapedDate time.Time     `bson:"scrapedDate"`
 }
+
+// ListingEvent Model - a change in a listing's price or status
+type ListingEvent struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	ListingId bson.ObjectId `bson:"listingId"`
+	Type      string        `bson:"type"`
+	Price     uint          `bson:"price"`
+	OldPrice  uint          `bson:"oldPrice,omitempty"`
+	ForSale   bool          `bson:"isForSale"`
+	Date      time.Time     `bson:"date"`
+}
+
+// ListingHistory - everything we know about how a listing changed over time
+type ListingHistory struct {
+	ListingId bson.ObjectId
+	Events    []ListingEvent
+	Scrapes   []ListingScrape
+}
+
+// ListingScrape - when a listing's page was fetched, and when it was scraped
+type ListingScrape struct {
+	FetchedDate time.Time `bson:"createdDate"`
+	ScrapedDate time.Time `bson:"scrapedDate"`
+}
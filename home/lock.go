@@ -0,0 +1,261 @@
+package home
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	LeaseCollectionName = "Leases"
+	DefaultLeaseTTL     = 30 * time.Second
+)
+
+// Locker makes sure only one process at a time is doing a certain
+// piece of work.
+type Locker interface {
+	// Acquire returns false if the lock is already held elsewhere
+	Acquire() (bool, error)
+	Release() error
+	// Lost is closed if the lock is taken away after being acquired
+	Lost() <-chan struct{}
+}
+
+// ErrLockHeld is returned by AcquireProcessLock when another process
+// has the lock
+var ErrLockHeld = errors.New("Process already running")
+
+// AcquireProcessLock takes the named lock for a command. lockType is
+// "db" for a lease in the database, good across hosts, or "file" for a
+// lock file in the temp dir, only good on the one host.
+func AcquireProcessLock(lockType, name string, db *DB) (Locker, error) {
+
+	var lock Locker
+	switch lockType {
+	case "db":
+		lock = db.NewLease(name, DefaultLeaseTTL)
+	case "file":
+		lock = NewFileLock(filepath.Join(os.TempDir(), "photochem-"+name+".lock"))
+	default:
+		return nil, fmt.Errorf("Unknown lock type: %q", lockType)
+	}
+
+	acquired, err := lock.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrLockHeld
+	}
+	return lock, nil
+}
+
+// File Lock
+
+// FileLock holds an exclusive flock on a file, it only coordinates
+// processes on the same host, but is released by the OS if the
+// process dies.
+type FileLock struct {
+	Path string
+	file *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{Path: path}
+}
+
+func (self *FileLock) Acquire() (bool, error) {
+	file, err := os.OpenFile(self.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	// Leave the pid behind, for whoever is wondering who has it
+	file.Truncate(0)
+	file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+
+	self.file = file
+	return true, nil
+}
+
+func (self *FileLock) Release() error {
+	if self.file == nil {
+		return errors.New("Lock not held")
+	}
+	syscall.Flock(int(self.file.Fd()), syscall.LOCK_UN)
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// A file lock can't be taken away from us
+func (self *FileLock) Lost() <-chan struct{} {
+	return nil
+}
+
+// Database Lease
+
+// Lease is a lock stored in the database, so it works across hosts.
+// It's kept alive by a heartbeat, and expires after the TTL if the
+// holder goes away without releasing it.
+type Lease struct {
+	Name  string
+	Owner string
+	TTL   time.Duration
+
+	db   *DB
+	lost chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (self *DB) NewLease(name string, ttl time.Duration) *Lease {
+	if ttl == 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Lease{
+		Name:  name,
+		Owner: leaseOwnerId(),
+		TTL:   ttl,
+		db:    self,
+	}
+}
+
+func (self *Lease) Acquire() (bool, error) {
+	collection := self.db.mongoBroker.leaseCollection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+
+	// Take it over if it's ours already or expired, if someone else
+	// holds it the upsert will collide on the _id
+	_, err := collection.Upsert(
+		bson.M{
+			"_id": self.Name,
+			"$or": []bson.M{
+				{"owner": self.Owner},
+				{"expiresDate": bson.M{"$lt": now}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"owner":         self.Owner,
+				"acquiredDate":  now,
+				"heartbeatDate": now,
+				"expiresDate":   now.Add(self.TTL),
+			},
+		})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	self.lost = make(chan struct{})
+	self.stop = make(chan struct{})
+	self.wg.Add(1)
+	go self.heartbeat(now, self.renew)
+
+	return true, nil
+}
+
+// heartbeat renews the lease every third of the TTL, until it's
+// released. It's lost if someone else has it, or it couldn't be renewed
+// before it ran out, from then on someone else could take it.
+func (self *Lease) heartbeat(lastRenew time.Time, renew func() error) {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(self.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// The new expiry is counted from before the renewal
+		renewing := time.Now()
+		err := renew()
+		if err == nil {
+			lastRenew = renewing
+			continue
+		}
+		if err == mgo.ErrNotFound {
+			fmt.Printf("[ERR] Lease %s was taken over, no longer held by %s\n", self.Name, self.Owner)
+			close(self.lost)
+			return
+		}
+
+		// Keep trying, until the lease runs out
+		fmt.Printf("[ERR] Problem renewing lease %s: %s\n", self.Name, err)
+		if time.Now().After(lastRenew.Add(self.TTL)) {
+			fmt.Printf("[ERR] Lease %s ran out, no longer held by %s\n", self.Name, self.Owner)
+			close(self.lost)
+			return
+		}
+	}
+}
+
+func (self *Lease) renew() error {
+	collection := self.db.mongoBroker.leaseCollection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	return collection.Update(
+		bson.M{"_id": self.Name, "owner": self.Owner},
+		bson.M{
+			"$set": bson.M{
+				"heartbeatDate": now,
+				"expiresDate":   now.Add(self.TTL),
+			},
+		})
+}
+
+func (self *Lease) Release() error {
+	if self.stop == nil {
+		return errors.New("Lease not held")
+	}
+	close(self.stop)
+	self.wg.Wait()
+	self.stop = nil
+
+	collection := self.db.mongoBroker.leaseCollection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	err := collection.Remove(bson.M{"_id": self.Name, "owner": self.Owner})
+	if err == mgo.ErrNotFound {
+		// Somebody took it over already, nothing to release
+		return nil
+	}
+	return err
+}
+
+func (self *Lease) Lost() <-chan struct{} {
+	return self.lost
+}
+
+func leaseOwnerId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), bson.NewObjectId().Hex())
+}
@@ -0,0 +1,95 @@
+package home
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestFileLock(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	first := NewFileLock(path)
+	second := NewFileLock(path)
+
+	if got, err := first.Acquire(); !got || err != nil {
+		t.Fatalf("first.Acquire() == %v, %v, expected true, nil", got, err)
+	}
+	if got, err := second.Acquire(); got || err != nil {
+		t.Fatalf("second.Acquire() while held == %v, %v, expected false, nil", got, err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatalf("first.Release() == %v", err)
+	}
+	if got, err := second.Acquire(); !got || err != nil {
+		t.Fatalf("second.Acquire() after release == %v, %v, expected true, nil", got, err)
+	}
+	second.Release()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("lock file should be left behind: %v", err)
+	}
+}
+
+func TestAcquireProcessLock(t *testing.T) {
+
+	name := "test-" + filepath.Base(t.TempDir())
+
+	first, err := AcquireProcessLock("file", name, nil)
+	if err != nil {
+		t.Fatalf("AcquireProcessLock() == %v, expected the lock", err)
+	}
+	defer os.Remove(filepath.Join(os.TempDir(), "photochem-"+name+".lock"))
+
+	if _, err := AcquireProcessLock("file", name, nil); err != ErrLockHeld {
+		t.Errorf("AcquireProcessLock() while held == %v, expected ErrLockHeld", err)
+	}
+	first.Release()
+
+	if _, err := AcquireProcessLock("carrier-pigeon", name, nil); err == nil || err == ErrLockHeld {
+		t.Errorf("AcquireProcessLock() with an unknown type == %v, expected an error", err)
+	}
+}
+
+func TestLeaseHeartbeat(t *testing.T) {
+
+	type inOut struct {
+		renewErr error
+		lost     bool
+	}
+
+	cases := []inOut{
+		{nil, false},
+		// Taken over
+		{mgo.ErrNotFound, true},
+		// Can't reach the database, it runs out
+		{errors.New("no reachable servers"), true},
+	}
+
+	for _, c := range cases {
+		lease := &Lease{Name: "test", Owner: "me", TTL: 30 * time.Millisecond}
+		lease.lost = make(chan struct{})
+		lease.stop = make(chan struct{})
+		lease.wg.Add(1)
+		go lease.heartbeat(time.Now(), func() error { return c.renewErr })
+
+		select {
+		case <-lease.Lost():
+			if !c.lost {
+				t.Errorf("heartbeat() renewing with %v lost the lease", c.renewErr)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if c.lost {
+				t.Errorf("heartbeat() renewing with %v kept the lease", c.renewErr)
+			}
+		}
+		close(lease.stop)
+		lease.wg.Wait()
+	}
+}
@@ -0,0 +1,270 @@
+package home
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const MarketSnapshotCollectionName = "MarketSnapshots"
+
+// Market snapshot area types
+const (
+	AreaZip  = "zip"
+	AreaCity = "city"
+)
+
+// MarketSnapshot is one day of market numbers for a zip or city
+type MarketSnapshot struct {
+	Id bson.ObjectId `bson:"_id,omitempty"`
+	// Midnight UTC of the day
+	Date     time.Time `bson:"date"`
+	AreaType string    `bson:"areaType"`
+	// The zip, or the city as "City, ST"
+	Area string `bson:"area"`
+
+	// For sale at the time of the snapshot
+	Active int `bson:"active"`
+	// Came on the market, or went off it, during the day
+	New      int `bson:"new"`
+	Delisted int `bson:"delisted"`
+
+	MedianPrice        uint      `bson:"medianPrice"`
+	MedianPricePerSqFt float64   `bson:"medianPricePerSqFt"`
+	CreatedDate        time.Time `bson:"createdDate"`
+}
+
+// CityArea is how cities are named in snapshots
+func CityArea(city, state string) string {
+	return city + ", " + state
+}
+
+// SnapshotMarket computes the day's numbers for every zip and city,
+// and saves them, replacing any snapshot already taken for the day.
+// Events are counted over the whole UTC day, so give it a finished one,
+// see LastMarketDay. Inventory and prices are as of now, so it's meant
+// to run daily, soon after midnight UTC. Only one listing per property
+// is counted.
+func (self *DB) SnapshotMarket(day time.Time) ([]MarketSnapshot, error) {
+
+	day = marketDay(day)
+	counter := newMarketCounter(day)
+
+	listings := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(listings)
+
+	iter := listings.Find(bson.M{"isDuplicate": bson.M{"$ne": true}}).
+		Select(bson.M{
+			"isForSale":                1,
+			"properties.currentPrice":  1,
+			"properties.squareFeet":    1,
+			"properties.address.zip":   1,
+			"properties.address.city":  1,
+			"properties.address.state": 1,
+		}).
+		Iter()
+	listing := Listing{}
+	for iter.Next(&listing) {
+		counter.addListing(listing)
+		listing = Listing{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	history := self.mongoBroker.historyCollection()
+	defer self.mongoBroker.closeCollection(history)
+
+	iter = history.Find(bson.M{
+		"date": marketDayRange(day),
+		"type": bson.M{"$in": []string{EventCreated, EventOnMarket, EventOffMarket}},
+	}).Iter()
+	event := ListingEvent{}
+	for iter.Next(&event) {
+		counter.addEvent(event)
+		event = ListingEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	snapshots := counter.snapshots()
+
+	collection := self.mongoBroker.marketSnapshotCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	for _, snapshot := range snapshots {
+		_, err := collection.Upsert(
+			bson.M{"date": snapshot.Date, "areaType": snapshot.AreaType, "area": snapshot.Area},
+			snapshot,
+		)
+		if err != nil {
+			return snapshots, err
+		}
+	}
+
+	return snapshots, nil
+}
+
+// GetMarketTrend returns the area's snapshots from one day to another,
+// oldest first
+func (self *DB) GetMarketTrend(areaType, area string, from, to time.Time) ([]MarketSnapshot, error) {
+	collection := self.mongoBroker.marketSnapshotCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	snapshots := []MarketSnapshot{}
+	err := collection.Find(bson.M{
+		"areaType": areaType,
+		"area":     area,
+		"date":     bson.M{"$gte": marketDay(from), "$lte": marketDay(to)},
+	}).Sort("date").All(&snapshots)
+	return snapshots, err
+}
+
+func (self *DB) ensureMarketIndexes() {
+	collection := self.mongoBroker.marketSnapshotCollection()
+	defer self.mongoBroker.closeCollection(collection)
+	collection.EnsureIndex(mgo.Index{Key: []string{"areaType", "area", "date"}, Unique: true})
+}
+
+// LastMarketDay is the last whole UTC day before now, the one to
+// snapshot
+func LastMarketDay(now time.Time) time.Time {
+	return marketDay(now).AddDate(0, 0, -1)
+}
+
+// marketDay is midnight UTC of the day
+func marketDay(date time.Time) time.Time {
+	return date.UTC().Truncate(24 * time.Hour)
+}
+
+// marketDayRange matches times in the day, from its midnight up to the
+// next one
+func marketDayRange(day time.Time) bson.M {
+	day = marketDay(day)
+	return bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}
+}
+
+type marketArea struct {
+	areaType, area string
+}
+
+type marketAreaCounts struct {
+	active, new, delisted int
+	prices                []uint
+	pricesPerSqFt         []float64
+}
+
+type marketCounter struct {
+	day     time.Time
+	areas   map[marketArea]*marketAreaCounts
+	listing map[bson.ObjectId][]marketArea
+}
+
+func newMarketCounter(day time.Time) *marketCounter {
+	return &marketCounter{
+		day:     day,
+		areas:   make(map[marketArea]*marketAreaCounts),
+		listing: make(map[bson.ObjectId][]marketArea),
+	}
+}
+
+func (self *marketCounter) area(key marketArea) *marketAreaCounts {
+	counts, found := self.areas[key]
+	if !found {
+		counts = &marketAreaCounts{}
+		self.areas[key] = counts
+	}
+	return counts
+}
+
+func (self *marketCounter) addListing(listing Listing) {
+	address := listing.Properties.Address
+
+	var areas []marketArea
+	if address.Zip != "" {
+		areas = append(areas, marketArea{AreaZip, address.Zip})
+	}
+	if address.City != "" && address.State != "" {
+		areas = append(areas, marketArea{AreaCity, CityArea(address.City, address.State)})
+	}
+	// Remembered for matching up the day's events
+	self.listing[listing.Id] = areas
+
+	if !listing.ForSale {
+		return
+	}
+	price := listing.Properties.CurrentPrice
+	squareFeet := listing.Properties.SquareFeet
+	for _, key := range areas {
+		counts := self.area(key)
+		counts.active++
+		if price != 0 {
+			counts.prices = append(counts.prices, price)
+			if squareFeet != 0 {
+				counts.pricesPerSqFt = append(counts.pricesPerSqFt, float64(price)/float64(squareFeet))
+			}
+		}
+	}
+}
+
+// addEvent counts the event against the listing's areas, events for
+// listings that weren't added (duplicates) are skipped
+func (self *marketCounter) addEvent(event ListingEvent) {
+	for _, key := range self.listing[event.ListingId] {
+		switch event.Type {
+		case EventCreated, EventOnMarket:
+			self.area(key).new++
+		case EventOffMarket:
+			self.area(key).delisted++
+		}
+	}
+}
+
+// snapshots by area type, then area
+func (self *marketCounter) snapshots() []MarketSnapshot {
+	keys := make([]marketArea, 0, len(self.areas))
+	for key := range self.areas {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].areaType != keys[j].areaType {
+			return keys[i].areaType < keys[j].areaType
+		}
+		return keys[i].area < keys[j].area
+	})
+
+	now := time.Now()
+	snapshots := make([]MarketSnapshot, len(keys))
+	for i, key := range keys {
+		counts := self.areas[key]
+		snapshot := MarketSnapshot{
+			Date:        self.day,
+			AreaType:    key.areaType,
+			Area:        key.area,
+			Active:      counts.active,
+			New:         counts.new,
+			Delisted:    counts.delisted,
+			CreatedDate: now,
+		}
+		if len(counts.prices) > 0 {
+			sort.Slice(counts.prices, func(i, j int) bool { return counts.prices[i] < counts.prices[j] })
+			snapshot.MedianPrice = medianPrice(counts.prices)
+		}
+		if len(counts.pricesPerSqFt) > 0 {
+			sort.Float64s(counts.pricesPerSqFt)
+			middle := len(counts.pricesPerSqFt) / 2
+			median := counts.pricesPerSqFt[middle]
+			if len(counts.pricesPerSqFt)%2 == 0 {
+				median = (counts.pricesPerSqFt[middle-1] + median) / 2
+			}
+			// To the cent
+			snapshot.MedianPricePerSqFt = math.Round(median*100) / 100
+		}
+		snapshots[i] = snapshot
+	}
+	return snapshots
+}
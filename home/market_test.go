@@ -0,0 +1,119 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMarketCounter(t *testing.T) {
+
+	listing := func(forSale bool, price, squareFeet uint, city, zip string) Listing {
+		return Listing{
+			Id:      bson.NewObjectId(),
+			ForSale: forSale,
+			Properties: ListingProperties{
+				CurrentPrice: price,
+				SquareFeet:   squareFeet,
+				Address:      ListingAddress{City: city, State: "CO", Zip: zip},
+			},
+		}
+	}
+
+	listings := []Listing{
+		listing(true, 300000, 1500, "Denver", "80203"),
+		listing(true, 500000, 2000, "Denver", "80203"),
+		listing(true, 400000, 0, "Denver", "80205"),
+		listing(false, 900000, 3000, "Denver", "80205"),
+	}
+
+	day := marketDay(time.Date(2020, 3, 14, 15, 0, 0, 0, time.UTC))
+	counter := newMarketCounter(day)
+	for _, l := range listings {
+		counter.addListing(l)
+	}
+	counter.addEvent(ListingEvent{ListingId: listings[1].Id, Type: EventCreated})
+	counter.addEvent(ListingEvent{ListingId: listings[3].Id, Type: EventOffMarket})
+	// Not a listing it knows, ie: a duplicate
+	counter.addEvent(ListingEvent{ListingId: bson.NewObjectId(), Type: EventCreated})
+
+	type inOut struct {
+		areaType, area        string
+		active, new, delisted int
+		medianPrice           uint
+		medianPricePerSqFt    float64
+	}
+
+	cases := []inOut{
+		{AreaCity, "Denver, CO", 3, 1, 1, 400000, 225},
+		{AreaZip, "80203", 2, 1, 0, 400000, 225},
+		{AreaZip, "80205", 1, 0, 1, 400000, 0},
+	}
+
+	snapshots := counter.snapshots()
+	if len(snapshots) != len(cases) {
+		t.Fatalf("snapshots() == %+v, expected %d", snapshots, len(cases))
+	}
+	for i, c := range cases {
+		got := snapshots[i]
+		if got.AreaType != c.areaType || got.Area != c.area || got.Active != c.active || got.New != c.new ||
+			got.Delisted != c.delisted || got.MedianPrice != c.medianPrice || got.MedianPricePerSqFt != c.medianPricePerSqFt {
+			t.Errorf("snapshot %d == %+v, expected %+v", i, got, c)
+		}
+		if !got.Date.Equal(time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("snapshot date == %v, expected midnight of the day", got.Date)
+		}
+	}
+}
+
+func TestLastMarketDay(t *testing.T) {
+
+	denver := time.FixedZone("MST", -7*60*60)
+
+	type inOut struct {
+		now    time.Time
+		expect time.Time
+	}
+
+	cases := []inOut{
+		{time.Date(2020, 3, 15, 0, 5, 0, 0, time.UTC), time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)},
+		// Right at midnight the day before is the finished one
+		{time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 3, 14, 23, 59, 59, 0, time.UTC), time.Date(2020, 3, 13, 0, 0, 0, 0, time.UTC)},
+		// Evening in Denver is already the next day in UTC
+		{time.Date(2020, 3, 14, 18, 0, 0, 0, denver), time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 3, 1, 1, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		if got := LastMarketDay(c.now); !got.Equal(c.expect) {
+			t.Errorf("LastMarketDay(%v) == %v, expected %v", c.now, got, c.expect)
+		}
+	}
+}
+
+func TestMarketDayRange(t *testing.T) {
+
+	dayRange := marketDayRange(time.Date(2020, 3, 14, 15, 0, 0, 0, time.UTC))
+	from, to := dayRange["$gte"].(time.Time), dayRange["$lt"].(time.Time)
+
+	type inOut struct {
+		date   time.Time
+		expect bool
+	}
+
+	cases := []inOut{
+		{time.Date(2020, 3, 13, 23, 59, 59, 999999999, time.UTC), false},
+		{time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 3, 14, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 3, 14, 23, 59, 59, 999999999, time.UTC), true},
+		{time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, c := range cases {
+		if got := !c.date.Before(from) && c.date.Before(to); got != c.expect {
+			t.Errorf("%v in the day == %v, expected %v", c.date, got, c.expect)
+		}
+	}
+}
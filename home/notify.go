@@ -0,0 +1,312 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Notifier delivers saved search alerts
+type Notifier interface {
+	// Notify sends the alert to wherever the search asked for, searches
+	// with nowhere for this notifier to send to are skipped.
+	Notify(search SavedSearch, alert SearchAlert) error
+}
+
+// Notifier providers
+const (
+	NotifierNone = ""
+	// Just prints alerts, for trying things out locally
+	NotifierLog = "log"
+	// Webhooks, and email if there's an smtp server
+	NotifierLive = "live"
+)
+
+// NewNotifier builds the notifier for the provider, email only goes out
+// from the live one if it's given an smtp server. Returns nil for no
+// provider.
+func NewNotifier(provider, smtpAddr, smtpFrom, smtpUser, smtpPassword string) (Notifier, error) {
+	switch provider {
+	case NotifierNone:
+		return nil, nil
+	case NotifierLog:
+		return &LogNotifier{}, nil
+	case NotifierLive:
+		notifiers := MultiNotifier{NewWebhookNotifier()}
+		if smtpAddr != "" {
+			notifiers = append(notifiers, NewSmtpNotifier(smtpAddr, smtpFrom, smtpUser, smtpPassword))
+		}
+		return notifiers, nil
+	}
+	return nil, fmt.Errorf("Unknown notifier: %q", provider)
+}
+
+// Multi Notifier
+
+// MultiNotifier hands the alert to each of its notifiers, failing if
+// any of them do
+type MultiNotifier []Notifier
+
+func (self MultiNotifier) Notify(search SavedSearch, alert SearchAlert) error {
+	var messages []string
+	for _, notifier := range self {
+		if err := notifier.Notify(search, alert); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// Webhook Notifier
+
+// WebhookNotifier posts the alert as json to the search's webhook
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+func NewWebhookNotifier() *WebhookNotifier {
+	return &WebhookNotifier{Client: NewWebhookClient(10 * time.Second)}
+}
+
+// The body posted to webhooks
+type AlertPayload struct {
+	AlertId    string                `json:"alertId"`
+	SearchId   string                `json:"searchId"`
+	SearchName string                `json:"searchName"`
+	UserId     string                `json:"userId"`
+	Listings   []AlertPayloadListing `json:"listings"`
+	Date       time.Time             `json:"date"`
+}
+
+type AlertPayloadListing struct {
+	Id       string `json:"id"`
+	Href     string `json:"href"`
+	Reason   string `json:"reason"`
+	Price    uint   `json:"price"`
+	OldPrice uint   `json:"oldPrice,omitempty"`
+}
+
+func NewAlertPayload(alert SearchAlert) AlertPayload {
+	payload := AlertPayload{
+		AlertId:    alert.Id.Hex(),
+		SearchId:   alert.SearchId.Hex(),
+		SearchName: alert.SearchName,
+		UserId:     alert.UserId,
+		Listings:   make([]AlertPayloadListing, len(alert.Listings)),
+		Date:       alert.CreatedDate,
+	}
+	for i, listing := range alert.Listings {
+		payload.Listings[i] = AlertPayloadListing{
+			Id:       listing.ListingId.Hex(),
+			Href:     listing.Url,
+			Reason:   listing.Reason,
+			Price:    listing.Price,
+			OldPrice: listing.OldPrice,
+		}
+	}
+	return payload
+}
+
+func (self *WebhookNotifier) Notify(search SavedSearch, alert SearchAlert) error {
+	if search.Webhook == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(NewAlertPayload(alert))
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.Client.Post(search.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with: %s", resp.Status)
+	}
+	return nil
+}
+
+// Webhook Urls
+
+// Webhooks are given by users, so they can't be pointed back in at
+// the servers and network this runs on.
+
+var ErrPrivateAddress = errors.New("Webhooks can't go to private or loopback addresses")
+
+// CheckWebhookUrl returns an error if the url isn't http(s), or its host
+// is, or resolves to, a private or loopback address. Addresses are
+// checked again when connecting, see NewWebhookClient, in case the host
+// changes where it points.
+func CheckWebhookUrl(rawUrl string) error {
+	target, err := url.Parse(rawUrl)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return fmt.Errorf("Invalid webhook url: %q", rawUrl)
+	}
+
+	ips := []net.IP{net.ParseIP(target.Hostname())}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(target.Hostname())
+		if err != nil {
+			return fmt.Errorf("Can't resolve webhook host: %q", target.Hostname())
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// NewWebhookClient is an http client that won't connect to private or
+// loopback addresses, redirects included
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// webhookDialControl runs after the host is resolved, right before
+// connecting
+func webhookDialControl(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// CheckEmail returns an error unless it's a bare email address, no name
+// or anything else that would end up in the mail headers
+func CheckEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return fmt.Errorf("Invalid email address: %q", email)
+	}
+	return nil
+}
+
+// Smtp Notifier
+
+// SmtpNotifier emails the alert to the search's email address
+type SmtpNotifier struct {
+	// host:port
+	Addr string
+	From string
+	// Nil for servers that don't need a login
+	Auth smtp.Auth
+
+	// Swapped out in tests
+	send func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewSmtpNotifier(addr, from, user, password string) *SmtpNotifier {
+	notifier := &SmtpNotifier{Addr: addr, From: from, send: smtp.SendMail}
+	if user != "" {
+		host := strings.Split(addr, ":")[0]
+		notifier.Auth = smtp.PlainAuth("", user, password, host)
+	}
+	return notifier
+}
+
+func (self *SmtpNotifier) Notify(search SavedSearch, alert SearchAlert) error {
+	if search.Email == "" {
+		return nil
+	}
+	send := self.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(self.Addr, self.Auth, self.From, []string{search.Email}, alertEmail(self.From, search.Email, alert))
+}
+
+var alertReasons = map[string]string{
+	EventCreated:  "New",
+	EventOnMarket: "Back on the market",
+	EventPrice:    "Price change",
+}
+
+// alertEmail is a plain text message, headers and all
+func alertEmail(from, to string, alert SearchAlert) []byte {
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", from)
+	fmt.Fprintf(message, "To: %s\r\n", to)
+	fmt.Fprintf(message, "Subject: %d new for your search %q\r\n", len(alert.Listings), alert.SearchName)
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+
+	for _, listing := range alert.Listings {
+		fmt.Fprintf(message, "%s: $%d", alertReasons[listing.Reason], listing.Price)
+		if listing.OldPrice != 0 {
+			fmt.Fprintf(message, " (was $%d)", listing.OldPrice)
+		}
+		fmt.Fprintf(message, "\r\n%s\r\n\r\n", listing.Url)
+	}
+	return message.Bytes()
+}
+
+// Local stand-ins
+
+// LogNotifier prints alerts instead of sending them
+type LogNotifier struct{}
+
+func (self *LogNotifier) Notify(search SavedSearch, alert SearchAlert) error {
+	fmt.Printf("[INFO] Alert for search %q (%s): %d listings, webhook: %q, email: %q\n",
+		search.Name, search.Id.Hex(), len(alert.Listings), search.Webhook, search.Email)
+	for _, listing := range alert.Listings {
+		fmt.Printf("[INFO]   %s %d %s\n", listing.Reason, listing.Price, listing.Url)
+	}
+	return nil
+}
+
+// MemoryNotifier keeps what it was sent, for tests, it's safe to share
+// between goroutines
+type MemoryNotifier struct {
+	// Returned from Notify, if set
+	Err error
+
+	mu   sync.Mutex
+	sent []SearchAlert
+}
+
+func (self *MemoryNotifier) Notify(search SavedSearch, alert SearchAlert) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.Err != nil {
+		return self.Err
+	}
+	self.sent = append(self.sent, alert)
+	return nil
+}
+
+func (self *MemoryNotifier) Sent() []SearchAlert {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]SearchAlert{}, self.sent...)
+}
@@ -0,0 +1,208 @@
+package home
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	OutboxCollectionName = "Outbox"
+	// Holds the last seq handed out, see ChangeEvent
+	OutboxSequenceCollectionName = "OutboxSequence"
+
+	// How long change events are kept around, for slow consumers
+	OutboxRetention = 7 * 24 * time.Hour
+	// How long a missing seq is waited on, see GetChangesAfter
+	OutboxGapWait = 30 * time.Second
+)
+
+// Change event types
+const (
+	ChangeCreated = "listing.created"
+	ChangePrice   = "listing.price"
+	ChangeStatus  = "listing.status"
+	ChangePhotos  = "listing.photos"
+)
+
+var ChangeTypes = []string{ChangeCreated, ChangePrice, ChangeStatus, ChangePhotos}
+
+// ChangeEvent is a change to a listing, written to the outbox as the
+// listing is saved, for the webhook dispatcher and anything else that
+// wants to follow along. Seq numbers the events one after the other,
+// across processes, in the order they were handed out. Ids don't order
+// them, they're made on each crawler.
+type ChangeEvent struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	Seq       int64         `bson:"seq"`
+	Type      string        `bson:"type"`
+	ListingId bson.ObjectId `bson:"listingId"`
+	Url       string        `bson:"url"`
+	Price     uint          `bson:"price"`
+	OldPrice  uint          `bson:"oldPrice,omitempty"`
+	ForSale   bool          `bson:"isForSale"`
+	// The photos added, for photo events
+	Photos []string  `bson:"photos,omitempty"`
+	Date   time.Time `bson:"date"`
+
+	// Handed out to the webhooks yet
+	FannedOut bool `bson:"fannedOut"`
+}
+
+// changeEvents are the events for a listing going from one state to
+// another, new listings are only a created event
+func changeEvents(previous listingState, hadPrevious bool, current listingState) []ChangeEvent {
+	base := ChangeEvent{Url: current.Url, Price: current.Price, ForSale: current.ForSale}
+
+	if !hadPrevious {
+		created := base
+		created.Type = ChangeCreated
+		created.Photos = current.Images
+		return []ChangeEvent{created}
+	}
+
+	var events []ChangeEvent
+	if previous.Price != current.Price {
+		event := base
+		event.Type = ChangePrice
+		event.OldPrice = previous.Price
+		events = append(events, event)
+	}
+	if previous.ForSale != current.ForSale {
+		event := base
+		event.Type = ChangeStatus
+		events = append(events, event)
+	}
+
+	// Only saving knows the images, status updates leave them out
+	if len(current.Images) > 0 {
+		had := make(map[string]bool, len(previous.Images))
+		for _, url := range previous.Images {
+			had[url] = true
+		}
+		var added []string
+		for _, url := range current.Images {
+			if !had[url] {
+				added = append(added, url)
+			}
+		}
+		if len(added) > 0 {
+			event := base
+			event.Type = ChangePhotos
+			event.Photos = added
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// emitChanges writes the listing's change events to the outbox, like
+// the history, problems are only logged
+func (self *DB) emitChanges(listingId bson.ObjectId, previous listingState, hadPrevious bool, current listingState) {
+	events := changeEvents(previous, hadPrevious, current)
+	if len(events) == 0 {
+		return
+	}
+
+	collection := self.mongoBroker.outboxCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	seq, err := self.nextChangeSeqs(len(events))
+	if err != nil {
+		fmt.Println("[ERR] Problem numbering listing changes for the outbox: ", err)
+		return
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, len(events))
+	for i, event := range events {
+		event.Id = bson.NewObjectId()
+		event.Seq = seq + int64(i)
+		event.ListingId = listingId
+		event.Date = now
+		docs[i] = event
+	}
+	if err := collection.Insert(docs...); err != nil {
+		fmt.Println("[ERR] Problem writing listing changes to the outbox: ", err)
+	}
+}
+
+// nextChangeSeqs reserves count seqs, returning the first
+func (self *DB) nextChangeSeqs(count int) (int64, error) {
+	collection := self.mongoBroker.outboxSequenceCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	sequence := struct {
+		Seq int64 `bson:"seq"`
+	}{}
+	_, err := collection.FindId("outbox").Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": count}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &sequence)
+	return sequence.Seq - int64(count) + 1, err
+}
+
+// GetChangesAfter returns up to limit change events after the seq,
+// in seq order. 0 starts from the oldest kept.
+//
+// Seqs are handed out before the events are written, so one can show
+// up before the one ahead of it. Events past a missing seq are held
+// back, until the missing one shows up or OutboxGapWait goes by and it
+// isn't coming, so following along by seq doesn't skip any.
+func (self *DB) GetChangesAfter(afterSeq int64, limit int) ([]ChangeEvent, error) {
+	collection := self.mongoBroker.outboxCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	events := []ChangeEvent{}
+	err := collection.Find(bson.M{"seq": bson.M{"$gt": afterSeq}}).Sort("seq").Limit(limit).All(&events)
+	if err != nil {
+		return nil, err
+	}
+	return settledChanges(afterSeq, events, time.Now()), nil
+}
+
+// settledChanges are the events up to the first missing seq, one that
+// might still be on its way
+func settledChanges(afterSeq int64, events []ChangeEvent, now time.Time) []ChangeEvent {
+	next := afterSeq + 1
+	for i, event := range events {
+		if event.Seq != next && now.Sub(event.Date) < OutboxGapWait {
+			return events[:i]
+		}
+		next = event.Seq + 1
+	}
+	return events
+}
+
+// LastChangeSeq is the seq of the newest change event, 0 if there
+// aren't any
+func (self *DB) LastChangeSeq() (int64, error) {
+	collection := self.mongoBroker.outboxCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	event := ChangeEvent{}
+	err := collection.Find(nil).Sort("-seq").Select(bson.M{"seq": 1}).One(&event)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return event.Seq, err
+}
+
+func (self *DB) ensureOutboxIndexes() {
+	outbox := self.mongoBroker.outboxCollection()
+	defer self.mongoBroker.closeCollection(outbox)
+	outbox.EnsureIndex(mgo.Index{Key: []string{"date"}, ExpireAfter: OutboxRetention})
+	outbox.EnsureIndex(mgo.Index{Key: []string{"seq"}})
+	outbox.EnsureIndex(mgo.Index{Key: []string{"fannedOut", "seq"}})
+
+	deliveries := self.mongoBroker.webhookDeliveryCollection()
+	defer self.mongoBroker.closeCollection(deliveries)
+	deliveries.EnsureIndex(mgo.Index{Key: []string{"status", "nextAttemptDate"}})
+	deliveries.EnsureIndex(mgo.Index{Key: []string{"webhookId", "status"}})
+	// One delivery per event per webhook, see fanOut
+	deliveries.EnsureIndex(mgo.Index{Key: []string{"eventId", "webhookId"}, Unique: true})
+}
@@ -0,0 +1,392 @@
+package home
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	PropertyCollectionName = "Properties"
+	// How close two listings have to be to count as the same house,
+	// only used for locations that came from the page or the rooftop
+	PropertyMatchDistance = 25
+)
+
+// Property is the house behind one or more listings, the same house
+// gets listed on more than one site.
+type Property struct {
+	Id         bson.ObjectId   `bson:"_id,omitempty"`
+	ListingIds []bson.ObjectId `bson:"listingIds"`
+	// The listing that stands in for the rest in query results
+	PrimaryId bson.ObjectId `bson:"primaryId,omitempty"`
+
+	MLS        []string `bson:"mls,omitempty"`
+	MLSKeys    []string `bson:"mlsKeys,omitempty"` // see mlsKey
+	Zip        string   `bson:"zip,omitempty"`
+	AddressKey string   `bson:"addressKey,omitempty"`
+	Unit       string   `bson:"unit,omitempty"`
+	Location   GeoJson  `bson:"geoLocation,omitempty"`
+
+	CreatedDate time.Time `bson:"createdDate"`
+	UpdatedDate time.Time `bson:"updatedDate"`
+}
+
+// Listing Model - Sources, other listings of the same property,
+// filled in by MergeDuplicates
+type ListingSource struct {
+	ListingId bson.ObjectId
+	Url       string
+	Source    string
+	ForSale   bool
+}
+
+// LinkProperty finds the property the listing is for, by MLS number,
+// normalized address, or a nearby location, or starts a new one. The
+// property then picks which of its listings is the primary one.
+func (self *DB) LinkProperty(listing Listing) (bson.ObjectId, error) {
+	collection := self.mongoBroker.propertyCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	property, found, err := self.matchProperty(collection, listing)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if !found {
+		// Upserted on the address or MLS number, so two crawlers linking
+		// the same house at once still make one property
+		selector, update := newPropertyUpsert(listing, now)
+		change := mgo.Change{Update: update, Upsert: true, ReturnNew: true}
+		_, err := collection.Find(selector).Apply(change, &property)
+		if mgo.IsDup(err) {
+			// The other one got it in first, it's there to match now
+			_, err = collection.Find(selector).Apply(change, &property)
+		}
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if err := collection.UpdateId(property.Id, propertyUpdate(property, listing, now)); err != nil {
+			return "", err
+		}
+	}
+
+	listings := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(listings)
+	err = listings.UpdateId(listing.Id, bson.M{"$set": bson.M{"propertyId": property.Id}})
+	if err != nil {
+		return property.Id, err
+	}
+
+	return property.Id, self.electPrimary(property.Id)
+}
+
+// mlsKey is the MLS number with the zip, MLS numbers are only unique
+// within a board, the zip keeps boards in different areas apart
+func mlsKey(mls, zip string) string {
+	if mls == "" || zip == "" {
+		return ""
+	}
+	return mls + "@" + zip
+}
+
+// newPropertyUpsert is the upsert for a property that wasn't matched,
+// on the address key, or the MLS number, both have unique indexes.
+// Without either there's nothing to collide on, it's always a new one.
+func newPropertyUpsert(listing Listing, now time.Time) (bson.M, bson.M) {
+	properties := listing.Properties
+	address := properties.Address
+
+	var selector bson.M
+	if key := address.Key(); key != "" {
+		selector = bson.M{"addressKey": key}
+	} else if key := mlsKey(properties.MLS, address.Zip); key != "" {
+		// Not an equality, that would start mlsKeys off as a string
+		selector = bson.M{"mlsKeys": bson.M{"$elemMatch": bson.M{"$eq": key}}}
+	} else {
+		selector = bson.M{"_id": bson.NewObjectId()}
+	}
+
+	// The address key comes from the selector. Left out when empty, so
+	// the unit: {$exists: false} match works.
+	fields := bson.M{"createdDate": now}
+	if address.Zip != "" {
+		fields["zip"] = address.Zip
+	}
+	if address.Unit != "" {
+		fields["unit"] = address.Unit
+	}
+	if preciseLocation(properties) {
+		fields["geoLocation"] = properties.Location
+	}
+
+	update := bson.M{
+		"$setOnInsert": fields,
+		"$set":         bson.M{"updatedDate": now},
+		"$addToSet":    bson.M{"listingIds": listing.Id},
+	}
+	if properties.MLS != "" {
+		update["$addToSet"].(bson.M)["mls"] = properties.MLS
+	}
+	if key := mlsKey(properties.MLS, address.Zip); key != "" {
+		update["$addToSet"].(bson.M)["mlsKeys"] = key
+	}
+	return selector, update
+}
+
+// propertyUpdate adds the listing to a property it matched
+func propertyUpdate(property Property, listing Listing, now time.Time) bson.M {
+	properties := listing.Properties
+	address := properties.Address
+
+	update := bson.M{
+		"$addToSet": bson.M{"listingIds": listing.Id},
+		"$set":      bson.M{"updatedDate": now},
+	}
+	if properties.MLS != "" {
+		update["$addToSet"].(bson.M)["mls"] = properties.MLS
+	}
+	if key := mlsKey(properties.MLS, address.Zip); key != "" {
+		update["$addToSet"].(bson.M)["mlsKeys"] = key
+	}
+	// Fill in whatever the property didn't know yet
+	if property.AddressKey == "" && address.Key() != "" {
+		update["$set"].(bson.M)["addressKey"] = address.Key()
+		update["$set"].(bson.M)["zip"] = address.Zip
+		if address.Unit != "" {
+			update["$set"].(bson.M)["unit"] = address.Unit
+		}
+	}
+	if !property.Location.IsSet() && preciseLocation(properties) {
+		update["$set"].(bson.M)["geoLocation"] = properties.Location
+	}
+	return update
+}
+
+// matchProperty tries the most reliable matches first
+func (self *DB) matchProperty(collection *mgo.Collection, listing Listing) (Property, bool, error) {
+	property := Property{}
+	address := listing.Properties.Address
+
+	// Already linked, from an earlier crawl
+	if listing.PropertyId != "" {
+		err := collection.FindId(listing.PropertyId).One(&property)
+		if err == nil {
+			return property, true, nil
+		}
+		if err != mgo.ErrNotFound {
+			return property, false, err
+		}
+	}
+
+	var selectors []bson.M
+	if mls := listing.Properties.MLS; mls != "" && address.Zip != "" {
+		// MLS numbers are only unique within a board, the zip keeps
+		// boards in different areas apart
+		selectors = append(selectors, bson.M{"mls": mls, "zip": address.Zip})
+	}
+	if key := address.Key(); key != "" {
+		selectors = append(selectors, bson.M{"addressKey": key})
+	}
+	if preciseLocation(listing.Properties) {
+		// Units in the same building share a location, so they have
+		// to match too
+		var unit interface{} = bson.M{"$exists": false}
+		if address.Unit != "" {
+			unit = address.Unit
+		}
+		selectors = append(selectors, bson.M{
+			"unit": unit,
+			"geoLocation": bson.M{
+				"$nearSphere": bson.M{
+					"$geometry":    listing.Properties.Location,
+					"$maxDistance": PropertyMatchDistance,
+				},
+			},
+		})
+	}
+
+	for _, selector := range selectors {
+		err := collection.Find(selector).One(&property)
+		if err == nil {
+			return property, true, nil
+		}
+		if err != mgo.ErrNotFound {
+			return property, false, err
+		}
+	}
+
+	return property, false, nil
+}
+
+// Zip centroids and the like are too rough to match houses on
+func preciseLocation(properties ListingProperties) bool {
+	if !properties.Location.IsSet() {
+		return false
+	}
+	switch properties.GeocodePrecision {
+	case PrecisionPage, PrecisionRooftop:
+		return true
+	}
+	return false
+}
+
+// electPrimary picks the listing that represents the property, the
+// most recently updated one that's for sale, or just the most recently
+// updated. The others are marked as duplicates.
+func (self *DB) electPrimary(propertyId bson.ObjectId) error {
+	listings := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(listings)
+
+	primary := Listing{}
+	err := listings.Find(bson.M{"propertyId": propertyId}).Sort("-isForSale", "-updatedDate").One(&primary)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = listings.UpdateAll(
+		bson.M{"propertyId": propertyId, "_id": bson.M{"$ne": primary.Id}},
+		bson.M{"$set": bson.M{"isDuplicate": true}},
+	)
+	if err != nil {
+		return err
+	}
+	err = listings.UpdateId(primary.Id, bson.M{"$unset": bson.M{"isDuplicate": ""}})
+	if err != nil {
+		return err
+	}
+
+	properties := self.mongoBroker.propertyCollection()
+	defer self.mongoBroker.closeCollection(properties)
+	return properties.UpdateId(propertyId, bson.M{"$set": bson.M{"primaryId": primary.Id}})
+}
+
+// propertyLink is what a listing already saved under the url is
+// linked to, since saving it again replaces the whole document
+func (self *DB) propertyLink(uri string) (bson.ObjectId, bool) {
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	listing := Listing{}
+	err := collection.Find(bson.M{"listingUrl": uri}).Select(bson.M{"propertyId": 1, "isDuplicate": 1}).One(&listing)
+	if err != nil {
+		return "", false
+	}
+	return listing.PropertyId, listing.Duplicate
+}
+
+// reelectPrimary is for after a listing's status changes, since the
+// primary should be one that's still for sale
+func (self *DB) reelectPrimary(selector bson.M) {
+	listings := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(listings)
+
+	listing := Listing{}
+	if err := listings.Find(selector).Select(bson.M{"propertyId": 1}).One(&listing); err != nil || listing.PropertyId == "" {
+		return
+	}
+	if err := self.electPrimary(listing.PropertyId); err != nil {
+		fmt.Println("[ERR] Problem picking primary listing: ", err)
+	}
+}
+
+// LinkProperties links listings that aren't linked to a property yet,
+// up to limit of them (0 for all). Returns how many were linked.
+func (self *DB) LinkProperties(limit int) (int, error) {
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	query := collection.Find(bson.M{"propertyId": bson.M{"$exists": false}}).Sort("_id")
+	if limit != 0 {
+		query.Limit(limit)
+	}
+
+	var listings []Listing
+	if err := query.All(&listings); err != nil {
+		return 0, err
+	}
+
+	for linked, listing := range listings {
+		if _, err := self.LinkProperty(listing); err != nil {
+			return linked, err
+		}
+	}
+	return len(listings), nil
+}
+
+// MergeDuplicates fills in the other sources of each listing's
+// property, and merges in their images.
+func (self *DB) MergeDuplicates(listings []Listing) error {
+
+	var propertyIds []bson.ObjectId
+	for _, listing := range listings {
+		if listing.PropertyId != "" {
+			propertyIds = append(propertyIds, listing.PropertyId)
+		}
+	}
+	if len(propertyIds) == 0 {
+		return nil
+	}
+
+	collection := self.mongoBroker.listingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	var linked []Listing
+	err := collection.Find(bson.M{"propertyId": bson.M{"$in": propertyIds}}).Sort("-isForSale", "-updatedDate").All(&linked)
+	if err != nil {
+		return err
+	}
+
+	byProperty := make(map[bson.ObjectId][]Listing)
+	for _, listing := range linked {
+		byProperty[listing.PropertyId] = append(byProperty[listing.PropertyId], listing)
+	}
+
+	for i := range listings {
+		if listings[i].PropertyId != "" {
+			mergeListing(&listings[i], byProperty[listings[i].PropertyId])
+		}
+	}
+	return nil
+}
+
+// mergeListing adds the sources and images of the duplicates
+func mergeListing(listing *Listing, duplicates []Listing) {
+	listing.Sources = []ListingSource{{
+		ListingId: listing.Id,
+		Url:       listing.Url,
+		Source:    listing.Source,
+		ForSale:   listing.ForSale,
+	}}
+
+	seen := make(map[string]bool)
+	for _, image := range listing.Images {
+		seen[image.Url] = true
+	}
+
+	for _, duplicate := range duplicates {
+		if duplicate.Id == listing.Id {
+			continue
+		}
+		listing.Sources = append(listing.Sources, ListingSource{
+			ListingId: duplicate.Id,
+			Url:       duplicate.Url,
+			Source:    duplicate.Source,
+			ForSale:   duplicate.ForSale,
+		})
+		for _, image := range duplicate.Images {
+			if !seen[image.Url] {
+				seen[image.Url] = true
+				listing.Images = append(listing.Images, image)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package home
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMergeListing(t *testing.T) {
+
+	primary := Listing{Id: bson.NewObjectId(), Url: "https://a.example/1", ForSale: true,
+		Images: []ListingImage{{Url: "https://img/1.jpg"}, {Url: "https://img/2.jpg"}}}
+	other := Listing{Id: bson.NewObjectId(), Url: "https://b.example/9",
+		Images: []ListingImage{{Url: "https://img/2.jpg"}, {Url: "https://img/3.jpg"}}}
+
+	merged := primary
+	mergeListing(&merged, []Listing{primary, other})
+
+	if len(merged.Sources) != 2 || merged.Sources[0].ListingId != primary.Id || merged.Sources[1].Url != other.Url {
+		t.Errorf("Sources == %+v, expected the primary then the other listing", merged.Sources)
+	}
+
+	urls := []string{}
+	for _, image := range merged.Images {
+		urls = append(urls, image.Url)
+	}
+	if len(urls) != 3 || urls[2] != "https://img/3.jpg" {
+		t.Errorf("Images == %v, expected the 3 distinct images", urls)
+	}
+}
+
+func TestPreciseLocation(t *testing.T) {
+
+	type inOut struct {
+		properties ListingProperties
+		precise    bool
+	}
+
+	cases := []inOut{
+		{ListingProperties{Location: NewGeoJsonPoint(-104.9, 39.7), GeocodePrecision: PrecisionPage}, true},
+		{ListingProperties{Location: NewGeoJsonPoint(-104.9, 39.7), GeocodePrecision: PrecisionRooftop}, true},
+		{ListingProperties{Location: NewGeoJsonPoint(-104.9, 39.7), GeocodePrecision: PrecisionZip}, false},
+		{ListingProperties{Location: NewGeoJsonPoint(0, 0), GeocodePrecision: PrecisionPage}, false},
+	}
+
+	for _, c := range cases {
+		if got := preciseLocation(c.properties); got != c.precise {
+			t.Errorf("preciseLocation(%+v) == %v, expected %v", c.properties, got, c.precise)
+		}
+	}
+}
+
+func TestNewPropertyUpsert(t *testing.T) {
+
+	now := time.Now()
+	id := bson.NewObjectId()
+	street := ListingAddress{Number: "123", StreetName: "main st", Zip: "80202"}
+	unit := street
+	unit.Unit = "4b"
+	zipOnly := ListingAddress{Zip: "80202"}
+
+	type inOut struct {
+		properties ListingProperties
+		selector   bson.M
+		fields     bson.M
+		addToSet   bson.M
+	}
+
+	cases := []inOut{
+		// The address wins, no unit is left out, not set blank
+		{ListingProperties{Address: street, MLS: "9876"},
+			bson.M{"addressKey": street.Key()},
+			bson.M{"createdDate": now, "zip": "80202"},
+			bson.M{"listingIds": id, "mls": "9876", "mlsKeys": "9876@80202"}},
+		{ListingProperties{Address: unit},
+			bson.M{"addressKey": unit.Key()},
+			bson.M{"createdDate": now, "zip": "80202", "unit": "4b"},
+			bson.M{"listingIds": id}},
+		// Then the MLS number
+		{ListingProperties{Address: zipOnly, MLS: "9876"},
+			bson.M{"mlsKeys": bson.M{"$elemMatch": bson.M{"$eq": "9876@80202"}}},
+			bson.M{"createdDate": now, "zip": "80202"},
+			bson.M{"listingIds": id, "mls": "9876", "mlsKeys": "9876@80202"}},
+	}
+
+	for _, c := range cases {
+		selector, update := newPropertyUpsert(Listing{Id: id, Properties: c.properties}, now)
+		if !reflect.DeepEqual(selector, c.selector) {
+			t.Errorf("newPropertyUpsert(%+v) selector == %v, expected %v", c.properties, selector, c.selector)
+		}
+		if !reflect.DeepEqual(update["$setOnInsert"], c.fields) || !reflect.DeepEqual(update["$addToSet"], c.addToSet) {
+			t.Errorf("newPropertyUpsert(%+v) update == %v, expected %v and %v", c.properties, update, c.fields, c.addToSet)
+		}
+	}
+
+	// Nothing to match on, always a new one
+	selector, _ := newPropertyUpsert(Listing{Id: id, Properties: ListingProperties{MLS: "9876"}}, now)
+	if _, isId := selector["_id"].(bson.ObjectId); !isId || len(selector) != 1 {
+		t.Errorf("newPropertyUpsert() without an address or zip selector == %v, expected a new id", selector)
+	}
+}
+
+func TestPropertyUpdate(t *testing.T) {
+
+	now := time.Now()
+	id := bson.NewObjectId()
+	street := ListingAddress{Number: "123", StreetName: "main st", Zip: "80202"}
+
+	// Found by location, fills in the address but leaves the unit
+	// missing, it was matched as having none
+	update := propertyUpdate(Property{Id: bson.NewObjectId()}, Listing{Id: id, Properties: ListingProperties{Address: street}}, now)
+	expect := bson.M{"updatedDate": now, "addressKey": street.Key(), "zip": "80202"}
+	if !reflect.DeepEqual(update["$set"], expect) {
+		t.Errorf("propertyUpdate() $set == %v, expected %v", update["$set"], expect)
+	}
+
+	// Nothing new about it
+	update = propertyUpdate(Property{Id: bson.NewObjectId(), AddressKey: street.Key()}, Listing{Id: id, Properties: ListingProperties{Address: street}}, now)
+	if expect := (bson.M{"updatedDate": now}); !reflect.DeepEqual(update["$set"], expect) {
+		t.Errorf("propertyUpdate() $set == %v, expected %v", update["$set"], expect)
+	}
+}
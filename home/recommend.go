@@ -0,0 +1,355 @@
+package home
+
+import (
+	"math"
+	"sort"
+)
+
+// How much each part of a listing counts towards its recommendation
+// score, see TasteProfile.Score
+const (
+	RecommendPriceWeight    = 3.0
+	RecommendLocationWeight = 3.0
+	RecommendRoomsWeight    = 2.0
+	// Photo tags, see PhotoTags
+	RecommendTagWeight = 2.0
+	// Taken off for being like the hidden listings
+	RecommendHideWeight = 2.0
+
+	// Listings this far from the liked ones score nothing for location
+	RecommendRadiusMeters = 25000
+	// Listings twice or half the liked price score nothing for price
+	RecommendPriceRatio = 2.0
+	// Beds or baths this many off score nothing for rooms
+	RecommendRoomsRange = 2.0
+
+	// Most liked and hidden listings the profile is made from, the
+	// recent ones
+	RecommendProfileSize = 100
+	// Most listings scored for a recommendation
+	RecommendCandidateLimit = 500
+)
+
+// TasteCenter is the middle of some listings
+type TasteCenter struct {
+	// Median of the prices
+	Price uint
+	// Middle of the listings, unset without any locations
+	Location GeoJson
+	// Average of the listings that have them, 0 if none do
+	Beds  float64
+	Baths float64
+}
+
+// TasteProfile sums up the listings a user liked and hid. Listings get
+// closer to the top for being like the liked ones, and further down for
+// being like the hidden ones.
+type TasteProfile struct {
+	Likes int
+	Hides int
+
+	// Middle of the liked listings
+	TasteCenter
+	// Middle of the hidden listings
+	Hidden TasteCenter
+	// Share of liked listings with a photo tag, less the share of hidden
+	// ones, -1 to 1
+	Tags map[string]float64
+}
+
+// RecommendScore is a listing's score, and the parts it's made from, all
+// 0 to 1. Parts the profile or listing doesn't know score 0.
+type RecommendScore struct {
+	Price    float64
+	Location float64
+	Rooms    float64
+	Tags     float64
+	// How much it's like the hidden listings
+	Dislike float64
+	// Weighted average of the parts, less the dislike, so it can go
+	// under 0
+	Total float64
+}
+
+type Recommendation struct {
+	Listing Listing
+	Score   RecommendScore
+}
+
+// NewTasteProfile sums up the liked and hidden listings
+func NewTasteProfile(liked, hidden []Listing) TasteProfile {
+	profile := TasteProfile{
+		Likes:       len(liked),
+		Hides:       len(hidden),
+		TasteCenter: newTasteCenter(liked),
+		Hidden:      newTasteCenter(hidden),
+		Tags:        make(map[string]float64),
+	}
+
+	for _, listing := range liked {
+		for _, tag := range listingTags(listing) {
+			profile.Tags[tag] += 1 / float64(len(liked))
+		}
+	}
+	for _, listing := range hidden {
+		for _, tag := range listingTags(listing) {
+			profile.Tags[tag] -= 1 / float64(len(hidden))
+		}
+	}
+	return profile
+}
+
+func newTasteCenter(listings []Listing) TasteCenter {
+	center := TasteCenter{}
+
+	var prices []uint
+	var lng, lat float64
+	located := 0
+	var beds, baths float64
+	withBeds, withBaths := 0, 0
+	for _, listing := range listings {
+		properties := listing.Properties
+		if properties.CurrentPrice != 0 {
+			prices = append(prices, properties.CurrentPrice)
+		}
+		if properties.Location.IsSet() {
+			lng += properties.Location.Coordinates[0]
+			lat += properties.Location.Coordinates[1]
+			located++
+		}
+		if properties.Beds != 0 {
+			beds += float64(properties.Beds)
+			withBeds++
+		}
+		if properties.Baths != 0 {
+			baths += properties.Baths
+			withBaths++
+		}
+	}
+
+	if len(prices) > 0 {
+		sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+		center.Price = medianPrice(prices)
+	}
+	if located > 0 {
+		center.Location = NewGeoJsonPoint(lng/float64(located), lat/float64(located))
+	}
+	if withBeds > 0 {
+		center.Beds = beds / float64(withBeds)
+	}
+	if withBaths > 0 {
+		center.Baths = baths / float64(withBaths)
+	}
+	return center
+}
+
+// closeness is how near the listing's price, location and rooms are to
+// the center, 0 to 1 each
+func (self TasteCenter) closeness(listing Listing) (price, location, rooms float64) {
+	properties := listing.Properties
+
+	if self.Price != 0 && properties.CurrentPrice != 0 {
+		ratio := math.Abs(math.Log(float64(properties.CurrentPrice) / float64(self.Price)))
+		price = math.Max(0, 1-ratio/math.Log(RecommendPriceRatio))
+	}
+
+	if self.Location.IsSet() && properties.Location.IsSet() {
+		meters := distanceMeters(self.Location, properties.Location)
+		location = math.Max(0, 1-meters/RecommendRadiusMeters)
+	}
+
+	var parts []float64
+	if self.Beds != 0 && properties.Beds != 0 {
+		parts = append(parts, math.Max(0, 1-math.Abs(float64(properties.Beds)-self.Beds)/RecommendRoomsRange))
+	}
+	if self.Baths != 0 && properties.Baths != 0 {
+		parts = append(parts, math.Max(0, 1-math.Abs(properties.Baths-self.Baths)/RecommendRoomsRange))
+	}
+	for _, part := range parts {
+		rooms += part / float64(len(parts))
+	}
+	return price, location, rooms
+}
+
+// Score is how well the listing fits the profile, the same listing and
+// profile always score the same
+func (self TasteProfile) Score(listing Listing) RecommendScore {
+	score := RecommendScore{}
+	score.Price, score.Location, score.Rooms = self.TasteCenter.closeness(listing)
+
+	// Average of the listing's tags, only the ones the user likes more
+	// than not count for it
+	tags := listingTags(listing)
+	for _, tag := range tags {
+		score.Tags += self.Tags[tag] / float64(len(tags))
+	}
+	score.Tags = math.Max(0, score.Tags)
+
+	price, location, rooms := self.Hidden.closeness(listing)
+	score.Dislike = (price*RecommendPriceWeight +
+		location*RecommendLocationWeight +
+		rooms*RecommendRoomsWeight) /
+		(RecommendPriceWeight + RecommendLocationWeight + RecommendRoomsWeight)
+
+	score.Total = (score.Price*RecommendPriceWeight +
+		score.Location*RecommendLocationWeight +
+		score.Rooms*RecommendRoomsWeight +
+		score.Tags*RecommendTagWeight -
+		score.Dislike*RecommendHideWeight) /
+		(RecommendPriceWeight + RecommendLocationWeight + RecommendRoomsWeight + RecommendTagWeight)
+	return score
+}
+
+// RankListings scores the listings, best first, ties going to the newest
+func RankListings(profile TasteProfile, listings []Listing) []Recommendation {
+	ranked := make([]Recommendation, len(listings))
+	for i, listing := range listings {
+		ranked[i] = Recommendation{Listing: listing, Score: profile.Score(listing)}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score.Total != ranked[j].Score.Total {
+			return ranked[i].Score.Total > ranked[j].Score.Total
+		}
+		return ranked[i].Listing.Id > ranked[j].Listing.Id
+	})
+	return ranked
+}
+
+// Recommendations are the ranked listings, and what they were ranked by
+type Recommendations struct {
+	Listings []Recommendation
+	Profile  TasteProfile
+	// Nothing to go on, or nothing matched around the likes, so it's
+	// the newest listings
+	ColdStart bool
+}
+
+// RecommendListings ranks listings for sale the user hasn't seen yet, by
+// their likes. Candidates come from around the liked listings, at about
+// their price. Without any likes yet, or when nothing's around them, ie:
+// likes in two cities putting the middle out between them, it's the
+// newest listings.
+func (self *DB) RecommendListings(userId string, limit int) (Recommendations, error) {
+	result := Recommendations{}
+
+	liked, err := self.reactedListings(userId, ReactionLike)
+	if err != nil {
+		return result, err
+	}
+	hidden, err := self.reactedListings(userId, ReactionHide)
+	if err != nil {
+		return result, err
+	}
+	result.Profile = NewTasteProfile(liked, hidden)
+
+	var candidates []Listing
+	if result.Profile.Likes > 0 {
+		candidates, err = self.recommendCandidates(userId, liked, hidden, &result.Profile)
+		if err != nil {
+			return result, err
+		}
+	}
+	if len(candidates) == 0 {
+		result.ColdStart = true
+		candidates, err = self.recommendCandidates(userId, liked, hidden, nil)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Listings = RankListings(result.Profile, candidates)
+	if limit != 0 && len(result.Listings) > limit {
+		result.Listings = result.Listings[:limit]
+	}
+	return result, nil
+}
+
+// recommendCandidates are the unseen listings for sale around the
+// profile, or the newest ones without a profile
+func (self *DB) recommendCandidates(userId string, liked, hidden []Listing, profile *TasteProfile) ([]Listing, error) {
+	query := self.NewListingsQuery()
+	query.ForSale(true)
+	query.LimitTo(RecommendCandidateLimit)
+	if err := query.ExcludeSeenBy(userId); err != nil {
+		return nil, err
+	}
+	// Seen too, but maybe longer ago than ExcludeSeenBy goes back
+	query.Exclude(listingIds(liked)...)
+	query.Exclude(listingIds(hidden)...)
+
+	if profile != nil && profile.Location.IsSet() {
+		query.NearPoint(profile.Location.Coordinates[0], profile.Location.Coordinates[1], RecommendRadiusMeters)
+	} else {
+		query.SortBy(SortNewest)
+	}
+	if profile != nil && profile.Price != 0 {
+		query.PriceBetween(
+			uint(float64(profile.Price)/RecommendPriceRatio),
+			uint(float64(profile.Price)*RecommendPriceRatio),
+		)
+	}
+
+	candidates, _, err := query.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return *candidates, nil
+}
+
+// reactedListings gets the user's most recent listings with the reaction
+func (self *DB) reactedListings(userId, reaction string) ([]Listing, error) {
+	userListings, err := self.GetUserListings(userId, reaction, RecommendProfileSize)
+	if err != nil || len(userListings) == 0 {
+		return nil, err
+	}
+
+	ids := make([]string, len(userListings))
+	for i, userListing := range userListings {
+		ids[i] = userListing.ListingId.Hex()
+	}
+	query := self.NewListingsQuery()
+	query.Include(ids...)
+	listings, _, err := query.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return *listings, nil
+}
+
+func listingIds(listings []Listing) []string {
+	ids := make([]string, len(listings))
+	for i, listing := range listings {
+		ids[i] = listing.Id.Hex()
+	}
+	return ids
+}
+
+// distanceMeters between two points, along the earth's surface
+func distanceMeters(from, to GeoJson) float64 {
+	lng1, lat1 := toRadians(from.Coordinates[0]), toRadians(from.Coordinates[1])
+	lng2, lat2 := toRadians(to.Coordinates[0]), toRadians(to.Coordinates[1])
+
+	sinLat := math.Sin((lat2 - lat1) / 2)
+	sinLng := math.Sin((lng2 - lng1) / 2)
+	a := sinLat*sinLat + math.Cos(lat1)*math.Cos(lat2)*sinLng*sinLng
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// listingTags are the listing's photo tags, each once
+func listingTags(listing Listing) []string {
+	var tags []string
+	found := make(map[string]bool)
+	for _, image := range listing.Images {
+		for _, tag := range image.Tags {
+			if !found[tag] {
+				found[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,172 @@
+package home
+
+import (
+	"math"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTasteProfileScore(t *testing.T) {
+
+	listing := func(id string, lng, lat float64, price, beds uint, baths float64, tags ...string) Listing {
+		return Listing{
+			Id: bson.ObjectIdHex(id),
+			Properties: ListingProperties{
+				Location:     NewGeoJsonPoint(lng, lat),
+				CurrentPrice: price,
+				Beds:         beds,
+				Baths:        baths,
+			},
+			Images: []ListingImage{{Url: "http://example.com/" + id + ".jpg", Tags: tags}},
+		}
+	}
+
+	// Likes downtown Denver 3 bed 2 baths around 400k, mostly with a pool
+	liked := []Listing{
+		listing("5a0000000000000000000001", -104.990, 39.740, 300000, 3, 2, "pool"),
+		listing("5a0000000000000000000002", -104.990, 39.740, 400000, 3, 2, "pool", "kitchen"),
+		listing("5a0000000000000000000003", -104.990, 39.740, 500000, 3, 2),
+	}
+	// Hid a big carpeted one in Boulder
+	hidden := []Listing{
+		listing("5a0000000000000000000004", -105.270, 40.015, 900000, 5, 4, "carpet"),
+	}
+	profile := NewTasteProfile(liked, hidden)
+
+	if profile.Likes != 3 || profile.Hides != 1 || profile.Price != 400000 || profile.Beds != 3 || profile.Baths != 2 {
+		t.Errorf("NewTasteProfile() == %+v, expected 3 likes, 1 hide, 400000, 3 beds, 2 baths", profile)
+	}
+	if profile.Hidden.Price != 900000 || profile.Hidden.Beds != 5 || profile.Hidden.Baths != 4 {
+		t.Errorf("NewTasteProfile().Hidden == %+v, expected 900000, 5 beds, 4 baths", profile.Hidden)
+	}
+	if !closeTo(profile.Tags["pool"], 2/3.0) || !closeTo(profile.Tags["kitchen"], 1/3.0) || !closeTo(profile.Tags["carpet"], -1) {
+		t.Errorf("NewTasteProfile().Tags == %v, expected pool 2/3, kitchen 1/3, carpet -1", profile.Tags)
+	}
+
+	// 800k is a bit like the 900k they hid, 4 beds half like its 5
+	dislike := (3*(1-math.Log(900.0/800)/math.Log(2)) + 2*0.25) / 8
+
+	type inOut struct {
+		listing Listing
+		expect  RecommendScore
+	}
+
+	cases := []inOut{
+		// Right in the middle of what they like
+		{listing("5b0000000000000000000001", -104.990, 39.740, 400000, 3, 2, "pool", "kitchen"),
+			RecommendScore{Price: 1, Location: 1, Rooms: 1, Tags: 0.5, Total: (3 + 3 + 2 + 2*0.5) / 10}},
+		// Twice the price, 1 bed more, 1 bath less
+		{listing("5b0000000000000000000002", -104.990, 39.740, 800000, 4, 1, "pool"),
+			RecommendScore{Price: 0, Location: 1, Rooms: 0.5, Tags: 2 / 3.0, Dislike: dislike, Total: (3 + 2*0.5 + 2*2/3.0 - 2*dislike) / 10}},
+		// Out in Boulder, carpeted like the one they hid
+		{listing("5b0000000000000000000003", -105.270, 40.015, 400000, 3, 2, "carpet"),
+			RecommendScore{Price: 1, Location: 0, Rooms: 1, Tags: 0, Dislike: 3 / 8.0, Total: (3 + 2 - 2*3/8.0) / 10}},
+		// Nothing known about it
+		{Listing{Id: bson.ObjectIdHex("5b0000000000000000000004")}, RecommendScore{}},
+	}
+
+	for _, c := range cases {
+		got := profile.Score(c.listing)
+		if !closeTo(got.Price, c.expect.Price) || !closeTo(got.Location, c.expect.Location) ||
+			!closeTo(got.Rooms, c.expect.Rooms) || !closeTo(got.Tags, c.expect.Tags) ||
+			!closeTo(got.Dislike, c.expect.Dislike) || !closeTo(got.Total, c.expect.Total) {
+			t.Errorf("Score(%s) == %+v, expected %+v", c.listing.Id.Hex(), got, c.expect)
+		}
+	}
+}
+
+func TestTasteProfileHides(t *testing.T) {
+
+	listing := func(id string, lng, lat float64, price, beds uint, baths float64) Listing {
+		return Listing{
+			Id: bson.ObjectIdHex(id),
+			Properties: ListingProperties{
+				Location:     NewGeoJsonPoint(lng, lat),
+				CurrentPrice: price,
+				Beds:         beds,
+				Baths:        baths,
+			},
+		}
+	}
+
+	liked := []Listing{listing("5a0000000000000000000001", -104.990, 39.740, 400000, 3, 2)}
+	hidden := []Listing{listing("5a0000000000000000000002", -104.950, 39.700, 450000, 3, 2)}
+	without := NewTasteProfile(liked, nil)
+	with := NewTasteProfile(liked, hidden)
+
+	type inOut struct {
+		listing Listing
+		lower   bool
+	}
+
+	cases := []inOut{
+		// Next door to the hidden one
+		{listing("5b0000000000000000000001", -104.951, 39.701, 450000, 3, 2), true},
+		// Out of town, priced well under it, and bigger
+		{listing("5b0000000000000000000002", -105.300, 39.740, 200000, 5, 4), false},
+	}
+
+	for _, c := range cases {
+		got, expect := with.Score(c.listing).Total, without.Score(c.listing).Total
+		if c.lower && got >= expect {
+			t.Errorf("Score(%s) == %v with hides, expected under %v without", c.listing.Id.Hex(), got, expect)
+		}
+		if !c.lower && !closeTo(got, expect) {
+			t.Errorf("Score(%s) == %v with hides, expected %v as without", c.listing.Id.Hex(), got, expect)
+		}
+	}
+}
+
+func TestRankListings(t *testing.T) {
+
+	listing := func(id string, price uint) Listing {
+		return Listing{
+			Id:         bson.ObjectIdHex(id),
+			Properties: ListingProperties{CurrentPrice: price},
+		}
+	}
+
+	candidates := []Listing{
+		listing("5b0000000000000000000001", 250000),
+		listing("5b0000000000000000000002", 400000),
+		listing("5b0000000000000000000003", 600000),
+		listing("5b0000000000000000000004", 250000),
+	}
+
+	type inOut struct {
+		liked  []Listing
+		hidden []Listing
+		expect []string
+	}
+
+	cases := []inOut{
+		// Closest price first, by ratio, ties to the newest
+		{[]Listing{listing("5a0000000000000000000001", 400000)}, nil,
+			[]string{"5b0000000000000000000002", "5b0000000000000000000003", "5b0000000000000000000004", "5b0000000000000000000001"}},
+		// Cold start is newest first
+		{nil, nil,
+			[]string{"5b0000000000000000000004", "5b0000000000000000000003", "5b0000000000000000000002", "5b0000000000000000000001"}},
+		// Hidden prices go to the bottom, the further away the better
+		{nil, []Listing{listing("5a0000000000000000000002", 250000)},
+			[]string{"5b0000000000000000000003", "5b0000000000000000000002", "5b0000000000000000000004", "5b0000000000000000000001"}},
+	}
+
+	for _, c := range cases {
+		ranked := RankListings(NewTasteProfile(c.liked, c.hidden), candidates)
+		got := make([]string, len(ranked))
+		for i, recommendation := range ranked {
+			got[i] = recommendation.Listing.Id.Hex()
+		}
+		for i := range c.expect {
+			if got[i] != c.expect[i] {
+				t.Errorf("RankListings() == %v, expected %v", got, c.expect)
+				break
+			}
+		}
+	}
+}
+
+func closeTo(got, expect float64) bool {
+	return math.Abs(got-expect) < 0.0001
+}
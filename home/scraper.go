@@ -30,6 +30,9 @@ var fieldSelectors []MarkupFieldSelector = []MarkupFieldSelector{
 
 	{"latitude", "[itemprop=latitude]", "content", false},
 	{"longitude", "[itemprop=longitude]", "content", false},
+	{"squareFeet", "[itemprop=floorSize] [itemprop=value]", "content", false},
+	{"beds", "[itemprop=numberOfBedrooms]", "content", false},
+	{"baths", "[itemprop=numberOfBathroomsTotal]", "content", false},
 
 	// {"street", "[itemprop=streetAddress]", "", false},
 	// {"city", "[itemprop=addressLocality]", "", false},
@@ -37,6 +40,9 @@ var fieldSelectors []MarkupFieldSelector = []MarkupFieldSelector{
 	// {"zip", "[itemprop=postalCode]", "", false},
 }
 
+// Square feet come formatted, ie: "1,850"
+var nonDigits = regexp.MustCompile("[^0-9]")
+
 func GetDefaultFieldSelectors() []MarkupFieldSelector {
 	return fieldSelectors
 }
@@ -130,13 +136,58 @@ func (self *Scraper) ScrapeListingImages() []ListingImage {
 		isDeadLink, _ := regexp.MatchString("(missing)", strings.ToLower(imageLink))
 
 		if imageLink != "" && !isDeadLink {
-			images = append(images, ListingImage{Url: imageLink})
+			// Captions, when the listing has them, say what's in the photo
+			label, _ := s.Attr("alt")
+			if label == "" {
+				label, _ = s.Attr("title")
+			}
+			label = strings.TrimSpace(label)
+			images = append(images, ListingImage{Url: imageLink, Label: label, Tags: PhotoTags(label)})
 		}
 	})
 
 	return images
 }
 
+// Words in photo captions worth tagging, by the tag they get
+var photoTagWords = map[string]string{
+	"pool":       "pool",
+	"pools":      "pool",
+	"kitchen":    "kitchen",
+	"kitchens":   "kitchen",
+	"fireplace":  "fireplace",
+	"fireplaces": "fireplace",
+	"deck":       "deck",
+	"patio":      "patio",
+	"garage":     "garage",
+	"yard":       "yard",
+	"backyard":   "yard",
+	"garden":     "yard",
+	"view":       "view",
+	"views":      "view",
+	"basement":   "basement",
+	"carpet":     "carpet",
+	"carpeted":   "carpet",
+	"hardwood":   "hardwood",
+	"hardwoods":  "hardwood",
+}
+
+var captionWords = regexp.MustCompile("[a-z]+")
+
+// PhotoTags picks the tags out of a photo's caption, in the order they
+// come up, ie: "Remodeled kitchen with a view" is kitchen and view
+func PhotoTags(caption string) []string {
+	var tags []string
+	found := make(map[string]bool)
+	for _, word := range captionWords.FindAllString(strings.ToLower(caption), -1) {
+		if tag, ok := photoTagWords[word]; ok && !found[tag] {
+			found[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 // ScrapeListingProperties will scrape all configured fields, and then marshal/convert
 // the raw string types into the types required by each of the listing properties. Extra
 // scraped data will be thrown into the meta properties.
@@ -144,30 +195,46 @@ func (self *Scraper) ScrapeListingProperties() ListingProperties {
 
 	raw := self.ScrapeFields()
 
-	lat, _ := strconv.ParseFloat(raw["latitude"], 64)
-	long, _ := strconv.ParseFloat(raw["longitude"], 64)
 	price, _ := strconv.Atoi(raw["price"])
+	squareFeet, _ := strconv.Atoi(nonDigits.ReplaceAllString(raw["squareFeet"], ""))
+	beds, _ := strconv.Atoi(nonDigits.ReplaceAllString(raw["beds"], ""))
+	// Half baths, ie: "2.5"
+	baths, _ := strconv.ParseFloat(strings.TrimSpace(raw["baths"]), 64)
 
 	// Build listing properties structure
 	props := ListingProperties{
 		CurrentPrice: uint(price),
+		SquareFeet:   uint(squareFeet),
+		Beds:         uint(beds),
+		Baths:        baths,
 		MLS:          raw["mls"],
-		Location: GeoJson{
-			Type:        "Point",
-			Coordinates: []float64{long, lat},
-		},
-		Address: ListingAddress{
+		Address: NormalizeAddress(RawAddress{
 			Street: raw["street"],
 			City:   raw["city"],
 			State:  raw["state"],
 			Zip:    raw["zip"],
-		},
+		}),
+	}
+
+	// Only keep the location if the page actually had one, it gets
+	// geocoded from the address otherwise
+	lat, latErr := strconv.ParseFloat(raw["latitude"], 64)
+	long, longErr := strconv.ParseFloat(raw["longitude"], 64)
+	if latErr == nil && longErr == nil {
+		location := NewGeoJsonPoint(long, lat)
+		if location.IsSet() {
+			props.Location = location
+			props.GeocodePrecision = PrecisionPage
+		}
 	}
 
 	// TODO - do this in a better way with introspection
 	delete(raw, "latitude")
 	delete(raw, "longitude")
 	delete(raw, "price")
+	delete(raw, "squareFeet")
+	delete(raw, "beds")
+	delete(raw, "baths")
 	delete(raw, "mls")
 	delete(raw, "street")
 	delete(raw, "city")
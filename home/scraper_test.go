@@ -0,0 +1,54 @@
+package home
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScrapeListingImages(t *testing.T) {
+
+	markup := `<html><body><div id="slider">
+		<img src="http://example.com/1.jpg" alt="Remodeled Kitchen with mountain views">
+		<img src="http://example.com/2.jpg" title="Pool and back yard">
+		<img src="http://example.com/missing.jpg" alt="Pool">
+		<img src="http://example.com/3.jpg">
+	</div></body></html>`
+
+	scraper, err := NewScraper(markup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []ListingImage{
+		{Url: "http://example.com/1.jpg", Label: "Remodeled Kitchen with mountain views", Tags: []string{"kitchen", "view"}},
+		{Url: "http://example.com/2.jpg", Label: "Pool and back yard", Tags: []string{"pool", "yard"}},
+		{Url: "http://example.com/3.jpg"},
+	}
+	if got := scraper.ScrapeListingImages(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("ScrapeListingImages() == %+v, expected %+v", got, expect)
+	}
+}
+
+func TestPhotoTags(t *testing.T) {
+
+	type inOut struct {
+		caption string
+		expect  []string
+	}
+
+	cases := []inOut{
+		{"Pool", []string{"pool"}},
+		{"Hardwoods throughout, fireplace in the den", []string{"hardwood", "fireplace"}},
+		// Once each
+		{"Pool, pools, and more POOLS", []string{"pool"}},
+		// Not a word on its own
+		{"Carport", nil},
+		{"", nil},
+	}
+
+	for _, c := range cases {
+		if got := PhotoTags(c.caption); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("PhotoTags(%q) == %v, expected %v", c.caption, got, c.expect)
+		}
+	}
+}
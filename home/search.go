@@ -0,0 +1,538 @@
+package home
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	SavedSearchCollectionName = "SavedSearches"
+	SearchAlertCollectionName = "SearchAlerts"
+
+	// Failed deliveries are tried again on later runs, up to this many times
+	MaxAlertAttempts = 3
+
+	// Held while running the saved searches, see RunSavedSearchesLocked
+	SavedSearchLeaseName = "saved-searches"
+)
+
+var ErrSearchNotFound = errors.New("Saved search not found")
+
+// InvalidSearchError is a saved search's webhook or email that alerts
+// can't be sent to
+type InvalidSearchError struct {
+	Field string
+	Err   error
+}
+
+func (self *InvalidSearchError) Error() string {
+	return self.Field + ": " + self.Err.Error()
+}
+
+// SavedSearch is a user's listing query, run after the crawlers to
+// alert them about new listings and price changes
+type SavedSearch struct {
+	Id       bson.ObjectId  `bson:"_id,omitempty"`
+	UserId   string         `bson:"userId"`
+	Name     string         `bson:"name"`
+	Criteria SearchCriteria `bson:"criteria"`
+
+	// Where to send alerts, either or both
+	Webhook string `bson:"webhook,omitempty"`
+	Email   string `bson:"email,omitempty"`
+
+	CreatedDate time.Time `bson:"createdDate"`
+	// Changes after this are what the next run alerts about
+	LastRunDate time.Time `bson:"lastRunDate,omitempty"`
+}
+
+// SearchCriteria is the stored form of a ListingsQuery's filters, see
+// Apply. Only listings for sale are ever matched.
+type SearchCriteria struct {
+	PriceMin uint     `bson:"priceMin,omitempty"`
+	PriceMax uint     `bson:"priceMax,omitempty"`
+	States   []string `bson:"states,omitempty"`
+	Cities   []string `bson:"cities,omitempty"`
+	Zips     []string `bson:"zips,omitempty"`
+
+	// Around a zip code, needs a geocoder
+	NearZip     string `bson:"nearZip,omitempty"`
+	ZipDistance uint   `bson:"zipDistance,omitempty"`
+
+	Near    *SearchNear     `bson:"near,omitempty"`
+	Polygon *GeoJsonPolygon `bson:"polygon,omitempty"`
+}
+
+type SearchNear struct {
+	Longitude float64 `bson:"lng"`
+	Latitude  float64 `bson:"lat"`
+	Meters    uint    `bson:"meters"`
+}
+
+// SearchAlert is one run's worth of matches for a saved search
+type SearchAlert struct {
+	Id         bson.ObjectId        `bson:"_id,omitempty"`
+	SearchId   bson.ObjectId        `bson:"searchId"`
+	UserId     string               `bson:"userId"`
+	SearchName string               `bson:"searchName"`
+	Listings   []SearchAlertListing `bson:"listings"`
+	// Of the listings, see alertKey, no two alerts share one
+	Keys []string `bson:"keys,omitempty"`
+
+	CreatedDate   time.Time `bson:"createdDate"`
+	DeliveredDate time.Time `bson:"deliveredDate,omitempty"`
+	Attempts      int       `bson:"attempts"`
+	// From the last failed delivery
+	Error string `bson:"error,omitempty"`
+}
+
+// SearchAlertListing is a listing that matched, and why it's news
+type SearchAlertListing struct {
+	ListingId bson.ObjectId `bson:"listingId"`
+	Url       string        `bson:"url"`
+	// EventCreated, EventOnMarket or EventPrice
+	Reason   string `bson:"reason"`
+	Price    uint   `bson:"price"`
+	OldPrice uint   `bson:"oldPrice,omitempty"`
+	// Of the event that gave the reason
+	ChangeDate time.Time `bson:"changeDate"`
+}
+
+// Apply adds the criteria's filters to the query, bad values are
+// reported by the query's Err
+func (self SearchCriteria) Apply(query *ListingsQuery) {
+	query.ForSale(true)
+
+	if self.PriceMin != 0 {
+		query.PriceAbove(self.PriceMin)
+	}
+	if self.PriceMax != 0 {
+		query.PriceUnder(self.PriceMax)
+	}
+	if len(self.States) > 0 {
+		query.InStates(self.States...)
+	}
+	if len(self.Cities) > 0 {
+		query.InCities(self.Cities...)
+	}
+	if len(self.Zips) > 0 {
+		query.InZipCodes(self.Zips...)
+	}
+	if self.NearZip != "" {
+		query.NearZipCode(self.NearZip, self.ZipDistance)
+	}
+	if self.Near != nil {
+		query.NearPoint(self.Near.Longitude, self.Near.Latitude, self.Near.Meters)
+	}
+	if self.Polygon != nil {
+		query.WithinPolygon(*self.Polygon)
+	}
+}
+
+// check is for what the query takes but makes no sense saved, as a
+// *QueryError
+func (self SearchCriteria) check() error {
+	// Within 0 of a zip would never match anything
+	if self.NearZip != "" && self.ZipDistance == 0 {
+		return &QueryError{Fields: []QueryFieldError{
+			{Field: "zipDistance", Message: "a distance is needed around a zip", Values: []string{"0"}},
+		}}
+	}
+	return nil
+}
+
+// SaveSearch adds the search, or replaces it if it has an id. A
+// *QueryError is returned if the criteria can't be used, and an
+// *InvalidSearchError if the webhook or email can't be.
+func (self *DB) SaveSearch(search SavedSearch) (SavedSearch, error) {
+
+	if err := search.Validate(); err != nil {
+		return search, err
+	}
+	if err := search.Criteria.check(); err != nil {
+		return search, err
+	}
+
+	query := self.NewListingsQuery()
+	search.Criteria.Apply(query)
+	if err := query.Err(); err != nil {
+		return search, err
+	}
+
+	collection := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	if search.Id == "" {
+		search.Id = bson.NewObjectId()
+		search.CreatedDate = time.Now()
+		// Only what's new from here on
+		search.LastRunDate = search.CreatedDate
+		return search, collection.Insert(search)
+	}
+
+	existing := SavedSearch{}
+	err := collection.Find(bson.M{"_id": search.Id, "userId": search.UserId}).One(&existing)
+	if err == mgo.ErrNotFound {
+		return search, ErrSearchNotFound
+	}
+	if err != nil {
+		return search, err
+	}
+	search.CreatedDate = existing.CreatedDate
+	search.LastRunDate = existing.LastRunDate
+
+	return search, collection.UpdateId(search.Id, search)
+}
+
+// Validate checks where the alerts go, see CheckWebhookUrl and
+// CheckEmail, returning an *InvalidSearchError
+func (self SavedSearch) Validate() error {
+	if self.Webhook != "" {
+		if err := CheckWebhookUrl(self.Webhook); err != nil {
+			return &InvalidSearchError{Field: "webhook", Err: err}
+		}
+	}
+	if self.Email != "" {
+		if err := CheckEmail(self.Email); err != nil {
+			return &InvalidSearchError{Field: "email", Err: err}
+		}
+	}
+	return nil
+}
+
+// GetSavedSearches returns the user's searches, oldest first
+func (self *DB) GetSavedSearches(userId string) ([]SavedSearch, error) {
+	collection := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	searches := []SavedSearch{}
+	err := collection.Find(bson.M{"userId": userId}).Sort("_id").All(&searches)
+	return searches, err
+}
+
+// DeleteSavedSearch returns ErrSearchNotFound if the user has no search
+// with the id
+func (self *DB) DeleteSavedSearch(userId string, searchId bson.ObjectId) error {
+	collection := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	err := collection.Remove(bson.M{"_id": searchId, "userId": userId})
+	if err == mgo.ErrNotFound {
+		return ErrSearchNotFound
+	}
+	return err
+}
+
+// GetSearchAlerts returns the user's most recent alerts, newest first
+func (self *DB) GetSearchAlerts(userId string, limit int) ([]SearchAlert, error) {
+	collection := self.mongoBroker.searchAlertCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	alerts := []SearchAlert{}
+	err := collection.Find(bson.M{"userId": userId}).Sort("-_id").Limit(limit).All(&alerts)
+	return alerts, err
+}
+
+// RunSavedSearchesLocked runs the saved searches under a lease, since
+// crawlers can finish at the same time and only one of them should.
+// ErrLockHeld is returned if another process is running them.
+func (self *DB) RunSavedSearchesLocked(notifier Notifier) (int, error) {
+	lease := self.NewLease(SavedSearchLeaseName, DefaultLeaseTTL)
+	acquired, err := lease.Acquire()
+	if err != nil {
+		return 0, err
+	}
+	if !acquired {
+		return 0, ErrLockHeld
+	}
+	defer lease.Release()
+
+	return self.RunSavedSearches(notifier)
+}
+
+// RunSavedSearches checks the listings registered, back on the market,
+// or changed in price since each search last ran, and saves an alert
+// for every search they match. Alerts are handed to the notifier, along
+// with ones that failed to go out on earlier runs. Without a notifier
+// the alerts are only saved. Returns how many alerts were made.
+//
+// Only one process should run it at a time, see RunSavedSearchesLocked.
+// A run that stops part way is picked up by the next one, without
+// alerting the same changes twice, see saveAlert.
+func (self *DB) RunSavedSearches(notifier Notifier) (int, error) {
+
+	now := time.Now()
+
+	searches := []SavedSearch{}
+	collection := self.mongoBroker.savedSearchCollection()
+	err := collection.Find(nil).All(&searches)
+	self.mongoBroker.closeCollection(collection)
+	if err != nil || len(searches) == 0 {
+		return 0, err
+	}
+
+	changes, err := self.listingChangesSince(oldestRun(searches), now)
+	if err != nil {
+		return 0, err
+	}
+
+	made := 0
+	for _, search := range searches {
+		alert, err := self.searchAlert(search, changes)
+		if err != nil {
+			fmt.Printf("[ERR] Problem running saved search %s: %s\n", search.Id.Hex(), err)
+			continue
+		}
+		if len(alert.Listings) > 0 {
+			saved, err := self.saveAlert(&alert)
+			if err != nil {
+				return made, err
+			}
+			if saved {
+				made++
+			}
+		}
+		if err := self.searchRan(search.Id, now); err != nil {
+			return made, err
+		}
+	}
+
+	if notifier != nil {
+		self.deliverAlerts(notifier)
+	}
+
+	return made, nil
+}
+
+// oldestRun is as far back as any search needs changes from
+func oldestRun(searches []SavedSearch) time.Time {
+	var oldest time.Time
+	for i, search := range searches {
+		if i == 0 || search.since().Before(oldest) {
+			oldest = search.since()
+		}
+	}
+	return oldest
+}
+
+func (self SavedSearch) since() time.Time {
+	if self.LastRunDate.IsZero() {
+		return self.CreatedDate
+	}
+	return self.LastRunDate
+}
+
+// listingChangesSince gathers the history events alerts care about, by
+// listing, oldest first
+func (self *DB) listingChangesSince(since, until time.Time) (map[bson.ObjectId][]ListingEvent, error) {
+	collection := self.mongoBroker.historyCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	changes := make(map[bson.ObjectId][]ListingEvent)
+	iter := collection.Find(bson.M{
+		"date": bson.M{"$gt": since, "$lte": until},
+		"type": bson.M{"$in": []string{EventCreated, EventOnMarket, EventPrice}},
+	}).Sort("date").Iter()
+	event := ListingEvent{}
+	for iter.Next(&event) {
+		changes[event.ListingId] = append(changes[event.ListingId], event)
+		event = ListingEvent{}
+	}
+	return changes, iter.Close()
+}
+
+// searchAlert matches the listings changed since the search last ran
+// against its criteria
+func (self *DB) searchAlert(search SavedSearch, changes map[bson.ObjectId][]ListingEvent) (SearchAlert, error) {
+	alert := SearchAlert{
+		SearchId:   search.Id,
+		UserId:     search.UserId,
+		SearchName: search.Name,
+	}
+
+	since := search.since()
+	var ids []string
+	for listingId, events := range changes {
+		if _, changed := alertReason(events, since); changed {
+			ids = append(ids, listingId.Hex())
+		}
+	}
+	if len(ids) == 0 {
+		return alert, nil
+	}
+
+	query := self.NewListingsQuery()
+	search.Criteria.Apply(query)
+	query.Include(ids...)
+	listings, _, err := query.Fetch()
+	if err != nil {
+		return alert, err
+	}
+
+	for _, listing := range *listings {
+		// Asking by id includes duplicates, the primary listing stands in
+		if listing.Duplicate {
+			continue
+		}
+		match, _ := alertReason(changes[listing.Id], since)
+		match.ListingId = listing.Id
+		match.Url = listing.Url
+		match.Price = listing.Properties.CurrentPrice
+		alert.Listings = append(alert.Listings, match)
+	}
+	return alert, nil
+}
+
+// alertReason is why a listing's events after since are worth an alert,
+// being new beats a price change. The events are oldest first.
+func alertReason(events []ListingEvent, since time.Time) (SearchAlertListing, bool) {
+	match := SearchAlertListing{}
+	found := false
+	for _, event := range events {
+		if !event.Date.After(since) {
+			continue
+		}
+		switch event.Type {
+		case EventCreated, EventOnMarket:
+			if match.Reason != EventCreated {
+				match.Reason = event.Type
+				match.OldPrice = 0
+				match.ChangeDate = event.Date
+			}
+		case EventPrice:
+			if match.Reason == "" {
+				match.Reason = EventPrice
+				// The price before the first change
+				match.OldPrice = event.OldPrice
+				match.ChangeDate = event.Date
+			}
+		default:
+			continue
+		}
+		found = true
+	}
+	return match, found
+}
+
+// alertKey is the search, listing, and the change that's news about it,
+// the same change is only ever alerted once
+func alertKey(searchId bson.ObjectId, listing SearchAlertListing) string {
+	millis := listing.ChangeDate.UnixNano() / int64(time.Millisecond)
+	return searchId.Hex() + "/" + listing.ListingId.Hex() + "/" + listing.Reason + "/" + strconv.FormatInt(millis, 10)
+}
+
+// unalerted drops the listings with keys already taken, and returns the
+// keys of the rest
+func unalerted(searchId bson.ObjectId, listings []SearchAlertListing, taken map[string]bool) ([]SearchAlertListing, []string) {
+	var left []SearchAlertListing
+	var keys []string
+	for _, listing := range listings {
+		key := alertKey(searchId, listing)
+		if !taken[key] {
+			left = append(left, listing)
+			keys = append(keys, key)
+		}
+	}
+	return left, keys
+}
+
+// saveAlert leaves out listings an alert was already saved for, ie: by
+// a run that stopped before it could record that it ran. Returns false
+// if there was nothing left to save.
+func (self *DB) saveAlert(alert *SearchAlert) (bool, error) {
+	collection := self.mongoBroker.searchAlertCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	_, keys := unalerted(alert.SearchId, alert.Listings, nil)
+	var existing []SearchAlert
+	err := collection.Find(bson.M{"keys": bson.M{"$in": keys}}).Select(bson.M{"keys": 1}).All(&existing)
+	if err != nil {
+		return false, err
+	}
+	taken := make(map[string]bool)
+	for _, other := range existing {
+		for _, key := range other.Keys {
+			taken[key] = true
+		}
+	}
+
+	alert.Listings, alert.Keys = unalerted(alert.SearchId, alert.Listings, taken)
+	if len(alert.Listings) == 0 {
+		return false, nil
+	}
+
+	alert.Id = bson.NewObjectId()
+	alert.CreatedDate = time.Now()
+	err = collection.Insert(alert)
+	if mgo.IsDup(err) {
+		// Somebody else saved them in the meantime
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (self *DB) searchRan(searchId bson.ObjectId, date time.Time) error {
+	collection := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	return collection.UpdateId(searchId, bson.M{"$set": bson.M{"lastRunDate": date}})
+}
+
+// deliverAlerts sends whatever hasn't gone out yet, problems are kept
+// on the alert for the next run to try again
+func (self *DB) deliverAlerts(notifier Notifier) {
+	alerts := self.mongoBroker.searchAlertCollection()
+	defer self.mongoBroker.closeCollection(alerts)
+	searches := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(searches)
+
+	iter := alerts.Find(bson.M{
+		"deliveredDate": bson.M{"$exists": false},
+		"attempts":      bson.M{"$lt": MaxAlertAttempts},
+	}).Sort("_id").Iter()
+
+	alert := SearchAlert{}
+	for iter.Next(&alert) {
+		search := SavedSearch{}
+		if err := searches.FindId(alert.SearchId).One(&search); err != nil {
+			// Deleted since, nowhere to send it
+			alerts.UpdateId(alert.Id, bson.M{"$set": bson.M{"attempts": MaxAlertAttempts, "error": "saved search not found"}})
+			alert = SearchAlert{}
+			continue
+		}
+
+		update := bson.M{"$inc": bson.M{"attempts": 1}}
+		if err := notifier.Notify(search, alert); err != nil {
+			fmt.Printf("[ERR] Problem delivering alert %s: %s\n", alert.Id.Hex(), err)
+			update["$set"] = bson.M{"error": err.Error()}
+		} else {
+			update["$set"] = bson.M{"deliveredDate": time.Now()}
+			update["$unset"] = bson.M{"error": ""}
+		}
+		if err := alerts.UpdateId(alert.Id, update); err != nil {
+			fmt.Println("[ERR] Problem updating alert: ", err)
+		}
+		alert = SearchAlert{}
+	}
+	if err := iter.Close(); err != nil {
+		fmt.Println("[ERR] Problem finding alerts to deliver: ", err)
+	}
+}
+
+func (self *DB) ensureSearchIndexes() {
+	searches := self.mongoBroker.savedSearchCollection()
+	defer self.mongoBroker.closeCollection(searches)
+	searches.EnsureIndex(mgo.Index{Key: []string{"userId"}})
+
+	alerts := self.mongoBroker.searchAlertCollection()
+	defer self.mongoBroker.closeCollection(alerts)
+	alerts.EnsureIndex(mgo.Index{Key: []string{"userId", "_id"}})
+	alerts.EnsureIndex(mgo.Index{Key: []string{"deliveredDate", "attempts"}})
+	// Alerts from before there were keys don't have them
+	alerts.EnsureIndex(mgo.Index{Key: []string{"keys"}, Unique: true, Sparse: true})
+}
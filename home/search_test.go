@@ -0,0 +1,192 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAlertReason(t *testing.T) {
+
+	since := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Hour)
+	later := since.Add(2 * time.Hour)
+
+	type inOut struct {
+		events   []ListingEvent
+		found    bool
+		reason   string
+		oldPrice uint
+	}
+
+	cases := []inOut{
+		{[]ListingEvent{{Type: EventCreated, Date: after}}, true, EventCreated, 0},
+		// Already alerted about
+		{[]ListingEvent{{Type: EventCreated, Date: before}}, false, "", 0},
+		{[]ListingEvent{{Type: EventCreated, Date: before}, {Type: EventPrice, OldPrice: 500, Date: after}}, true, EventPrice, 500},
+		// Price from before the first change
+		{[]ListingEvent{{Type: EventPrice, OldPrice: 500, Date: after}, {Type: EventPrice, OldPrice: 450, Date: later}}, true, EventPrice, 500},
+		// New beats a price change
+		{[]ListingEvent{{Type: EventCreated, Date: after}, {Type: EventPrice, OldPrice: 500, Date: later}}, true, EventCreated, 0},
+		{[]ListingEvent{{Type: EventPrice, OldPrice: 500, Date: after}, {Type: EventOnMarket, Date: later}}, true, EventOnMarket, 0},
+		{[]ListingEvent{{Type: EventOffMarket, Date: after}}, false, "", 0},
+		{nil, false, "", 0},
+	}
+
+	for i, c := range cases {
+		match, found := alertReason(c.events, since)
+		if found != c.found || match.Reason != c.reason || match.OldPrice != c.oldPrice {
+			t.Errorf("case %d: alertReason() == %+v, %v, expected %q, %d, %v", i, match, found, c.reason, c.oldPrice, c.found)
+		}
+	}
+
+	// The change is the one the reason came from
+	match, _ := alertReason([]ListingEvent{{Type: EventPrice, OldPrice: 500, Date: after}, {Type: EventOnMarket, Date: later}}, since)
+	if !match.ChangeDate.Equal(later) {
+		t.Errorf("alertReason() change date == %v, expected %v", match.ChangeDate, later)
+	}
+}
+
+func TestUnalerted(t *testing.T) {
+
+	searchId := bson.NewObjectId()
+	date := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := SearchAlertListing{ListingId: bson.NewObjectId(), Reason: EventCreated, ChangeDate: date}
+	second := SearchAlertListing{ListingId: bson.NewObjectId(), Reason: EventPrice, ChangeDate: date}
+	// Same listing, a later price change is news again
+	again := second
+	again.ChangeDate = date.Add(time.Hour)
+
+	// Saved by a run that didn't get to record it ran
+	taken := map[string]bool{alertKey(searchId, first): true}
+
+	left, keys := unalerted(searchId, []SearchAlertListing{first, second, again}, taken)
+	if len(left) != 2 || left[0] != second || left[1] != again {
+		t.Errorf("unalerted() == %+v, expected the second and again", left)
+	}
+	if len(keys) != 2 || keys[0] == keys[1] || keys[0] != alertKey(searchId, second) {
+		t.Errorf("unalerted() keys == %v, expected one each", keys)
+	}
+
+	// Another search alerts about the same change on its own
+	if alertKey(bson.NewObjectId(), first) == alertKey(searchId, first) {
+		t.Errorf("alertKey() is the same for two searches")
+	}
+}
+
+func TestSaveSearchZipDistance(t *testing.T) {
+
+	type inOut struct {
+		criteria SearchCriteria
+		invalid  bool
+	}
+
+	cases := []inOut{
+		{SearchCriteria{NearZip: "80202"}, true},
+		{SearchCriteria{NearZip: "80202", ZipDistance: 5000}, false},
+		{SearchCriteria{}, false},
+	}
+
+	for _, c := range cases {
+		err := c.criteria.check()
+		if _, isQueryErr := err.(*QueryError); isQueryErr != c.invalid {
+			t.Errorf("check(%+v) == %v, expected invalid %v", c.criteria, err, c.invalid)
+		}
+	}
+
+	// Turned away before it gets near the database
+	if _, err := (&DB{}).SaveSearch(SavedSearch{Criteria: SearchCriteria{NearZip: "80202"}}); err == nil {
+		t.Errorf("SaveSearch() with no zip distance == nil, expected a *QueryError")
+	} else if _, ok := err.(*QueryError); !ok {
+		t.Errorf("SaveSearch() with no zip distance == %v, expected a *QueryError", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+
+	var got AlertPayload
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("bad webhook body: %v", err)
+		}
+		if req.URL.Path == "/fail" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	listingId := bson.NewObjectId()
+	alert := SearchAlert{
+		Id:         bson.NewObjectId(),
+		SearchId:   bson.NewObjectId(),
+		SearchName: "Denver condos",
+		Listings:   []SearchAlertListing{{ListingId: listingId, Url: "http://example.com/1", Reason: EventPrice, Price: 400, OldPrice: 450}},
+	}
+
+	// The test server is on loopback, which the real client won't go to
+	notifier := &WebhookNotifier{Client: server.Client()}
+	if err := NewWebhookNotifier().Notify(SavedSearch{Webhook: server.URL + "/alerts"}, alert); err == nil {
+		t.Errorf("expected the webhook client to refuse a loopback address")
+	}
+
+	if err := notifier.Notify(SavedSearch{Webhook: server.URL + "/alerts"}, alert); err != nil {
+		t.Fatalf("Notify() == %v", err)
+	}
+	if got.SearchName != alert.SearchName || len(got.Listings) != 1 || got.Listings[0].Id != listingId.Hex() || got.Listings[0].OldPrice != 450 {
+		t.Errorf("webhook got %+v", got)
+	}
+
+	if err := notifier.Notify(SavedSearch{Webhook: server.URL + "/fail"}, alert); err == nil {
+		t.Errorf("expected an error when the webhook fails")
+	}
+
+	// Nowhere to send it
+	if err := notifier.Notify(SavedSearch{Email: "someone@example.com"}, alert); err != nil {
+		t.Errorf("Notify() without a webhook == %v, expected it skipped", err)
+	}
+}
+
+func TestSavedSearchValidate(t *testing.T) {
+
+	type inOut struct {
+		search SavedSearch
+		field  string
+	}
+
+	cases := []inOut{
+		{SavedSearch{Webhook: "https://93.184.216.34/alerts", Email: "someone@example.com"}, ""},
+		{SavedSearch{Email: "someone@example.com"}, ""},
+		{SavedSearch{Webhook: "ftp://93.184.216.34/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "/alerts"}, "webhook"},
+		// Nothing on the inside
+		{SavedSearch{Webhook: "http://127.0.0.1:8080/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "http://localhost/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "http://10.0.0.5/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "http://192.168.1.1/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "http://169.254.169.254/latest/meta-data"}, "webhook"},
+		{SavedSearch{Webhook: "http://[::1]/alerts"}, "webhook"},
+		{SavedSearch{Webhook: "http://0.0.0.0/alerts"}, "webhook"},
+		{SavedSearch{Email: "not an email"}, "email"},
+		// Just the address, nothing for the headers
+		{SavedSearch{Email: "Someone <someone@example.com>"}, "email"},
+		{SavedSearch{Email: "someone@example.com\r\nBcc: else@example.com"}, "email"},
+	}
+
+	for _, c := range cases {
+		err := c.search.Validate()
+		field := ""
+		if invalid, ok := err.(*InvalidSearchError); ok {
+			field = invalid.Field
+		} else if err != nil {
+			t.Errorf("Validate(%+v) == %v, expected an *InvalidSearchError", c.search, err)
+		}
+		if field != c.field {
+			t.Errorf("Validate(%+v) == %v, expected a problem with %q", c.search, err, c.field)
+		}
+	}
+}
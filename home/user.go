@@ -0,0 +1,177 @@
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	UserListingCollectionName = "UserListings"
+
+	// Most recently seen listings ExcludeSeenBy skips, older ones can
+	// come back around
+	SeenExcludeLimit = 1000
+)
+
+// What a user thought of a listing
+const (
+	ReactionNone = ""
+	ReactionLike = "like"
+	ReactionHide = "hide"
+)
+
+var ErrUnknownReaction = errors.New("Unknown reaction")
+var ErrBadUserToken = errors.New("Invalid user token")
+
+// UserListing is a listing a user has come across, and what they made
+// of it, one per user and listing. Users are whatever id signed in
+// them, see UserToken.
+type UserListing struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	UserId    string        `bson:"userId"`
+	ListingId bson.ObjectId `bson:"listingId"`
+	SeenDate  time.Time     `bson:"seenDate"`
+
+	// ReactionLike, ReactionHide, or none
+	Reaction     string    `bson:"reaction,omitempty"`
+	ReactionDate time.Time `bson:"reactionDate,omitempty"`
+}
+
+// MarkSeen records the user has seen the listings, already seen ones
+// are left alone
+func (self *DB) MarkSeen(userId string, listingIds ...bson.ObjectId) error {
+	if len(listingIds) == 0 {
+		return nil
+	}
+
+	collection := self.mongoBroker.userListingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	bulk := collection.Bulk()
+	bulk.Unordered()
+	for _, listingId := range listingIds {
+		bulk.Upsert(
+			bson.M{"userId": userId, "listingId": listingId},
+			bson.M{"$setOnInsert": bson.M{"seenDate": now}},
+		)
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+// React records what the user made of the listing, which also marks it
+// seen. ReactionNone takes back a like or hide, the listing stays seen.
+func (self *DB) React(userId string, listingId bson.ObjectId, reaction string) error {
+	update := bson.M{}
+	switch reaction {
+	case ReactionLike, ReactionHide:
+		update["$set"] = bson.M{"reaction": reaction, "reactionDate": time.Now()}
+	case ReactionNone:
+		update["$unset"] = bson.M{"reaction": "", "reactionDate": ""}
+	default:
+		return ErrUnknownReaction
+	}
+	update["$setOnInsert"] = bson.M{"seenDate": time.Now()}
+
+	collection := self.mongoBroker.userListingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	_, err := collection.Upsert(bson.M{"userId": userId, "listingId": listingId}, update)
+	return err
+}
+
+// GetUserListings returns the listings the user reacted to that way,
+// most recent first, 0 for no limit
+func (self *DB) GetUserListings(userId, reaction string, limit int) ([]UserListing, error) {
+	if reaction != ReactionLike && reaction != ReactionHide {
+		return nil, ErrUnknownReaction
+	}
+
+	collection := self.mongoBroker.userListingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	userListings := []UserListing{}
+	query := collection.Find(bson.M{"userId": userId, "reaction": reaction}).Sort("-reactionDate")
+	if limit != 0 {
+		query.Limit(limit)
+	}
+	err := query.All(&userListings)
+	return userListings, err
+}
+
+// SeenListingIds returns the ids of the listings the user has seen most
+// recently, liked and hidden ones included, up to the limit
+func (self *DB) SeenListingIds(userId string, limit int) ([]bson.ObjectId, error) {
+	collection := self.mongoBroker.userListingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	iter := collection.Find(bson.M{"userId": userId}).
+		Sort("-seenDate").
+		Limit(limit).
+		Select(bson.M{"listingId": 1}).
+		Iter()
+
+	var ids []bson.ObjectId
+	var result UserListing
+	for iter.Next(&result) {
+		ids = append(ids, result.ListingId)
+	}
+	return ids, iter.Close()
+}
+
+// ExcludeSeenBy skips the listings the user has seen most recently, up
+// to SeenExcludeLimit of them. Any problem looking them up is returned,
+// both here and from Err.
+func (self *ListingsQuery) ExcludeSeenBy(userId string) error {
+	ids, err := self.db.SeenListingIds(userId, SeenExcludeLimit)
+	if err != nil {
+		self.lookupErr = err
+		return err
+	}
+	self.excluding = append(self.excluding, ids...)
+	self.excludeFl = true
+	return nil
+}
+
+// UserToken signs the user in, it's the id and its hex HMAC-SHA256
+// keyed with the secret, "<userId>.<signature>". Whatever signs users
+// in hands these out, sharing the secret with the server.
+func UserToken(secret, userId string) string {
+	return userId + "." + userTokenSignature(secret, userId)
+}
+
+// ParseUserToken returns the user the token was made for, or
+// ErrBadUserToken if it wasn't made with the secret
+func ParseUserToken(secret, token string) (string, error) {
+	split := strings.LastIndex(token, ".")
+	if secret == "" || split < 1 {
+		return "", ErrBadUserToken
+	}
+	userId, signature := token[:split], token[split+1:]
+	if !hmac.Equal([]byte(signature), []byte(userTokenSignature(secret, userId))) {
+		return "", ErrBadUserToken
+	}
+	return userId, nil
+}
+
+func userTokenSignature(secret, userId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(userId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *DB) ensureUserIndexes() {
+	collection := self.mongoBroker.userListingCollection()
+	defer self.mongoBroker.closeCollection(collection)
+	collection.EnsureIndex(mgo.Index{Key: []string{"userId", "listingId"}, Unique: true})
+	collection.EnsureIndex(mgo.Index{Key: []string{"userId", "reaction", "reactionDate"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"userId", "seenDate"}})
+}
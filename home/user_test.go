@@ -0,0 +1,53 @@
+package home
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUnknownReaction(t *testing.T) {
+
+	db := &DB{}
+	listingId := bson.NewObjectId()
+
+	for _, reaction := range []string{"love", "LIKE", "hidden"} {
+		if err := db.React("user-1", listingId, reaction); err != ErrUnknownReaction {
+			t.Errorf("React(%q) == %v, expected ErrUnknownReaction", reaction, err)
+		}
+		if _, err := db.GetUserListings("user-1", reaction, 10); err != ErrUnknownReaction {
+			t.Errorf("GetUserListings(%q) == %v, expected ErrUnknownReaction", reaction, err)
+		}
+	}
+}
+
+func TestUserToken(t *testing.T) {
+
+	token := UserToken("shh", "user-1")
+
+	type inOut struct {
+		secret string
+		token  string
+		userId string
+	}
+
+	cases := []inOut{
+		{"shh", token, "user-1"},
+		// Ids can have dots
+		{"shh", UserToken("shh", "first.last"), "first.last"},
+		{"wrong", token, ""},
+		{"", token, ""},
+		// Someone else's id on this signature
+		{"shh", "user-2" + token[len("user-1"):], ""},
+		{"shh", "user-1", ""},
+		{"shh", "", ""},
+		{"shh", ".abc", ""},
+	}
+
+	for _, c := range cases {
+		userId, err := ParseUserToken(c.secret, c.token)
+		if userId != c.userId || (c.userId == "" && err != ErrBadUserToken) {
+			t.Errorf("ParseUserToken(%q, %q) == %q, %v, expected %q", c.secret, c.token, userId, err, c.userId)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package home
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	WebhookCollectionName         = "Webhooks"
+	WebhookDeliveryCollectionName = "WebhookDeliveries"
+
+	// Headers sent with every delivery
+	WebhookEventHeader     = "X-Photochem-Event"
+	WebhookDeliveryHeader  = "X-Photochem-Delivery"
+	WebhookTimestampHeader = "X-Photochem-Timestamp"
+	WebhookSignatureHeader = "X-Photochem-Signature"
+
+	// Most events or deliveries handled in one go
+	webhookBatch = 500
+)
+
+// Delivery statuses, dead deliveries ran out of attempts
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+var ErrWebhookNotFound = errors.New("Webhook not found")
+var ErrDeliveryNotFound = errors.New("Dead delivery not found")
+
+// Webhook is a url listing change events are posted to
+type Webhook struct {
+	Id  bson.ObjectId `bson:"_id,omitempty"`
+	Url string        `bson:"url"`
+	// Signs the deliveries, see WebhookSignature
+	Secret string `bson:"secret"`
+	// Change types it wants, empty for all of them
+	Types       []string  `bson:"types,omitempty"`
+	CreatedDate time.Time `bson:"createdDate"`
+}
+
+func (self Webhook) wants(eventType string) bool {
+	if len(self.Types) == 0 {
+		return true
+	}
+	for _, wanted := range self.Types {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one change event going to one webhook
+type WebhookDelivery struct {
+	Id              bson.ObjectId `bson:"_id,omitempty"`
+	EventId         bson.ObjectId `bson:"eventId"`
+	EventType       string        `bson:"eventType"`
+	WebhookId       bson.ObjectId `bson:"webhookId"`
+	Status          string        `bson:"status"`
+	Attempts        int           `bson:"attempts"`
+	NextAttemptDate time.Time     `bson:"nextAttemptDate"`
+	// From the last failed attempt
+	LastError     string    `bson:"lastError,omitempty"`
+	CreatedDate   time.Time `bson:"createdDate"`
+	DeliveredDate time.Time `bson:"deliveredDate,omitempty"`
+}
+
+// The body posted to webhooks
+type ChangePayload struct {
+	Id      string               `json:"id"`
+	Type    string               `json:"type"`
+	Date    time.Time            `json:"date"`
+	Listing ChangePayloadListing `json:"listing"`
+}
+
+type ChangePayloadListing struct {
+	Id       string   `json:"id"`
+	Href     string   `json:"href"`
+	Price    uint     `json:"price"`
+	OldPrice uint     `json:"oldPrice,omitempty"`
+	ForSale  bool     `json:"forSale"`
+	Photos   []string `json:"photos,omitempty"`
+}
+
+func NewChangePayload(event ChangeEvent) ChangePayload {
+	return ChangePayload{
+		Id:   event.Id.Hex(),
+		Type: event.Type,
+		Date: event.Date,
+		Listing: ChangePayloadListing{
+			Id:       event.ListingId.Hex(),
+			Href:     event.Url,
+			Price:    event.Price,
+			OldPrice: event.OldPrice,
+			ForSale:  event.ForSale,
+			Photos:   event.Photos,
+		},
+	}
+}
+
+// WebhookSignature is the hex HMAC-SHA256 of the timestamp header, a
+// dot, and the body, keyed with the webhook's secret. It's sent as
+// "sha256=<signature>", receivers should check it and that the
+// timestamp is recent.
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RegisterWebhook adds the webhook, a secret is made up for it if it
+// doesn't have one. Only changes from then on are delivered to it.
+func (self *DB) RegisterWebhook(webhook Webhook) (Webhook, error) {
+	if err := webhook.Validate(); err != nil {
+		return webhook, err
+	}
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return webhook, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	webhook.Id = bson.NewObjectId()
+	webhook.CreatedDate = time.Now()
+
+	collection := self.mongoBroker.webhookCollection()
+	defer self.mongoBroker.closeCollection(collection)
+	return webhook, collection.Insert(webhook)
+}
+
+// Validate checks the url, see CheckWebhookUrl, and change types
+func (self Webhook) Validate() error {
+	if err := CheckWebhookUrl(self.Url); err != nil {
+		return err
+	}
+	for _, eventType := range self.Types {
+		if !isChangeType(eventType) {
+			return fmt.Errorf("Unknown change type: %q", eventType)
+		}
+	}
+	return nil
+}
+
+func isChangeType(eventType string) bool {
+	for _, known := range ChangeTypes {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *DB) GetWebhooks() ([]Webhook, error) {
+	collection := self.mongoBroker.webhookCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	webhooks := []Webhook{}
+	err := collection.Find(nil).Sort("_id").All(&webhooks)
+	return webhooks, err
+}
+
+// DeleteWebhook removes the webhook, deliveries still waiting for it
+// end up dead
+func (self *DB) DeleteWebhook(webhookId bson.ObjectId) error {
+	collection := self.mongoBroker.webhookCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	err := collection.RemoveId(webhookId)
+	if err == mgo.ErrNotFound {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+// GetDeadLetters returns the deliveries that ran out of attempts,
+// newest first, for the webhook or all of them if the id is empty
+func (self *DB) GetDeadLetters(webhookId bson.ObjectId, limit int) ([]WebhookDelivery, error) {
+	collection := self.mongoBroker.webhookDeliveryCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	selector := bson.M{"status": DeliveryDead}
+	if webhookId != "" {
+		selector["webhookId"] = webhookId
+	}
+
+	deliveries := []WebhookDelivery{}
+	err := collection.Find(selector).Sort("-_id").Limit(limit).All(&deliveries)
+	return deliveries, err
+}
+
+// RetryDeadLetter gives a dead delivery a fresh set of attempts
+func (self *DB) RetryDeadLetter(deliveryId bson.ObjectId) error {
+	collection := self.mongoBroker.webhookDeliveryCollection()
+	defer self.mongoBroker.closeCollection(collection)
+
+	err := collection.Update(
+		bson.M{"_id": deliveryId, "status": DeliveryDead},
+		bson.M{"$set": bson.M{
+			"status":          DeliveryPending,
+			"attempts":        0,
+			"nextAttemptDate": time.Now(),
+		}})
+	if err == mgo.ErrNotFound {
+		return ErrDeliveryNotFound
+	}
+	return err
+}
+
+// Dispatcher
+
+// WebhookDispatcher hands the outbox's change events out to the
+// webhooks and delivers them, retrying failures with a growing wait
+// until they run out of attempts and go on the dead letter list.
+// Only one should run at a time.
+type WebhookDispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	// The first retry waits this long, doubling each time after
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration
+
+	db *DB
+}
+
+// DispatchStats counts what one Dispatch did
+type DispatchStats struct {
+	Events    int
+	Delivered int
+	Failed    int
+	Dead      int
+	// Left for next time, their webhook timed out
+	Skipped int
+}
+
+func (self *DB) NewWebhookDispatcher(maxAttempts int) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Client:       NewWebhookClient(10 * time.Second),
+		MaxAttempts:  maxAttempts,
+		RetryWait:    30 * time.Second,
+		MaxRetryWait: 6 * time.Hour,
+		db:           self,
+	}
+}
+
+// Dispatch fans out new change events and makes the deliveries that
+// are due
+func (self *WebhookDispatcher) Dispatch() (DispatchStats, error) {
+	stats := DispatchStats{}
+
+	webhooks, err := self.db.GetWebhooks()
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Events, err = self.fanOut(webhooks)
+	if err != nil {
+		return stats, err
+	}
+
+	err = self.deliverDue(webhooks, &stats)
+	return stats, err
+}
+
+// fanOut makes a delivery for each webhook that wants each new event,
+// events from before a webhook was added aren't sent to it
+func (self *WebhookDispatcher) fanOut(webhooks []Webhook) (int, error) {
+	outbox := self.db.mongoBroker.outboxCollection()
+	defer self.db.mongoBroker.closeCollection(outbox)
+	deliveries := self.db.mongoBroker.webhookDeliveryCollection()
+	defer self.db.mongoBroker.closeCollection(deliveries)
+
+	events := []ChangeEvent{}
+	err := outbox.Find(bson.M{"fannedOut": false}).Sort("seq").Limit(webhookBatch).All(&events)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, event := range events {
+		for _, webhook := range webhooks {
+			if !webhook.wants(event.Type) || webhook.CreatedDate.After(event.Date) {
+				continue
+			}
+			// Upserted, so a fan out cut short before the event was marked
+			// doesn't make a second delivery when it's redone
+			_, err := deliveries.Upsert(
+				bson.M{"eventId": event.Id, "webhookId": webhook.Id},
+				bson.M{"$setOnInsert": bson.M{
+					"eventType":       event.Type,
+					"status":          DeliveryPending,
+					"attempts":        0,
+					"nextAttemptDate": now,
+					"createdDate":     now,
+				}})
+			if err != nil && !mgo.IsDup(err) {
+				return 0, err
+			}
+		}
+		if err := outbox.UpdateId(event.Id, bson.M{"$set": bson.M{"fannedOut": true}}); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), nil
+}
+
+// deliverDue sends the deliveries that are due, each webhook's in turn
+// but the webhooks side by side, so a slow one doesn't hold up the rest
+func (self *WebhookDispatcher) deliverDue(webhooks []Webhook, stats *DispatchStats) error {
+	deliveries := self.db.mongoBroker.webhookDeliveryCollection()
+	defer self.db.mongoBroker.closeCollection(deliveries)
+
+	byId := make(map[bson.ObjectId]Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byId[webhook.Id] = webhook
+	}
+
+	due := []WebhookDelivery{}
+	err := deliveries.Find(bson.M{
+		"status":          DeliveryPending,
+		"nextAttemptDate": bson.M{"$lte": time.Now()},
+	}).Sort("nextAttemptDate").Limit(webhookBatch).All(&due)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	var firstErr error
+	for _, group := range groupByWebhook(due) {
+		wait.Add(1)
+		go func(group []WebhookDelivery) {
+			defer wait.Done()
+			webhook, found := byId[group[0].WebhookId]
+			groupStats, err := self.deliverTo(webhook, found, group)
+
+			lock.Lock()
+			defer lock.Unlock()
+			stats.Delivered += groupStats.Delivered
+			stats.Failed += groupStats.Failed
+			stats.Dead += groupStats.Dead
+			stats.Skipped += groupStats.Skipped
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(group)
+	}
+	wait.Wait()
+	return firstErr
+}
+
+// deliverTo sends the webhook's due deliveries and records how they went
+func (self *WebhookDispatcher) deliverTo(webhook Webhook, found bool, due []WebhookDelivery) (DispatchStats, error) {
+	stats := DispatchStats{}
+	outbox := self.db.mongoBroker.outboxCollection()
+	defer self.db.mongoBroker.closeCollection(outbox)
+	deliveries := self.db.mongoBroker.webhookDeliveryCollection()
+	defer self.db.mongoBroker.closeCollection(deliveries)
+
+	results := sendInTurn(due, func(delivery WebhookDelivery) error {
+		if !found {
+			return errors.New("webhook was deleted")
+		}
+		event := ChangeEvent{}
+		if err := outbox.FindId(delivery.EventId).One(&event); err != nil {
+			return fmt.Errorf("event is gone from the outbox: %v", err)
+		}
+		return self.post(webhook, event, delivery.Id)
+	})
+	stats.Skipped = len(due) - len(results)
+	if stats.Skipped > 0 {
+		fmt.Printf("[INFO] Webhook %s timed out, leaving %d deliveries for next time\n", due[0].WebhookId.Hex(), stats.Skipped)
+	}
+
+	for _, result := range results {
+		delivery, sendErr := result.delivery, result.err
+
+		now := time.Now()
+		attempts := delivery.Attempts + 1
+		set := bson.M{"attempts": attempts}
+		switch {
+		case sendErr == nil:
+			set["status"] = DeliveryDelivered
+			set["deliveredDate"] = now
+			stats.Delivered++
+		case attempts >= self.MaxAttempts || !found:
+			set["status"] = DeliveryDead
+			set["lastError"] = sendErr.Error()
+			stats.Dead++
+		default:
+			set["nextAttemptDate"] = now.Add(self.retryWait(attempts))
+			set["lastError"] = sendErr.Error()
+			stats.Failed++
+		}
+		if sendErr != nil {
+			fmt.Printf("[ERR] Problem delivering event %s to webhook %s: %s\n", delivery.EventId.Hex(), delivery.WebhookId.Hex(), sendErr)
+		}
+
+		if err := deliveries.UpdateId(delivery.Id, bson.M{"$set": set}); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+type deliveryResult struct {
+	delivery WebhookDelivery
+	err      error
+}
+
+// sendInTurn sends the deliveries one after the other, stopping after
+// one times out, the rest are left as they are for the next Dispatch
+func sendInTurn(due []WebhookDelivery, send func(WebhookDelivery) error) []deliveryResult {
+	results := make([]deliveryResult, 0, len(due))
+	for _, delivery := range due {
+		err := send(delivery)
+		results = append(results, deliveryResult{delivery: delivery, err: err})
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			break
+		}
+	}
+	return results
+}
+
+// groupByWebhook splits the deliveries up by webhook, keeping their order
+func groupByWebhook(due []WebhookDelivery) [][]WebhookDelivery {
+	var groups [][]WebhookDelivery
+	index := make(map[bson.ObjectId]int)
+	for _, delivery := range due {
+		i, found := index[delivery.WebhookId]
+		if !found {
+			i = len(groups)
+			index[delivery.WebhookId] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], delivery)
+	}
+	return groups
+}
+
+// retryWait is how long to wait after the attempt failed
+func (self *WebhookDispatcher) retryWait(attempts int) time.Duration {
+	wait := self.RetryWait
+	for i := 1; i < attempts && wait < self.MaxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > self.MaxRetryWait {
+		wait = self.MaxRetryWait
+	}
+	return wait
+}
+
+// post sends the event, anything but a 2xx is a failure
+func (self *WebhookDispatcher) post(webhook Webhook, event ChangeEvent, deliveryId bson.ObjectId) error {
+	body, err := json.Marshal(NewChangePayload(event))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	req.Header.Set(WebhookDeliveryHeader, deliveryId.Hex())
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(webhook.Secret, timestamp, body))
+
+	resp, err := self.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with: %s", resp.Status)
+	}
+	return nil
+}
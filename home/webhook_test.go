@@ -0,0 +1,244 @@
+package home
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChangeEvents(t *testing.T) {
+
+	type inOut struct {
+		previous    listingState
+		hadPrevious bool
+		current     listingState
+		expect      []string
+	}
+
+	on := listingState{Price: 400, ForSale: true, Images: []string{"a", "b"}}
+
+	cases := []inOut{
+		{listingState{}, false, on, []string{ChangeCreated}},
+		{on, true, on, nil},
+		{on, true, listingState{Price: 380, ForSale: true, Images: []string{"a", "b"}}, []string{ChangePrice}},
+		// Status updates don't know the images
+		{on, true, listingState{Price: 400, ForSale: false}, []string{ChangeStatus}},
+		{on, true, listingState{Price: 380, ForSale: true, Images: []string{"b", "c", "a"}}, []string{ChangePrice, ChangePhotos}},
+		// Fewer photos isn't news
+		{on, true, listingState{Price: 400, ForSale: true, Images: []string{"a"}}, nil},
+	}
+
+	for i, c := range cases {
+		var got []string
+		for _, event := range changeEvents(c.previous, c.hadPrevious, c.current) {
+			got = append(got, event.Type)
+			if event.Type == ChangePhotos && !reflect.DeepEqual(event.Photos, []string{"c"}) {
+				t.Errorf("case %d: photos added == %v, expected [c]", i, event.Photos)
+			}
+			if event.Type == ChangePrice && event.OldPrice != 400 {
+				t.Errorf("case %d: old price == %d, expected 400", i, event.OldPrice)
+			}
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d: changeEvents() types == %v, expected %v", i, got, c.expect)
+		}
+	}
+}
+
+func TestWebhookDispatcherPost(t *testing.T) {
+
+	secret := "shh"
+	var signature, timestamp, eventType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		signature = req.Header.Get(WebhookSignatureHeader)
+		timestamp = req.Header.Get(WebhookTimestampHeader)
+		eventType = req.Header.Get(WebhookEventHeader)
+		if req.URL.Path == "/fail" {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	dispatcher := (&DB{}).NewWebhookDispatcher(3)
+	event := ChangeEvent{Id: bson.NewObjectId(), Type: ChangePrice, ListingId: bson.NewObjectId(), Price: 380, OldPrice: 400}
+
+	// The test server is on loopback, which the real client won't go to
+	if err := dispatcher.post(Webhook{Url: server.URL + "/hook", Secret: secret}, event, bson.NewObjectId()); err == nil {
+		t.Errorf("expected the webhook client to refuse a loopback address")
+	}
+	dispatcher.Client = server.Client()
+
+	err := dispatcher.post(Webhook{Url: server.URL + "/hook", Secret: secret}, event, bson.NewObjectId())
+	if err != nil {
+		t.Fatalf("post() == %v", err)
+	}
+	if eventType != ChangePrice {
+		t.Errorf("event header == %q, expected %q", eventType, ChangePrice)
+	}
+	sent, _ := strconv.ParseInt(timestamp, 10, 64)
+	if expect := "sha256=" + WebhookSignature(secret, sent, body); signature != expect {
+		t.Errorf("signature == %q, expected %q", signature, expect)
+	}
+	if WebhookSignature("wrong", sent, body) == WebhookSignature(secret, sent, body) {
+		t.Errorf("expected the signature to depend on the secret")
+	}
+
+	if err := dispatcher.post(Webhook{Url: server.URL + "/fail", Secret: secret}, event, bson.NewObjectId()); err == nil {
+		t.Errorf("expected an error for a 502")
+	}
+
+	waits := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute}
+	for i, expect := range waits {
+		if got := dispatcher.retryWait(i + 1); got != expect {
+			t.Errorf("retryWait(%d) == %v, expected %v", i+1, got, expect)
+		}
+	}
+	if got := dispatcher.retryWait(30); got != dispatcher.MaxRetryWait {
+		t.Errorf("retryWait(30) == %v, expected the max", got)
+	}
+}
+
+func TestWebhookValidate(t *testing.T) {
+
+	type inOut struct {
+		webhook Webhook
+		valid   bool
+	}
+
+	cases := []inOut{
+		{Webhook{Url: "https://93.184.216.34/hook"}, true},
+		{Webhook{Url: "https://93.184.216.34/hook", Types: []string{ChangePrice}}, true},
+		{Webhook{Url: "https://93.184.216.34/hook", Types: []string{"nope"}}, false},
+		{Webhook{Url: "ftp://93.184.216.34/hook"}, false},
+		{Webhook{Url: "http://127.0.0.1/hook"}, false},
+		{Webhook{Url: "http://localhost:8080/hook"}, false},
+		{Webhook{Url: "http://172.16.0.1/hook"}, false},
+		{Webhook{Url: "http://169.254.169.254/latest/meta-data"}, false},
+		{Webhook{Url: "http://[fe80::1]/hook"}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.webhook.Validate(); (err == nil) != c.valid {
+			t.Errorf("Validate(%+v) == %v, expected valid: %v", c.webhook, err, c.valid)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSendInTurn(t *testing.T) {
+
+	first, second, third := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	due := []WebhookDelivery{{Id: first}, {Id: second}, {Id: third}}
+
+	type inOut struct {
+		errs   map[bson.ObjectId]error
+		expect int
+	}
+
+	cases := []inOut{
+		{map[bson.ObjectId]error{}, 3},
+		// Failing is fine, it goes on to the next
+		{map[bson.ObjectId]error{first: errors.New("502")}, 3},
+		// Timing out leaves the rest for next time
+		{map[bson.ObjectId]error{second: timeoutError{}}, 2},
+		{map[bson.ObjectId]error{first: timeoutError{}}, 1},
+	}
+
+	for i, c := range cases {
+		results := sendInTurn(due, func(delivery WebhookDelivery) error {
+			return c.errs[delivery.Id]
+		})
+		if len(results) != c.expect {
+			t.Errorf("case %d: sendInTurn() sent %d, expected %d", i, len(results), c.expect)
+			continue
+		}
+		for _, result := range results {
+			if result.err != c.errs[result.delivery.Id] {
+				t.Errorf("case %d: result %+v, expected error %v", i, result, c.errs[result.delivery.Id])
+			}
+		}
+	}
+}
+
+func TestGroupByWebhook(t *testing.T) {
+
+	a, b := bson.NewObjectId(), bson.NewObjectId()
+	due := []WebhookDelivery{
+		{Id: "1", WebhookId: a},
+		{Id: "2", WebhookId: b},
+		{Id: "3", WebhookId: a},
+		{Id: "4", WebhookId: b},
+		{Id: "5", WebhookId: a},
+	}
+
+	got := [][]bson.ObjectId{}
+	for _, group := range groupByWebhook(due) {
+		ids := []bson.ObjectId{}
+		for _, delivery := range group {
+			ids = append(ids, delivery.Id)
+		}
+		got = append(got, ids)
+	}
+	expect := [][]bson.ObjectId{{"1", "3", "5"}, {"2", "4"}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("groupByWebhook() == %v, expected %v", got, expect)
+	}
+}
+
+func TestSettledChanges(t *testing.T) {
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	recent := now.Add(-time.Second)
+	stale := now.Add(-2 * OutboxGapWait)
+
+	// Made on different crawlers, so the ids are out of order with the seqs
+	late := bson.ObjectIdHex("5b0000000000000000000009")
+	early := bson.ObjectIdHex("5b0000000000000000000001")
+
+	event := func(id bson.ObjectId, seq int64, date time.Time) ChangeEvent {
+		return ChangeEvent{Id: id, Seq: seq, Date: date}
+	}
+
+	type inOut struct {
+		afterSeq int64
+		events   []ChangeEvent
+		expect   []int64
+	}
+
+	cases := []inOut{
+		// In seq order, whatever the ids
+		{10, []ChangeEvent{event(late, 11, recent), event(early, 12, recent)}, []int64{11, 12}},
+		// 11 has its seq but isn't written yet, 12 waits for it
+		{10, []ChangeEvent{event(early, 12, recent)}, []int64{}},
+		{10, []ChangeEvent{event(late, 11, recent), event(early, 13, recent)}, []int64{11}},
+		// Long enough and 11 isn't coming
+		{10, []ChangeEvent{event(early, 12, stale), event(late, 13, recent)}, []int64{12, 13}},
+		// Starting out, or after the oldest expired
+		{0, []ChangeEvent{event(early, 500, stale), event(late, 501, recent)}, []int64{500, 501}},
+		{10, nil, []int64{}},
+	}
+
+	for i, c := range cases {
+		got := []int64{}
+		for _, event := range settledChanges(c.afterSeq, c.events, now) {
+			got = append(got, event.Seq)
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %d: settledChanges() seqs == %v, expected %v", i, got, c.expect)
+		}
+	}
+}
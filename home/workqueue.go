@@ -0,0 +1,296 @@
+package home
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	HostThrottleCollectionName = "HostThrottle"
+
+	DefaultWorkLeaseTTL    = 2 * time.Minute
+	DefaultWorkMaxAttempts = 3
+)
+
+// Work item states
+const (
+	WorkPending = "pending"
+	WorkClaimed = "claimed"
+	WorkDone    = "done"
+	WorkFailed  = "failed"
+)
+
+// Nothing available to claim right now, either the queue is empty,
+// or everything left is for hosts we have to wait on.
+var ErrNoWork = errors.New("No work available")
+
+// WorkItem Model
+type WorkItem struct {
+	Id       bson.ObjectId `bson:"_id,omitempty"`
+	Url      string        `bson:"url"`
+	Host     string        `bson:"host"`
+	Priority int           `bson:"priority"`
+	State    string        `bson:"state"`
+	Owner    string        `bson:"owner,omitempty"`
+	Attempts int           `bson:"attempts"`
+
+	QueuedDate       time.Time `bson:"queuedDate"`
+	ClaimedDate      time.Time `bson:"claimedDate,omitempty"`
+	LeaseExpiresDate time.Time `bson:"leaseExpiresDate,omitempty"`
+	DoneDate         time.Time `bson:"doneDate,omitempty"`
+}
+
+// WorkQueue is a crawl frontier shared by any number of crawler
+// processes. Items are claimed with a lease, and go back to being
+// available if the claiming worker doesn't ack them before it runs
+// out. Fetches against the same host are spaced out by HostInterval,
+// across every process sharing the database.
+type WorkQueue struct {
+	Name         string
+	Owner        string
+	LeaseTTL     time.Duration
+	HostInterval time.Duration
+	MaxAttempts  int
+
+	collectionName string
+	db             *DB
+}
+
+func (self *DB) NewWorkQueue(name string, hostInterval time.Duration) *WorkQueue {
+	queue := &WorkQueue{
+		Name:           name,
+		Owner:          leaseOwnerId(),
+		LeaseTTL:       DefaultWorkLeaseTTL,
+		HostInterval:   hostInterval,
+		MaxAttempts:    DefaultWorkMaxAttempts,
+		collectionName: PageQueueCollectionPrefix + "-" + name,
+		db:             self,
+	}
+	queue.ensureIndexes()
+	return queue
+}
+
+func (self *WorkQueue) ensureIndexes() {
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+	collection.EnsureIndex(mgo.Index{Key: []string{"url"}, Unique: true})
+	collection.EnsureIndex(mgo.Index{Key: []string{"state", "-priority", "queuedDate"}})
+	collection.EnsureIndex(mgo.Index{Key: []string{"state", "leaseExpiresDate"}})
+}
+
+func (self *WorkQueue) collection() *mgo.Collection {
+	return self.db.mongoBroker.collection(self.collectionName)
+}
+
+// Push adds uris to the queue, ones that were ever queued before are
+// skipped. Returns the number actually added.
+func (self *WorkQueue) Push(priority int, uris ...string) (int, error) {
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	added := 0
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+
+		err = collection.Insert(WorkItem{
+			Url:        uri,
+			Host:       parsed.Host,
+			Priority:   priority,
+			State:      WorkPending,
+			QueuedDate: time.Now(),
+		})
+		if mgo.IsDup(err) {
+			continue
+		}
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// Claim takes the next available item, highest priority first. Items
+// claimed by a worker whose lease ran out are available again, counted
+// as an attempt, since the worker likely crashed or hung on them.
+func (self *WorkQueue) Claim() (*WorkItem, error) {
+
+	if err := self.expireLeases(); err != nil {
+		return nil, err
+	}
+
+	throttled, err := self.throttledHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	query := bson.M{"state": WorkPending}
+	if len(throttled) > 0 {
+		query["host"] = bson.M{"$nin": throttled}
+	}
+
+	item := WorkItem{}
+	_, err = collection.Find(query).Sort("-priority", "queuedDate").Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"state":            WorkClaimed,
+				"owner":            self.Owner,
+				"claimedDate":      now,
+				"leaseExpiresDate": now.Add(self.LeaseTTL),
+			},
+		},
+		ReturnNew: true,
+	}, &item)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNoWork
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Someone else may have beat us to this host in the meantime
+	reserved, err := self.reserveHost(item.Host)
+	if err != nil || !reserved {
+		self.Release(&item)
+		if err == nil {
+			err = ErrNoWork
+		}
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// expireLeases hands back the items whose lease ran out, as a failed
+// attempt, and gives up on the ones out of attempts
+func (self *WorkQueue) expireLeases() error {
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	expired := func(lastAttempt bool) bson.M {
+		selector := bson.M{"state": WorkClaimed, "leaseExpiresDate": bson.M{"$lt": now}}
+		if lastAttempt {
+			selector["attempts"] = bson.M{"$gte": self.MaxAttempts - 1}
+		}
+		return selector
+	}
+	update := func(state string) bson.M {
+		return bson.M{
+			"$set":   bson.M{"state": state},
+			"$inc":   bson.M{"attempts": 1},
+			"$unset": bson.M{"owner": "", "leaseExpiresDate": ""},
+		}
+	}
+
+	// Out of attempts first, so the rest are only the ones with some left
+	if _, err := collection.UpdateAll(expired(true), update(WorkFailed)); err != nil {
+		return err
+	}
+	_, err := collection.UpdateAll(expired(false), update(WorkPending))
+	return err
+}
+
+// Ack marks an item as finished
+func (self *WorkQueue) Ack(item *WorkItem) error {
+	return self.finish(item, bson.M{"state": WorkDone, "doneDate": time.Now()})
+}
+
+// Release hands an item back without counting it as an attempt, ie:
+// when shutting down in the middle of it.
+func (self *WorkQueue) Release(item *WorkItem) error {
+	return self.finish(item, bson.M{"state": WorkPending})
+}
+
+// Fail hands an item back to be tried again, until it runs out of
+// attempts.
+func (self *WorkQueue) Fail(item *WorkItem) error {
+	state := WorkPending
+	if item.Attempts+1 >= self.MaxAttempts {
+		state = WorkFailed
+	}
+	return self.finish(item, bson.M{"state": state, "attempts": item.Attempts + 1})
+}
+
+func (self *WorkQueue) finish(item *WorkItem, set bson.M) error {
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	err := collection.Update(
+		// Only if we still hold it
+		bson.M{"_id": item.Id, "state": WorkClaimed, "owner": self.Owner},
+		bson.M{
+			"$set":   set,
+			"$unset": bson.M{"owner": "", "leaseExpiresDate": ""},
+		})
+	if err == mgo.ErrNotFound {
+		return errors.New("Work item lease was lost: " + item.Url)
+	}
+	return err
+}
+
+// Remaining returns how many items are waiting or being worked on
+func (self *WorkQueue) Remaining() (int, error) {
+	collection := self.collection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	return collection.Find(bson.M{"state": bson.M{"$in": []string{WorkPending, WorkClaimed}}}).Count()
+}
+
+// Host Throttling
+
+func (self *WorkQueue) throttledHosts() ([]string, error) {
+	if self.HostInterval == 0 {
+		return nil, nil
+	}
+
+	collection := self.db.mongoBroker.hostThrottleCollection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	type document struct {
+		Host string `bson:"_id"`
+	}
+	var result []document
+
+	err := collection.Find(bson.M{"nextFetchDate": bson.M{"$gt": time.Now()}}).All(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, len(result))
+	for i, doc := range result {
+		hosts[i] = doc.Host
+	}
+	return hosts, nil
+}
+
+// reserveHost atomically takes the next fetch slot for the host,
+// returns false if the host is still waiting on its last fetch.
+func (self *WorkQueue) reserveHost(host string) (bool, error) {
+	if self.HostInterval == 0 {
+		return true, nil
+	}
+
+	collection := self.db.mongoBroker.hostThrottleCollection()
+	defer self.db.mongoBroker.closeCollection(collection)
+
+	now := time.Now()
+	_, err := collection.Upsert(
+		bson.M{"_id": host, "nextFetchDate": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextFetchDate": now.Add(self.HostInterval)}})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}